@@ -58,10 +58,17 @@ func main() {
 	if err != nil {
 		log.Panic("Config not valid", err)
 	}
-	s, err := server.NewServer(config.ServerVersion, mysql.AuthNativePassword)
+	s, err := server.NewServer(config.ServerVersion, mysql.AuthNativePassword, config.Connections,
+		server.WithCompression(config.CompressionAlgorithms, config.ZstdCompressionLevel), server.WithMaxPacketSize(config.MaxPacketSize))
 	if err != nil {
 		log.Panic("Error creating server", err)
 	}
+	go func() {
+		err := s.ServeAdmin(config.WebPort)
+		if err != nil {
+			log.Printf("Error serving the admin interface: %v", err)
+		}
+	}()
 	s.Serve(config.ServerPort)
 	//close
 }
@@ -12,8 +12,10 @@ func TestLauncher(t *testing.T) {
 	urlConfig := "../../docs/config.json"
 	config, err := getConfig(urlConfig)
 	assert.NilError(t, err, "Err must be nil")
-	_, err = server.NewServer(config.ServerVersion, mysql.AuthNativePassword)
+	s, err := server.NewServer(config.ServerVersion, mysql.AuthNativePassword, config.Connections)
 	assert.NilError(t, err, "Err must be nil")
+	//the lag checkers and the health checks of the config dial until closed
+	defer s.Close()
 	//ch := make(chan error)
 	//go func() {
 	//	err = s.Serve(config.ServerPort)
@@ -1,9 +1,13 @@
 module github.com/rafalopez79/godriver
 
-go 1.13
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	gotest.tools v2.2.0+incompatible
+)
 
 require (
 	github.com/google/go-cmp v0.3.1 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	gotest.tools v2.2.0+incompatible
 )
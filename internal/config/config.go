@@ -2,16 +2,77 @@ package config
 
 import (
 	"encoding/json"
+	"strings"
 )
 
 //Connection cloud info
 type Connection struct {
-	ID         string `json:"id"  binding:"required"`
-	User       string `json:"user"  binding:"required"`
-	Password   string `json:"password"  binding:"required"`
-	DBUser     string `json:"dbuser"  binding:"required"`
-	DBPassword string `json:"dbpassword"  binding:"required"`
-	DSNS       string `json:"dsns"  binding:"required"`
+	ID         string  `json:"id"  binding:"required"`
+	User       string  `json:"user"  binding:"required"`
+	Password   string  `json:"password"  binding:"required"`
+	DBUser     string  `json:"dbuser"  binding:"required"`
+	DBPassword string  `json:"dbpassword"  binding:"required"`
+	DSNS       DSNList `json:"dsns"  binding:"required"`
+	AuthPlugin string  `json:"authplugin"` //empty for the server default
+	//backend connection pool, 0 for the defaults
+	PoolMinSize     int `json:"poolminsize"`
+	PoolMaxSize     int `json:"poolmaxsize"`
+	PoolIdleTimeout int `json:"poolidletimeout"` //seconds
+	PoolMaxLifetime int `json:"poolmaxlifetime"` //seconds
+	PoolWaitTimeout int `json:"poolwaittimeout"` //seconds waiting for a free connection
+	//backend failover, 0 for the defaults
+	FailoverRetries  int `json:"failoverretries"`  //connection retries of a DSN before the next one
+	FailoverBackoff  int `json:"failoverbackoff"`  //milliseconds before the first retry, doubled on each one
+	FailbackInterval int `json:"failbackinterval"` //seconds between checks of the previous DSNs, 0 to stay
+	//read/write splitting, SELECTs out of transactions go to a replica
+	Replicas       DSNList `json:"replicas"`
+	ReadYourWrites int     `json:"readyourwrites"` //milliseconds reading from the primary after a write of the user
+	//replica of a session: roundrobin, weighted, leastoutstanding, hashuser or hashaddress, empty for roundrobin
+	Balancer       string `json:"balancer"`
+	ReplicaWeights []int  `json:"replicaweights"` //of the weighted balancer, by replica, 1 if missing
+	//replica lag, replicas over ReplicaMaxLag are out of rotation
+	ReplicaMaxLag      int    `json:"replicamaxlag"`      //seconds, 0 not to check the lag
+	ReplicaLagQuery    string `json:"replicalagquery"`    //lag in seconds, e.g. from a heartbeat table, empty for SHOW REPLICA STATUS
+	ReplicaLagInterval int    `json:"replicalaginterval"` //seconds between checks, 0 for the default
+	//health checks of the DSNs and replicas, DSNs down are skipped
+	HealthCheckInterval  int `json:"healthcheckinterval"`  //seconds between pings, 0 not to check
+	HealthCheckTimeout   int `json:"healthchecktimeout"`   //milliseconds, 0 for the default
+	HealthCheckFailures  int `json:"healthcheckfailures"`  //consecutive failed pings to mark a DSN down, 0 for the default
+	HealthCheckSuccesses int `json:"healthchecksuccesses"` //consecutive successful pings to mark it up again, 0 for the default
+}
+
+//DSNList ordered backend DSNs, the first one is the primary.
+//In JSON it is an array or a string of comma separated DSNs
+type DSNList []string
+
+//ParseDSNList parses comma separated DSNs or a JSON array
+func ParseDSNList(s string) (DSNList, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		var list []string
+		err := json.Unmarshal([]byte(s), &list)
+		return DSNList(list), err
+	}
+	var list DSNList
+	for _, dsn := range strings.Split(s, ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			list = append(list, dsn)
+		}
+	}
+	return list, nil
+}
+
+//UnmarshalJSON decodes an array or a string of DSNs
+func (list *DSNList) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*list, err = ParseDSNList(s)
+		return err
+	}
+	var dsns []string
+	err = json.Unmarshal(data, &dsns)
+	*list = DSNList(dsns)
+	return err
 }
 
 //Configuration server config
@@ -20,6 +81,12 @@ type Configuration struct {
 	ServerPort    int          `json:"serverport" binding:"required"`
 	WebPort       int          `json:"webport" binding:"required"`
 	Connections   []Connection `json:"connections" binding:"required"`
+	//zlib, zstd or uncompressed, empty for all
+	CompressionAlgorithms []string `json:"compressionalgorithms"`
+	//zstd level, 0 for the client level
+	ZstdCompressionLevel int `json:"zstdcompressionlevel"`
+	//max size of the packets read from clients, 0 for the default
+	MaxPacketSize uint32 `json:"maxpacketsize"`
 }
 
 //Parse the string
@@ -11,9 +11,13 @@ func TestParse(t *testing.T) {
 	  "serverversion": 	"5.5.5-test",
 	  "serverport": 8000,
 	   "webport": 8080,
+	   "compressionalgorithms": ["zstd", "uncompressed"],
+	   "zstdcompressionlevel": 5,
+	   "maxpacketsize": 1048576,
 	   "connections": [
-		{"id": "test1", "user": "user1", "password":"password1"},
-		{"id": "test2", "user": "user2", "password":"password2"}
+		{"id": "test1", "user": "user1", "password":"password1", "poolminsize": 1, "poolmaxsize": 20, "poolidletimeout": 60, "poolmaxlifetime": 600, "poolwaittimeout": 5, "replicas": "tcp(db2:3306)/test", "readyourwrites": 500, "balancer": "hashuser", "replicaweights": [2], "replicamaxlag": 5, "replicalagquery": "SELECT lag FROM heartbeat",
+		 "healthcheckinterval": 5, "healthchecktimeout": 1000, "healthcheckfailures": 3, "healthchecksuccesses": 2},
+		{"id": "test2", "user": "user2", "password":"password2", "authplugin": "caching_sha2_password"}
 		]}`
 	c, err := Parse([]byte(txt))
 	if err != nil {
@@ -23,5 +27,52 @@ func TestParse(t *testing.T) {
 		assert.Equal(t, c.Connections[0].ID, "test1")
 		assert.Equal(t, c.Connections[0].User, "user1")
 		assert.Equal(t, c.Connections[1].Password, "password2")
+		assert.Equal(t, c.Connections[0].AuthPlugin, "")
+		assert.Equal(t, c.Connections[1].AuthPlugin, "caching_sha2_password")
+		assert.DeepEqual(t, c.CompressionAlgorithms, []string{"zstd", "uncompressed"})
+		assert.Equal(t, c.ZstdCompressionLevel, 5)
+		assert.Equal(t, c.MaxPacketSize, uint32(1048576))
+		assert.Equal(t, c.Connections[0].PoolMinSize, 1)
+		assert.Equal(t, c.Connections[0].PoolMaxSize, 20)
+		assert.Equal(t, c.Connections[0].PoolIdleTimeout, 60)
+		assert.Equal(t, c.Connections[0].PoolMaxLifetime, 600)
+		assert.Equal(t, c.Connections[0].PoolWaitTimeout, 5)
+		assert.Equal(t, c.Connections[1].PoolMaxSize, 0)
+		assert.DeepEqual(t, c.Connections[0].Replicas, DSNList{"tcp(db2:3306)/test"})
+		assert.Equal(t, c.Connections[0].ReadYourWrites, 500)
+		assert.Equal(t, len(c.Connections[1].Replicas), 0)
+		assert.Equal(t, c.Connections[0].ReplicaMaxLag, 5)
+		assert.Equal(t, c.Connections[0].ReplicaLagQuery, "SELECT lag FROM heartbeat")
+		assert.Equal(t, c.Connections[0].ReplicaLagInterval, 0)
+		assert.Equal(t, c.Connections[0].HealthCheckInterval, 5)
+		assert.Equal(t, c.Connections[0].HealthCheckTimeout, 1000)
+		assert.Equal(t, c.Connections[0].HealthCheckFailures, 3)
+		assert.Equal(t, c.Connections[0].HealthCheckSuccesses, 2)
+		assert.Equal(t, c.Connections[1].HealthCheckInterval, 0)
+		assert.Equal(t, c.Connections[0].Balancer, "hashuser")
+		assert.DeepEqual(t, c.Connections[0].ReplicaWeights, []int{2})
+		assert.Equal(t, c.Connections[1].Balancer, "")
 	}
 }
+
+func TestDSNList(t *testing.T) {
+	txt := `{"connections": [
+		{"id": "test1", "dsns": "tcp(db1:3306)/test, tcp(db2:3306)/test,"},
+		{"id": "test2", "dsns": ["tcp(db1:3306)/test", "unix(/tmp/mysql.sock)/test"]},
+		{"id": "test3", "dsns": "[\"tcp(db1:3306)/test\"]"},
+		{"id": "test4", "dsns": ""},
+		{"id": "test5"}
+		]}`
+	c, err := Parse([]byte(txt))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, c.Connections[0].DSNS, DSNList{"tcp(db1:3306)/test", "tcp(db2:3306)/test"})
+	assert.DeepEqual(t, c.Connections[1].DSNS, DSNList{"tcp(db1:3306)/test", "unix(/tmp/mysql.sock)/test"})
+	assert.DeepEqual(t, c.Connections[2].DSNS, DSNList{"tcp(db1:3306)/test"})
+	assert.Equal(t, len(c.Connections[3].DSNS), 0)
+	assert.Equal(t, len(c.Connections[4].DSNS), 0)
+
+	_, err = Parse([]byte(`{"connections": [{"id": "test1", "dsns": 1}]}`))
+	assert.ErrorContains(t, err, "cannot unmarshal")
+	_, err = ParseDSNList("[tcp(db1:3306)/test]")
+	assert.Assert(t, err != nil)
+}
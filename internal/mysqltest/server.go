@@ -0,0 +1,654 @@
+//Package mysqltest provides an in-process fake MySQL server for tests
+package mysqltest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//Version of the fake server
+const Version = "8.0.0-fake"
+
+//capability of the fake server
+const capability uint32 = mysql.ClientLongPassword | mysql.ClientLongFlag | mysql.ClientConnectWithDB |
+	mysql.ClientProtocol41 | mysql.ClientTransactions | mysql.ClientSecureConnection | mysql.ClientMultiStatements |
+	mysql.ClientMultiResults | mysql.ClientPSMultiResults | mysql.ClientPluginAuth | mysql.ClientPluginAuthLENENCClientData
+
+//Result answer of a query: an error, an OK or a resultset of text rows
+type Result struct {
+	Err          *mysql.Error
+	AffectedRows uint64
+	LastInsertID uint64
+	Fields       []*mysql.Field
+	Rows         [][]interface{}
+	RowsErr      *mysql.Error //sent after the rows instead of the end of the resultset
+}
+
+//Server fake MySQL server accepting a user, answering the configured results
+type Server struct {
+	Addr       string
+	user       string
+	password   string
+	authMethod string
+	switchTo   string // auth switch to this method, empty for none
+	fastAuth   bool   // caching_sha2_password fast auth
+	noReset    bool   // COM_RESET_CONNECTION not supported
+	down       bool   // new connections are closed
+	tlsConfig  *tls.Config
+	privKey    *rsa.PrivateKey
+	pubKey     []byte
+	listener   net.Listener
+	mutex      sync.Mutex
+	results    map[string]*Result
+	queries    []string
+	conns      map[net.Conn]bool
+	lastConnID uint32
+	resets     int    //COM_RESET_CONNECTION and COM_CHANGE_USER received
+	collations []byte //of the handshake responses and COM_CHANGE_USER received
+}
+
+//NewServer starts a fake server on a random local port, the options are applied before listening
+func NewServer(user string, password string, options ...func(*Server)) (server *Server, err error) {
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	server = &Server{
+		user:       user,
+		password:   password,
+		authMethod: mysql.AuthNativePassword,
+		privKey:    privKey,
+		pubKey:     pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		results:    make(map[string]*Result),
+		conns:      make(map[net.Conn]bool),
+	}
+	for _, option := range options {
+		option(server)
+	}
+	server.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server.Addr = server.listener.Addr().String()
+	go server.serve()
+	return server, nil
+}
+
+//WithAuthMethod sets the default auth method
+func WithAuthMethod(authMethod string) func(*Server) {
+	return func(server *Server) {
+		server.authMethod = authMethod
+	}
+}
+
+//WithAuthSwitch switches the clients to the auth method after the handshake response
+func WithAuthSwitch(authMethod string) func(*Server) {
+	return func(server *Server) {
+		server.switchTo = authMethod
+	}
+}
+
+//WithFastAuth accepts caching_sha2_password scrambles without full auth
+func WithFastAuth() func(*Server) {
+	return func(server *Server) {
+		server.fastAuth = true
+	}
+}
+
+//WithoutResetConnection answers COM_RESET_CONNECTION as an unknown command, like servers before 5.7.3
+func WithoutResetConnection() func(*Server) {
+	return func(server *Server) {
+		server.noReset = true
+	}
+}
+
+//WithTLS accepts TLS with a self signed certificate
+func WithTLS() func(*Server) {
+	return func(server *Server) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "mysqltest"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		server.tlsConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	}
+}
+
+//SetResult sets the answer of a query
+func (server *Server) SetResult(query string, result *Result) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.results[query] = result
+}
+
+//Queries returns the queries received
+func (server *Server) Queries() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.queries...)
+}
+
+//Connections returns the number of open connections
+func (server *Server) Connections() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.conns)
+}
+
+//Resets returns the number of session resets, by COM_RESET_CONNECTION or COM_CHANGE_USER
+func (server *Server) Resets() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.resets
+}
+
+//Collations returns the collations of the handshake responses and COM_CHANGE_USER received
+func (server *Server) Collations() []byte {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]byte{}, server.collations...)
+}
+
+//addCollation records a collation requested by a client
+func (server *Server) addCollation(collation byte) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.collations = append(server.collations, collation)
+}
+
+//SetDown closes the new connections before the handshake while down
+func (server *Server) SetDown(down bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.down = down
+}
+
+//CloseConnections closes the open connections, the server keeps listening
+func (server *Server) CloseConnections() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for conn := range server.conns {
+		conn.Close()
+	}
+}
+
+//Close stops listening and closes the connections
+func (server *Server) Close() error {
+	err := server.listener.Close()
+	server.CloseConnections()
+	return err
+}
+
+func (server *Server) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mutex.Lock()
+		if server.down {
+			server.mutex.Unlock()
+			conn.Close()
+			continue
+		}
+		server.conns[conn] = true
+		server.lastConnID++
+		connID := server.lastConnID
+		server.mutex.Unlock()
+		go func() {
+			defer func() {
+				conn.Close()
+				server.mutex.Lock()
+				delete(server.conns, conn)
+				server.mutex.Unlock()
+			}()
+			fake := &fakeConn{
+				server: server,
+				conn:   conn,
+				reader: conn,
+				writer: conn,
+				pool:   util.NewBufferPool(),
+				status: mysql.ServerStatusAutocommit,
+			}
+			if fake.accept(connID) == nil {
+				fake.handle()
+			}
+		}()
+	}
+}
+
+//fakeConn server side of a fake connection
+type fakeConn struct {
+	server     *Server
+	conn       net.Conn
+	reader     io.Reader
+	writer     io.Writer
+	seq        byte
+	pool       *util.BufferPool
+	capability uint32
+	status     uint16
+	salt       []byte
+	db         string //current schema
+}
+
+func (fake *fakeConn) read() ([]byte, error) {
+	packet, err := mysql.ReadPacket(fake.reader, &fake.seq, 0, fake.pool)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, packet.Body.Bytes()...), nil
+}
+
+func (fake *fakeConn) write(body []byte) error {
+	return mysql.WritePacket(fake.writer, &fake.seq, mysql.NewPacket(func(p *mysql.Packet) {
+		p.Body = bytes.NewBuffer(body)
+	}))
+}
+
+func (fake *fakeConn) writeOK(ok *mysql.OKPacket) error {
+	ok.Status |= fake.status
+	buffer := new(bytes.Buffer)
+	ok.Write(buffer, fake.capability)
+	return fake.write(buffer.Bytes())
+}
+
+func (fake *fakeConn) writeError(e *mysql.Error) error {
+	buffer := new(bytes.Buffer)
+	e.ERRPacket().Write(buffer, fake.capability)
+	return fake.write(buffer.Bytes())
+}
+
+//accept performs the server side of the connection phase
+func (fake *fakeConn) accept(connID uint32) (err error) {
+	server := fake.server
+	fake.salt = []byte("abcdefghijklmnopqrst")
+	serverCapability := capability
+	if server.tlsConfig != nil {
+		serverCapability |= mysql.ClientSSL
+	}
+	handshake := &mysql.Handshake{
+		ProtocolVersion: mysql.MinProtocolVersion,
+		ServerVersion:   Version,
+		ConnectionID:    connID,
+		Salt:            fake.salt,
+		Capability:      serverCapability,
+		Collation:       mysql.DefaultCollationID,
+		Status:          fake.status,
+		AuthPlugin:      server.authMethod,
+	}
+	buffer := new(bytes.Buffer)
+	handshake.Write(buffer)
+	err = fake.write(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	body, err := fake.read()
+	if err != nil {
+		return err
+	}
+	if mysql.IsSSLRequest(len(body)) {
+		tlsConn := tls.Server(fake.conn, server.tlsConfig)
+		err = tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+		fake.conn = tlsConn
+		fake.reader = tlsConn
+		fake.writer = tlsConn
+		body, err = fake.read()
+		if err != nil {
+			return err
+		}
+	}
+	resp, err := mysql.ReadHandshakeResponse(bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	fake.capability = resp.Capability & serverCapability
+	fake.db = resp.Database
+	server.addCollation(resp.Collation)
+	authMethod, auth := resp.AuthPlugin, resp.AuthResponse
+	if server.switchTo != "" {
+		authMethod = server.switchTo
+		auth, err = fake.switchAuth(authMethod, []byte("ABCDEFGHIJKLMNOPQRST"))
+		if err != nil {
+			return err
+		}
+	}
+	ok, err := fake.authenticate(authMethod, auth)
+	if err != nil {
+		return err
+	} else if resp.User != server.user || !ok {
+		e := mysql.NewError(mysql.ErrAccessDeniedError, resp.User, "127.0.0.1", "YES")
+		fake.writeError(e)
+		return e
+	}
+	return fake.writeOK(&mysql.OKPacket{})
+}
+
+//switchAuth sends an AuthSwitchRequest with the salt and returns the auth response
+func (fake *fakeConn) switchAuth(authMethod string, salt []byte) ([]byte, error) {
+	fake.salt = salt
+	buffer := new(bytes.Buffer)
+	mysql.WriteBytes(buffer, mysql.AuthSwitchHeader)
+	mysql.WriteNullTerminatedString(buffer, authMethod)
+	mysql.Write(buffer, salt)
+	mysql.WriteBytes(buffer, 0)
+	err := fake.write(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return fake.read()
+}
+
+//changeUser authenticates the user again with the server auth method, resetting the session
+func (fake *fakeConn) changeUser(body []byte) error {
+	server := fake.server
+	buffer := bytes.NewBuffer(body)
+	user, err := mysql.ReadNullTerminatedString(buffer)
+	if err != nil {
+		return err
+	}
+	authLen, err := buffer.ReadByte()
+	if err != nil {
+		return err
+	}
+	buffer.Next(int(authLen))
+	db, err := mysql.ReadNullTerminatedString(buffer)
+	if err != nil {
+		return err
+	}
+	collation, err := mysql.ReadInt2(buffer)
+	if err != nil {
+		return err
+	}
+	server.addCollation(byte(collation))
+	auth, err := fake.switchAuth(server.authMethod, []byte("0123456789abcdefghij"))
+	if err != nil {
+		return err
+	}
+	ok, err := fake.authenticate(server.authMethod, auth)
+	if err != nil {
+		return err
+	} else if user != server.user || !ok {
+		e := mysql.NewError(mysql.ErrAccessDeniedError, user, "127.0.0.1", "YES")
+		fake.writeError(e)
+		return e
+	}
+	fake.db = db
+	return fake.reset()
+}
+
+//reset clears the session state
+func (fake *fakeConn) reset() error {
+	server := fake.server
+	server.mutex.Lock()
+	server.resets++
+	server.mutex.Unlock()
+	fake.status = mysql.ServerStatusAutocommit
+	return fake.writeOK(&mysql.OKPacket{})
+}
+
+//authenticate checks the auth response of the method
+func (fake *fakeConn) authenticate(authMethod string, auth []byte) (bool, error) {
+	password := fake.server.password
+	switch authMethod {
+	case mysql.AuthNativePassword:
+		return mysql.CheckNativePassword(fake.salt, auth, mysql.NativePasswordHash(password)), nil
+	case mysql.AuthCachingSHA2Password:
+		if fake.server.fastAuth {
+			ok := mysql.CheckSHA256Password(fake.salt, auth, mysql.SHA256PasswordHash(password))
+			if ok {
+				return true, fake.write([]byte{mysql.MoreDataHeader, mysql.CacheSHA2FastAuth})
+			}
+		}
+		err := fake.write([]byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+		if err != nil {
+			return false, err
+		}
+		auth, err = fake.read()
+		if err != nil {
+			return false, err
+		}
+		clear, err := fake.readPassword(auth, mysql.CacheSHA2RequestPublicKey)
+		return clear == password, err
+	case mysql.AuthSHA2Password:
+		if len(auth) == 1 && auth[0] == 0 {
+			return password == "", nil
+		}
+		clear, err := fake.readPassword(auth, mysql.SHA256RequestPublicKey)
+		return clear == password, err
+	}
+	return false, nil
+}
+
+//readPassword returns the clear text password over TLS, or the RSA encrypted one sending the public key on request
+func (fake *fakeConn) readPassword(auth []byte, requestPublicKey byte) (string, error) {
+	if _, ok := fake.conn.(*tls.Conn); ok {
+		return mysql.ReadNullTerminatedString(bytes.NewBuffer(auth))
+	}
+	if len(auth) == 1 && auth[0] == requestPublicKey {
+		err := fake.write(append([]byte{mysql.MoreDataHeader}, fake.server.pubKey...))
+		if err != nil {
+			return "", err
+		}
+		auth, err = fake.read()
+		if err != nil {
+			return "", err
+		}
+	}
+	clear, err := mysql.DecryptPassword(fake.salt, auth, fake.server.privKey)
+	if err != nil {
+		return "", nil
+	}
+	return clear, nil
+}
+
+//handle answers commands until COM_QUIT
+func (fake *fakeConn) handle() {
+	for {
+		fake.seq = 0
+		body, err := fake.read()
+		if err != nil || len(body) == 0 {
+			return
+		}
+		switch body[0] {
+		case mysql.ComQuit:
+			return
+		case mysql.ComPing:
+			err = fake.writeOK(&mysql.OKPacket{})
+		case mysql.ComInitDB:
+			fake.db = string(body[1:])
+			err = fake.writeOK(&mysql.OKPacket{})
+		case mysql.ComResetConnection:
+			if fake.server.noReset {
+				err = fake.writeError(mysql.NewError(mysql.ErrUnknownComError))
+			} else {
+				err = fake.reset()
+			}
+		case mysql.ComChangeUser:
+			err = fake.changeUser(body[1:])
+		case mysql.ComQuery:
+			err = fake.query(string(body[1:]))
+		case mysql.ComSTMTPrepare:
+			err = fake.prepare(string(body[1:]))
+		case mysql.ComSTMTExecute:
+			err = fake.execute(body[1:])
+		case mysql.ComSTMTClose:
+		default:
+			err = fake.writeError(mysql.NewError(mysql.ErrUnknownComError))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+//query answers the results of the statements of the query, separated by ';'
+func (fake *fakeConn) query(query string) (err error) {
+	statements := []string{query}
+	if fake.capability&mysql.ClientMultiStatements != 0 {
+		statements = splitStatements(query)
+	}
+	for i, statement := range statements {
+		server := fake.server
+		server.mutex.Lock()
+		server.queries = append(server.queries, statement)
+		result, ok := server.results[statement]
+		server.mutex.Unlock()
+		switch statement {
+		case "BEGIN", "START TRANSACTION":
+			fake.status |= mysql.ServerStatusInTrans
+		case "COMMIT", "ROLLBACK":
+			fake.status &^= mysql.ServerStatusInTrans
+		}
+		var more uint16
+		if i < len(statements)-1 {
+			more = mysql.ServerStatusMoreResultsExists
+		}
+		switch {
+		case !ok && statement == "SELECT DATABASE()":
+			//the current schema, NULL for none
+			var db interface{}
+			if fake.db != "" {
+				db = fake.db
+			}
+			fields := []*mysql.Field{mysql.NewField("DATABASE()", mysql.MYSQLTypeVarString)}
+			err = mysql.WriteResultset(fake.writer, &fake.seq, fake.capability, fake.status|more, fields, [][]interface{}{{db}})
+		case !ok && isLoadData(statement):
+			err = fake.loadData(more)
+		case !ok:
+			//unknown statements are accepted
+			err = fake.writeOK(&mysql.OKPacket{Status: more})
+		case result.Err != nil:
+			return fake.writeError(result.Err)
+		case result.RowsErr != nil:
+			return fake.writeRowsError(result, more)
+		case result.Fields == nil:
+			err = fake.writeOK(&mysql.OKPacket{AffectedRows: result.AffectedRows, LastInsertID: result.LastInsertID, Status: more})
+		default:
+			err = mysql.WriteResultset(fake.writer, &fake.seq, fake.capability, fake.status|more, result.Fields, result.Rows)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//writeRowsError writes the column definitions and the rows of the result, ended by its error
+func (fake *fakeConn) writeRowsError(result *Result, more uint16) (err error) {
+	rs := mysql.NewResultset(fake.writer, &fake.seq, fake.capability, result.Fields)
+	err = rs.WriteFields(fake.status | more)
+	if err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		err = rs.WriteRow(row...)
+		if err != nil {
+			return err
+		}
+	}
+	return fake.writeError(result.RowsErr)
+}
+
+//loadData requests a LOCAL INFILE and answers the bytes received as affected rows
+func (fake *fakeConn) loadData(more uint16) (err error) {
+	err = fake.write(append([]byte{mysql.LocalInfileHeader}, "data.csv"...))
+	if err != nil {
+		return err
+	}
+	var n uint64
+	for {
+		body, err := fake.read()
+		if err != nil {
+			return err
+		} else if len(body) == 0 {
+			break
+		}
+		n += uint64(len(body))
+	}
+	return fake.writeOK(&mysql.OKPacket{AffectedRows: n, Status: more})
+}
+
+//prepare answers a statement of a param and a column
+func (fake *fakeConn) prepare(query string) (err error) {
+	buffer := new(bytes.Buffer)
+	(&mysql.StmtPrepareOK{StatementID: 1, ColumnCount: 1, ParamCount: 1}).Write(buffer)
+	err = fake.write(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, field := range []*mysql.Field{mysql.NewField("?", mysql.MYSQLTypeVarString), mysql.NewField("value", mysql.MYSQLTypeVarString)} {
+		buffer.Reset()
+		field.Write(buffer)
+		err = fake.write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+		buffer.Reset()
+		(&mysql.EOFPacket{Status: fake.status}).Write(buffer, fake.capability)
+		err = fake.write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//execute answers a row with the param
+func (fake *fakeConn) execute(body []byte) (err error) {
+	execute, err := mysql.ReadStmtExecute(bytes.NewBuffer(body), 1, nil, nil)
+	if err != nil {
+		return fake.writeError(mysql.NewError(mysql.ErrWrongArguments, "mysqld_stmt_execute"))
+	}
+	fields := []*mysql.Field{mysql.NewField("value", mysql.MYSQLTypeVarString)}
+	rs := mysql.NewResultset(fake.writer, &fake.seq, fake.capability, fields)
+	err = rs.WriteFields(fake.status)
+	if err != nil {
+		return err
+	}
+	err = rs.WriteBinaryRow(execute.Params[0])
+	if err != nil {
+		return err
+	}
+	return rs.WriteEnd(fake.status, 0)
+}
+
+func splitStatements(query string) []string {
+	var statements []string
+	for _, statement := range bytes.Split([]byte(query), []byte(";")) {
+		statement = bytes.TrimSpace(statement)
+		if len(statement) > 0 {
+			statements = append(statements, string(statement))
+		}
+	}
+	return statements
+}
+
+func isLoadData(statement string) bool {
+	return bytes.HasPrefix(bytes.ToUpper([]byte(statement)), []byte("LOAD DATA LOCAL"))
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//ReplicaLag state of a replica lag checker on the admin interface
+type ReplicaLag struct {
+	Connection string  `json:"connection"`
+	Replica    string  `json:"replica"`         //DSN without credentials
+	Lag        float64 `json:"lag"`             //seconds, of the last successful check
+	MaxLag     float64 `json:"maxlag"`          //seconds
+	InRotation bool    `json:"inrotation"`      //reads are routed to the replica
+	Error      string  `json:"error,omitempty"` //of the last check
+}
+
+//ReplicaLags returns the state of the replica lag checkers
+func (server *Server) ReplicaLags() []ReplicaLag {
+	var keys []string
+	server.lagCheckers.Range(func(key, checker interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	lags := make([]ReplicaLag, 0, len(keys))
+	for _, key := range keys {
+		checker, _ := server.lagCheckers.Load(key)
+		lags = append(lags, checker.(*LagChecker).state())
+	}
+	return lags
+}
+
+//state returns the admin state of the checker
+func (checker *LagChecker) state() ReplicaLag {
+	lag, err := checker.Lag()
+	replica := "invalid DSN"
+	if dsn, dsnErr := mysql.ParseDSN(checker.dsn); dsnErr == nil {
+		dsn.User = ""
+		replica = dsn.String()
+	}
+	state := ReplicaLag{
+		checker.connection.ID,
+		replica,
+		lag.Seconds(),
+		checker.maxLag.Seconds(),
+		err == nil && lag <= checker.maxLag,
+		"",
+	}
+	if err != nil {
+		state.Error = err.Error()
+	}
+	return state
+}
+
+//AdminHandler returns the handler of the admin interface:
+//GET /replicas returns the replica lags as JSON
+func (server *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replicas", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(server.ReplicaLags())
+		if err != nil {
+			log.Printf("Error writing replica lags: %v", err)
+		}
+	})
+	return mux
+}
+
+//ServeAdmin serves the admin interface on the port
+func (server *Server) ServeAdmin(port int) error {
+	return http.ListenAndServe(fmt.Sprintf(":%d", port), server.AdminHandler())
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//ErrAccessDenied returned by an Authenticator for wrong credentials
+var ErrAccessDenied = errors.New("Access denied")
+
+//AuthRequest with the client credentials
+type AuthRequest struct {
+	Response    *mysql.HandshakeResponse // parsed handshake response, AuthResponse after any auth switch
+	AuthMethod  string                   // auth method of the AuthResponse
+	Salt        []byte                   // salt of the AuthResponse scramble
+	Password    string                   // clear text password, sent over TLS or RSA encrypted
+	HasPassword bool                     // Password is set, AuthResponse is not a scramble
+	TLS         *tls.ConnectionState     // nil without TLS
+	RemoteAddr  net.Addr
+}
+
+//Identity of an authenticated client
+type Identity struct {
+	User       string
+	Connection *config.Connection
+}
+
+//Authenticator resolves client credentials to an identity
+type Authenticator interface {
+	//AuthMethod returns the auth method for the user, empty for the server default.
+	//Authenticators needing the clear text password use sha256_password or caching_sha2_password
+	AuthMethod(user string) string
+	//Authenticate returns the identity of the client or ErrAccessDenied
+	Authenticate(request *AuthRequest) (*Identity, error)
+}
+
+//CachingAuthenticator is an Authenticator allowing the caching_sha2_password fast auth of its identities.
+//The identities of other authenticators are not cached, except the ones of a ConfigAuthenticator
+type CachingAuthenticator interface {
+	Authenticator
+	//Revalidate checks a cached identity on a fast auth, false to force full auth, e.g. for revoked users or changed passwords
+	Revalidate(request *AuthRequest, identity *Identity) bool
+}
+
+//cachesIdentities checks if the authenticator identities can be cached for fast auth,
+//the credentials of a ConfigAuthenticator do not change
+func cachesIdentities(authenticator Authenticator) bool {
+	switch authenticator.(type) {
+	case *ConfigAuthenticator, CachingAuthenticator:
+		return true
+	}
+	return false
+}
+
+//revalidate checks a cached identity with the authenticator
+func revalidate(authenticator Authenticator, request *AuthRequest, identity *Identity) bool {
+	switch authenticator := authenticator.(type) {
+	case *ConfigAuthenticator:
+		return true
+	case CachingAuthenticator:
+		return authenticator.Revalidate(request, identity)
+	}
+	return false
+}
+
+//WithAuthenticator sets the server authenticator
+func WithAuthenticator(authenticator Authenticator) func(*Server) {
+	return func(server *Server) {
+		server.authenticator = authenticator
+	}
+}
+
+//ConfigAuthenticator checks the users and passwords of config.Connection
+type ConfigAuthenticator struct {
+	users map[string]*config.Connection //user -> connection
+}
+
+//NewConfigAuthenticator creates an authenticator for the connections
+func NewConfigAuthenticator(connections []config.Connection) (authenticator *ConfigAuthenticator, err error) {
+	users := make(map[string]*config.Connection, len(connections))
+	for i := range connections {
+		connection := &connections[i]
+		if _, ok := users[connection.User]; ok {
+			return nil, fmt.Errorf("Duplicated user %s", connection.User)
+		}
+		if connection.AuthPlugin != "" && !isAuthMethodSupported(connection.AuthPlugin) {
+			return nil, fmt.Errorf("Auth method %s of user %s not supported", connection.AuthPlugin, connection.User)
+		}
+		users[connection.User] = connection
+	}
+	return &ConfigAuthenticator{users}, nil
+}
+
+//AuthMethod returns the auth plugin configured for the user
+func (authenticator *ConfigAuthenticator) AuthMethod(user string) string {
+	if connection, ok := authenticator.users[user]; ok {
+		return connection.AuthPlugin
+	}
+	return ""
+}
+
+//Authenticate checks the password of the configured user
+func (authenticator *ConfigAuthenticator) Authenticate(request *AuthRequest) (*Identity, error) {
+	resp := request.Response
+	connection, ok := authenticator.users[resp.User]
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+	switch {
+	case request.HasPassword:
+		ok = checkPassword(connection.Password, request.Password)
+	case request.AuthMethod == mysql.AuthNativePassword:
+		ok = mysql.CheckNativePassword(request.Salt, resp.AuthResponse, mysql.NativePasswordHash(connection.Password))
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, ErrAccessDenied
+	}
+	return &Identity{resp.User, connection}, nil
+}
+
+//checkPassword compares a clear text password of the client with the configured one, plain or '*HEX'.
+//The client password is always clear text, the configured hash is not a valid password
+func checkPassword(configured string, password string) bool {
+	return subtle.ConstantTimeCompare(mysql.PasswordHash(password), mysql.NativePasswordHash(configured)) == 1
+}
+
+func isAuthMethodSupported(authMethod string) bool {
+	return authMethod == mysql.AuthNativePassword ||
+		authMethod == mysql.AuthCachingSHA2Password ||
+		authMethod == mysql.AuthSHA2Password
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//forwardedCapability client capabilities requested to the backend, they change the result stream
+const forwardedCapability = mysql.ClientFoundRows | mysql.ClientIgnoreSpace | mysql.ClientInteractive |
+	mysql.ClientLocalFiles | mysql.ClientMultiStatements | mysql.ClientMultiResults | mysql.ClientPSMultiResults
+
+//backendDSN parses a DSN of the connection with the db credentials, db overrides the DSN database
+func backendDSN(connection *config.Connection, name string, db string) (*mysql.DSN, error) {
+	dsn, err := mysql.ParseDSN(name)
+	if err != nil {
+		return nil, err
+	}
+	dsn.User = connection.DBUser
+	dsn.Password = connection.DBPassword
+	if db != "" {
+		dsn.DBName = db
+	}
+	return dsn, nil
+}
+
+//forwarded checks if the commands of the session are forwarded to a backend
+func (session *Session) forwarded() bool {
+	identity := session.identity
+	return identity != nil && identity.Connection != nil && len(identity.Connection.DSNS) > 0
+}
+
+//connectBackend borrows a backend session of the connection primary if it is not open.
+//Backend errors are only logged, they may name the db user or the backend address
+func (session *Session) connectBackend() (*PooledConn, error) {
+	if session.backend != nil {
+		return session.backend, nil
+	}
+	connection := session.identity.Connection
+	pool := session.server.getPool(connection)
+	backend, err := pool.Get(session.capability&forwardedCapability, session.collation, session.db)
+	if err != nil {
+		var sqlErr *mysql.Error
+		if errors.As(err, &sqlErr) && sqlErr.Number == mysql.ErrConCountError {
+			return nil, sqlErr
+		}
+		log.Printf("Error connecting to the backend of %s: %v", connection.ID, err)
+		return nil, mysql.NewError(mysql.CRConnectionError, connection.ID)
+	}
+	session.backend = backend
+	return backend, nil
+}
+
+//connectReplica borrows a backend session of a connection replica chosen by its balancer if it is not open,
+//nil if no replica is available
+func (session *Session) connectReplica() *PooledConn {
+	if session.replica != nil {
+		return session.replica
+	}
+	connection := session.identity.Connection
+	pools, endpoints := session.server.getReplicaPools(connection)
+	balancer := session.server.getBalancer(connection)
+	host, _, err := net.SplitHostPort(session.conn.RemoteAddr().String())
+	if err != nil {
+		host = session.conn.RemoteAddr().String()
+	}
+	for len(pools) > 0 {
+		i := balancer.Next(endpoints, session.identity.User, host)
+		pool := pools[i]
+		replica, err := pool.Get(session.capability&forwardedCapability, session.collation, session.db)
+		if err == nil {
+			session.replica = replica
+			return replica
+		}
+		log.Printf("Error connecting to replica %s of %s: %v", endpoints[i].Name, connection.ID, err)
+		pools = append(pools[:i], pools[i+1:]...)
+		endpoints = append(endpoints[:i], endpoints[i+1:]...)
+	}
+	return nil
+}
+
+//releaseBackend returns the backend sessions to their pools
+func (session *Session) releaseBackend() {
+	for _, backend := range []*PooledConn{session.backend, session.replica} {
+		if backend != nil {
+			backend.pool.Put(backend)
+		}
+	}
+	session.backend = nil
+	session.backendState = false
+	session.pinned = false
+	session.replica = nil
+}
+
+//closeBackend closes a backend session of unknown state, the next command borrows a new one
+func (session *Session) closeBackend(backend *PooledConn) {
+	backend.pool.Discard(backend)
+	if session.backend == backend {
+		session.backend = nil
+		session.backendState = false
+		session.pinned = false
+	} else if session.replica == backend {
+		session.replica = nil
+	}
+}
+
+//forward sends the command to the primary or a replica and relays its answer to the client.
+//Backend failures are returned as a mysql.Error, client failures as is
+func (session *Session) forward(command byte, packet *mysql.Packet) (err error) {
+	switch command {
+	case mysql.ComQuit:
+		return io.EOF
+	case mysql.ComInitDB, mysql.ComPing, mysql.ComStatistics, mysql.ComProcessKill, mysql.ComRefresh,
+		mysql.ComDebug, mysql.ComSetOption, mysql.ComResetConnection, mysql.ComCreateDB, mysql.ComDropDB,
+		mysql.ComQuery, mysql.ComFieldList, mysql.ComSTMTPrepare, mysql.ComSTMTExecute, mysql.ComSTMTFetch,
+		mysql.ComSTMTReset, mysql.ComSTMTSendLongData, mysql.ComSTMTClose:
+	default:
+		return mysql.NewError(mysql.ErrUnknownComError)
+	}
+	backend, fresh, err := session.route(command, packet.Body.String())
+	if err != nil {
+		return err
+	}
+	replaceable := session.replaceable(backend)
+	if backend == session.backend && changesSession(command, packet.Body.String()) {
+		session.backendState = true
+	}
+	body := append([]byte{command}, packet.Body.Bytes()...)
+	err = backend.WriteCommand(body)
+	if err != nil && !fresh && replaceable {
+		//the idle backend session is gone without state, nothing was answered yet
+		session.closeBackend(backend)
+		backend, _, err = session.route(command, packet.Body.String())
+		if err != nil {
+			return err
+		}
+		err = backend.WriteCommand(body)
+	}
+	if err != nil {
+		return session.backendLost(backend, err)
+	}
+	atomic.AddInt64(&backend.pool.outstanding, 1)
+	defer atomic.AddInt64(&backend.pool.outstanding, -1)
+	relay := &relay{session: session, conn: backend, backend: backend.Conn}
+	defer relay.release()
+	err = relay.answer(command)
+	var sqlErr *mysql.Error
+	if err != nil && !errors.As(err, &sqlErr) {
+		//the client is gone in the middle of the answer
+		session.closeBackend(backend)
+		return err
+	} else if err == nil && relay.ok {
+		switch {
+		case command == mysql.ComInitDB:
+			session.db = packet.Body.String()
+			backend.db = session.db
+		case command == mysql.ComQuery && useDB(packet.Body.String()) != "":
+			session.db = useDB(packet.Body.String())
+			backend.db = session.db
+		}
+	}
+	return err
+}
+
+//replaceable checks if the backend session can be replaced after a failure without the client noticing:
+//replica sessions only run reads, the primary one must be out of transactions and without session state
+func (session *Session) replaceable(backend *PooledConn) bool {
+	if backend == session.replica {
+		return true
+	}
+	return !session.backendState && session.status&mysql.ServerStatusInTrans == 0 && session.status&mysql.ServerStatusAutocommit != 0
+}
+
+//sessionPrefixes of the statements leaving state on the backend session
+var sessionPrefixes = []string{"SET", "LOCK", "PREPARE", "CREATE TEMPORARY", "HANDLER", "XA"}
+
+//changesSession checks if the command leaves state on the backend session other than the schema:
+//prepared statements, options, session variables, user variables, locks and temporary tables
+func changesSession(command byte, query string) bool {
+	switch command {
+	case mysql.ComSTMTPrepare, mysql.ComSetOption:
+		return true
+	case mysql.ComQuery:
+	default:
+		return false
+	}
+	for _, statement := range strings.Split(query, ";") {
+		statement = strings.ToUpper(skipComments(statement))
+		if strings.Contains(statement, "@") || strings.Contains(statement, "GET_LOCK") {
+			return true
+		} else if strings.HasPrefix(statement, "SET TRANSACTION") {
+			continue
+		}
+		for _, prefix := range sessionPrefixes {
+			if strings.HasPrefix(statement, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//backendLost closes the backend session after a failure, returning the error for the client
+func (session *Session) backendLost(backend *PooledConn, err error) error {
+	log.Printf("Lost backend session of session %d: %v", session.sessionID, err)
+	session.closeBackend(backend)
+	return mysql.NewError(mysql.CRServerLost)
+}
+
+//relay streams the answer of a command from the backend to the client
+type relay struct {
+	session *Session
+	conn    *PooledConn
+	backend *mysql.Conn
+	packet  *mysql.Packet //last relayed packet
+	ok      bool          //the last relayed status packet is an OK
+}
+
+//answer relays the answer of the command
+func (relay *relay) answer(command byte) error {
+	switch command {
+	case mysql.ComSTMTSendLongData, mysql.ComSTMTClose:
+		return nil
+	case mysql.ComQuery, mysql.ComSTMTExecute:
+		return relay.result()
+	case mysql.ComSTMTPrepare:
+		return relay.prepare()
+	case mysql.ComSTMTFetch:
+		return relay.rows()
+	case mysql.ComFieldList:
+		//column definitions until the EOF
+		return relay.rows()
+	}
+	body, err := relay.next()
+	if err == nil {
+		relay.status(body)
+	}
+	return err
+}
+
+//next reads a backend packet and writes it to the client, the body is valid until the next call
+func (relay *relay) next() (body []byte, err error) {
+	relay.release()
+	session := relay.session
+	packet, err := relay.backend.ReadPacket()
+	if err != nil {
+		return nil, session.backendLost(relay.conn, err)
+	}
+	relay.packet = packet
+	body = packet.Body.Bytes()
+	if len(body) == 0 {
+		return nil, session.backendLost(relay.conn, errors.New("Empty packet"))
+	}
+	err = session.writePacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+//status makes the session status follow an OK or EOF packet. Only called where the protocol places them:
+//rows and definitions may start with the same headers
+func (relay *relay) status(body []byte) {
+	capability := relay.backend.Capability()
+	relay.ok = false
+	switch {
+	case body[0] == mysql.OKHeader:
+		ok, err := mysql.ReadOKPacket(bytes.NewBuffer(body), capability)
+		if err == nil {
+			relay.ok = true
+			relay.session.status = ok.Status
+		}
+	case mysql.IsEOFPacket(body, capability):
+		eof, err := mysql.ReadEOFPacket(bytes.NewBuffer(body), capability)
+		if err == nil {
+			relay.session.status = eof.Status
+		}
+	}
+}
+
+//release returns the last relayed packet to the pool
+func (relay *relay) release() {
+	if relay.packet != nil {
+		relay.backend.ReleasePacket(relay.packet)
+		relay.packet = nil
+	}
+}
+
+//result relays the results of a query or a statement execution, following LOCAL INFILE requests and multi results
+func (relay *relay) result() error {
+	for {
+		body, err := relay.next()
+		if err != nil {
+			return err
+		}
+		switch body[0] {
+		case mysql.ERRHeader:
+			return nil
+		case mysql.OKHeader:
+			relay.status(body)
+		case mysql.LocalInfileHeader:
+			err = relay.localInfile()
+			if err != nil {
+				return err
+			}
+			//the OK or ERR of the load follows
+			continue
+		default:
+			err = relay.resultset(body)
+			if err != nil {
+				return err
+			} else if mysql.IsERRPacket(relay.packet.Body.Bytes()) {
+				//the ERR in the middle of the resultset ends the answer
+				return nil
+			}
+		}
+		if relay.session.status&mysql.ServerStatusMoreResultsExists == 0 {
+			return nil
+		}
+	}
+}
+
+//resultset relays the column definitions and the rows of a resultset, no rows follow an open cursor
+func (relay *relay) resultset(body []byte) error {
+	count, _, err := mysql.ReadRLEInt(bytes.NewBuffer(body))
+	if err != nil {
+		return relay.session.backendLost(relay.conn, err)
+	}
+	for i := int64(0); i < count; i++ {
+		_, err = relay.next()
+		if err != nil {
+			return err
+		}
+	}
+	if relay.backend.Capability()&mysql.ClientDeprecateEOF == 0 {
+		body, err = relay.next()
+		if err != nil {
+			return err
+		}
+		relay.status(body)
+		if relay.session.status&mysql.ServerStatusCursorExists != 0 {
+			return nil
+		}
+	}
+	return relay.rows()
+}
+
+//rows relays rows until the EOF or an ERR
+func (relay *relay) rows() error {
+	capability := relay.backend.Capability()
+	for {
+		body, err := relay.next()
+		if err != nil {
+			return err
+		} else if mysql.IsERRPacket(body) {
+			return nil
+		} else if mysql.IsEOFPacket(body, capability) {
+			relay.status(body)
+			return nil
+		}
+	}
+}
+
+//prepare relays the COM_STMT_PREPARE_OK with the param and column definitions
+func (relay *relay) prepare() error {
+	body, err := relay.next()
+	if err != nil || mysql.IsERRPacket(body) {
+		return err
+	}
+	ok, err := mysql.ReadStmtPrepareOK(bytes.NewBuffer(body))
+	if err != nil {
+		return relay.session.backendLost(relay.conn, err)
+	}
+	deprecateEOF := relay.backend.Capability()&mysql.ClientDeprecateEOF != 0
+	for _, count := range []uint16{ok.ParamCount, ok.ColumnCount} {
+		if count == 0 {
+			continue
+		}
+		if !deprecateEOF {
+			count++
+		}
+		for i := uint16(0); i < count; i++ {
+			_, err = relay.next()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//localInfile relays the file content of the client until its empty packet
+func (relay *relay) localInfile() error {
+	session := relay.session
+	for {
+		packet, err := session.readPacket()
+		if err != nil {
+			return err
+		}
+		empty := packet.Body.Len() == 0
+		err = relay.backend.WritePacket(packet.Body.Bytes())
+		session.releasePacket(packet)
+		if err != nil {
+			return session.backendLost(relay.conn, err)
+		} else if empty {
+			return nil
+		}
+	}
+}
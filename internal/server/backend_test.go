@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysqltest "github.com/rafalopez79/godriver/internal/mysqltest"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+func newBackend(t *testing.T) *mysqltest.Server {
+	backend, err := mysqltest.NewServer("dbuser1", "dbpassword1")
+	assert.NilError(t, err)
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+//newForwardingServer creates a server forwarding user1 to the DSN
+func newForwardingServer(t *testing.T, dsns string, dbPassword string) *Server {
+	connections := []config.Connection{{ID: "test1", User: "user1", Password: "password1", DBUser: "dbuser1", DBPassword: dbPassword, DSNS: config.DSNList{dsns}}}
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, connections)
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	return server
+}
+
+//connectForwarded connects a client through a server forwarding user1 to the DSN
+func connectForwarded(t *testing.T, dsns string, dbPassword string) *mysql.Conn {
+	return connectClient(t, newForwardingServer(t, dsns, dbPassword))
+}
+
+//connectClient connects user1 to the server
+func connectClient(t *testing.T, server *Server) *mysql.Conn {
+	serverConn, clientConn := net.Pipe()
+	go server.handle(serverConn)
+	conn, err := mysql.Connect(clientConn, &mysql.DSN{User: "user1", Password: "password1", DBName: "db1"},
+		mysql.WithCapability(mysql.ClientMultiStatements|mysql.ClientMultiResults|mysql.ClientLocalFiles))
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func assertSQLError(t *testing.T, err error, number uint16) {
+	var sqlErr *mysql.Error
+	assert.Assert(t, errors.As(err, &sqlErr), "%v", err)
+	assert.Equal(t, sqlErr.Number, number)
+}
+
+func readAll(t *testing.T, rows *mysql.Rows) (values [][]interface{}) {
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			return values
+		}
+		assert.NilError(t, err)
+		values = append(values, row)
+	}
+}
+
+func TestForwardQueries(t *testing.T) {
+	backend := newBackend(t)
+	backend.SetResult("SELECT a, b FROM t", &mysqltest.Result{
+		Fields: []*mysql.Field{mysql.NewField("a", mysql.MYSQLTypeLongLong), mysql.NewField("b", mysql.MYSQLTypeVarString)},
+		Rows:   [][]interface{}{{1, "x"}, {2, nil}},
+	})
+	backend.SetResult("UPDATE t SET b = 1", &mysqltest.Result{AffectedRows: 2})
+	backend.SetResult("SELEC", &mysqltest.Result{Err: mysql.NewError(mysql.ErrParseError, "near 'SELEC'")})
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+
+	rows, err := conn.Query("SELECT a, b FROM t")
+	assert.NilError(t, err)
+	assert.Equal(t, rows.Fields[1].Name, "b")
+	assert.DeepEqual(t, readAll(t, rows), [][]interface{}{{[]byte("1"), []byte("x")}, {[]byte("2"), nil}})
+
+	ok, err := conn.Exec("UPDATE t SET b = 1")
+	assert.NilError(t, err)
+	assert.Equal(t, ok.AffectedRows, uint64(2))
+	_, err = conn.Exec("SELEC")
+	assertSQLError(t, err, mysql.ErrParseError)
+
+	rows, err = conn.Query("SELECT a, b FROM t; UPDATE t SET b = 1; SELECT a, b FROM t")
+	assert.NilError(t, err)
+	assert.Equal(t, len(readAll(t, rows)), 2)
+	rows, err = rows.NextResult()
+	assert.NilError(t, err)
+	assert.Equal(t, rows.OK.AffectedRows, uint64(2))
+	rows, err = rows.NextResult()
+	assert.NilError(t, err)
+	assert.Equal(t, len(readAll(t, rows)), 2)
+	_, err = rows.NextResult()
+	assert.Equal(t, err, io.EOF)
+
+	_, err = conn.Exec("BEGIN")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.Status()&mysql.ServerStatusInTrans, mysql.ServerStatusInTrans)
+	assert.NilError(t, conn.InitDB("db2"))
+	assert.NilError(t, conn.Ping())
+	assert.Equal(t, backend.Connections(), 1)
+}
+
+func TestForwardRowsLikeStatus(t *testing.T) {
+	backend := newBackend(t)
+	//the row starts like an OK of status in transaction with more results
+	backend.SetResult("SELECT a, b FROM t", &mysqltest.Result{
+		Fields:  []*mysql.Field{mysql.NewField("a", mysql.MYSQLTypeVarString), mysql.NewField("b", mysql.MYSQLTypeVarString)},
+		Rows:    [][]interface{}{{"", "a\x09\x00\x00\x00"}},
+		RowsErr: mysql.NewError(mysql.ErrQueryInterrupted),
+	})
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+
+	rows, err := conn.Query("SELECT a, b FROM t")
+	assert.NilError(t, err)
+	row, err := rows.Next()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, row, []interface{}{[]byte{}, []byte("a\x09\x00\x00\x00")})
+	_, err = rows.Next()
+	assertSQLError(t, err, mysql.ErrQueryInterrupted)
+
+	//out of transaction the lost backend session is replaced
+	backend.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Exec("UPDATE t SET a = 1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, backend.Queries(), []string{"SELECT a, b FROM t", "UPDATE t SET a = 1"})
+}
+
+func TestForwardLocalInfile(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+
+	assert.NilError(t, conn.WriteCommand(append([]byte{mysql.ComQuery}, "LOAD DATA LOCAL INFILE 'data.csv' INTO TABLE t"...)))
+	packet, err := conn.ReadPacket()
+	assert.NilError(t, err)
+	assert.Equal(t, packet.Body.String(), "\xfbdata.csv")
+	for _, data := range []string{"1,a\n", "2,b\n", ""} {
+		assert.NilError(t, conn.WritePacket([]byte(data)))
+	}
+	packet, err = conn.ReadPacket()
+	assert.NilError(t, err)
+	ok, err := mysql.ReadOKPacket(packet.Body, conn.Capability())
+	assert.NilError(t, err)
+	assert.Equal(t, ok.AffectedRows, uint64(8))
+	assert.NilError(t, conn.Ping())
+}
+
+func TestForwardPreparedStatements(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+
+	stmt, err := conn.Prepare("SELECT ?")
+	assert.NilError(t, err)
+	assert.Equal(t, len(stmt.Params), 1)
+	assert.Equal(t, len(stmt.Columns), 1)
+	rows, err := stmt.Execute("abc")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, readAll(t, rows), [][]interface{}{{[]byte("abc")}})
+	assert.NilError(t, stmt.Close())
+	assert.NilError(t, conn.Ping())
+}
+
+func TestForwardBackendErrors(t *testing.T) {
+	backend := newBackend(t)
+	//backend access denied is not sent with the db user, the client session goes on
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "wrong")
+	for i := 0; i < 2; i++ {
+		err := conn.Ping()
+		assertSQLError(t, err, mysql.CRConnectionError)
+		assert.Assert(t, !strings.Contains(err.Error(), "dbuser1"), "%v", err)
+	}
+
+	conn = connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	assert.NilError(t, conn.Ping())
+	backend.Close()
+	_, err := conn.Exec("DO 1")
+	var sqlErr *mysql.Error
+	assert.Assert(t, errors.As(err, &sqlErr), "%v", err)
+	assert.Assert(t, sqlErr.Number == mysql.CRServerLost || sqlErr.Number == mysql.CRConnectionError, "%v", err)
+	assertSQLError(t, conn.Ping(), mysql.CRConnectionError)
+
+	conn = connectForwarded(t, "tcp(localhost:3306", "dbpassword1")
+	assertSQLError(t, conn.Ping(), mysql.CRConnectionError)
+}
+
+func TestForwardUnknownCommand(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	assert.NilError(t, conn.WriteCommand([]byte{mysql.ComBinlogDump}))
+	packet, err := conn.ReadPacket()
+	assert.NilError(t, err)
+	e, err := mysql.ReadERRPacket(bytes.NewBuffer(packet.Body.Bytes()), conn.Capability())
+	assert.NilError(t, err)
+	assert.Equal(t, e.Code, mysql.ErrUnknownComError)
+	assert.Equal(t, backend.Connections(), 0)
+}
+
+func TestForwardPooledBackend(t *testing.T) {
+	backend := newBackend(t)
+	server := newForwardingServer(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	for i := 0; i < 3; i++ {
+		conn := connectClient(t, server)
+		_, err := conn.Exec("BEGIN")
+		assert.NilError(t, err)
+		assert.NilError(t, conn.Close())
+		//the session returns the backend connection when it ends
+		pool := server.getPool(&config.Connection{ID: "test1"})
+		deadline := time.Now().Add(2 * time.Second)
+		for _, idle := pool.Stats(); idle < 1 && time.Now().Before(deadline); _, idle = pool.Stats() {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assertStats(t, pool, 1, 1)
+	}
+	assert.Equal(t, backend.Resets(), 3)
+	assert.Equal(t, backend.Connections(), 1)
+}
+
+func TestChangesSession(t *testing.T) {
+	tests := []struct {
+		command byte
+		query   string
+		changes bool
+	}{
+		{mysql.ComQuery, "SET NAMES utf8mb4", true},
+		{mysql.ComQuery, "/* c */ set time_zone = '+00:00'", true},
+		{mysql.ComQuery, "SET TRANSACTION ISOLATION LEVEL READ COMMITTED", false},
+		{mysql.ComQuery, "SELECT 1 INTO @a", true},
+		{mysql.ComQuery, "SELECT GET_LOCK('a', 1)", true},
+		{mysql.ComQuery, "LOCK TABLES t READ", true},
+		{mysql.ComQuery, "CREATE TEMPORARY TABLE t (a INT)", true},
+		{mysql.ComQuery, "BEGIN; SET sql_mode = ''", true},
+		{mysql.ComQuery, "UPDATE t SET a = 1", false},
+		{mysql.ComQuery, "SELECT a FROM t", false},
+		{mysql.ComSTMTPrepare, "SELECT ?", true},
+		{mysql.ComSetOption, "", true},
+		{mysql.ComPing, "", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, changesSession(test.command, test.query), test.changes, test.query)
+	}
+}
+
+func TestForwardReplacesLostBackend(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	_, err := conn.Exec("UPDATE t SET a = 0")
+	assert.NilError(t, err)
+	backend.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	//without state the lost backend session is replaced
+	_, err = conn.Exec("UPDATE t SET a = 1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, backend.Queries(), []string{"UPDATE t SET a = 0", "UPDATE t SET a = 1"})
+}
+
+func TestForwardLostInTransaction(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	_, err := conn.Exec("BEGIN")
+	assert.NilError(t, err)
+	backend.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	//the statement of the transaction is not run in autocommit on a new backend session
+	_, err = conn.Exec("UPDATE t SET a = 1")
+	assertSQLError(t, err, mysql.CRServerLost)
+	assert.DeepEqual(t, backend.Queries(), []string{"BEGIN"})
+
+	//the next command starts a new backend session
+	_, err = conn.Exec("UPDATE t SET a = 2")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, backend.Queries(), []string{"BEGIN", "UPDATE t SET a = 2"})
+}
+
+func TestForwardLostWithSessionState(t *testing.T) {
+	backend := newBackend(t)
+	conn := connectForwarded(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	_, err := conn.Exec("SET @a = 1")
+	assert.NilError(t, err)
+	backend.CloseConnections()
+	time.Sleep(50 * time.Millisecond)
+	_, err = conn.Exec("SELECT @a")
+	assertSQLError(t, err, mysql.CRServerLost)
+	assert.DeepEqual(t, backend.Queries(), []string{"SET @a = 1"})
+}
+
+func TestForwardCollation(t *testing.T) {
+	backend := newBackend(t)
+	server := newForwardingServer(t, "tcp("+backend.Addr+")/", "dbpassword1")
+	serverConn, clientConn := net.Pipe()
+	go server.handle(serverConn)
+	//utf8mb4_0900_ai_ci
+	conn, err := mysql.Connect(clientConn, &mysql.DSN{User: "user1", Password: "password1"}, mysql.WithCollation(255))
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.NilError(t, conn.Ping())
+	assert.DeepEqual(t, backend.Collations(), []byte{255})
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//balancing policies of config.Connection.Balancer
+const (
+	BalanceRoundRobin       = "roundrobin"
+	BalanceWeighted         = "weighted"
+	BalanceLeastOutstanding = "leastoutstanding"
+	BalanceHashUser         = "hashuser"
+	BalanceHashAddress      = "hashaddress"
+)
+
+//hashReplicas virtual nodes of each endpoint on the consistent hash ring
+const hashReplicas = 100
+
+//Endpoint eligible backend of a Balancer
+type Endpoint struct {
+	Name        string // DSN, the key of the endpoint on the consistent hash ring
+	Weight      int    // relative share of the weighted policy, 1 if not positive
+	Outstanding int64  // queries in progress
+}
+
+//Balancer chooses a backend among the eligible endpoints for a client
+type Balancer interface {
+	//Next returns the index of the chosen endpoint, endpoints is not empty
+	Next(endpoints []Endpoint, user string, address string) int
+}
+
+//NewBalancer creates a balancer of the policy, round-robin if it is empty
+func NewBalancer(policy string) (Balancer, error) {
+	switch policy {
+	case "", BalanceRoundRobin:
+		return &RoundRobinBalancer{}, nil
+	case BalanceWeighted:
+		return &WeightedBalancer{current: make(map[string]int)}, nil
+	case BalanceLeastOutstanding:
+		return &LeastOutstandingBalancer{}, nil
+	case BalanceHashUser:
+		return &HashBalancer{byAddress: false}, nil
+	case BalanceHashAddress:
+		return &HashBalancer{byAddress: true}, nil
+	}
+	return nil, fmt.Errorf("Balancer %s not supported", policy)
+}
+
+//RoundRobinBalancer chooses the endpoints in turn
+type RoundRobinBalancer struct {
+	counter uint64
+}
+
+//Next returns the next endpoint in turn
+func (balancer *RoundRobinBalancer) Next(endpoints []Endpoint, user string, address string) int {
+	return int((atomic.AddUint64(&balancer.counter, 1) - 1) % uint64(len(endpoints)))
+}
+
+//WeightedBalancer chooses the endpoints in turn proportionally to their weights,
+//spreading the turns of each one with the smooth weighted round-robin
+type WeightedBalancer struct {
+	mutex   sync.Mutex
+	current map[string]int // current weight by endpoint name
+}
+
+//Next returns the endpoint of highest current weight
+func (balancer *WeightedBalancer) Next(endpoints []Endpoint, user string, address string) int {
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	total := 0
+	best := 0
+	for i, endpoint := range endpoints {
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total += weight
+		balancer.current[endpoint.Name] += weight
+		if balancer.current[endpoint.Name] > balancer.current[endpoints[best].Name] {
+			best = i
+		}
+	}
+	balancer.current[endpoints[best].Name] -= total
+	return best
+}
+
+//LeastOutstandingBalancer chooses the endpoint with fewer queries in progress, in turn on ties
+type LeastOutstandingBalancer struct {
+	counter uint64
+}
+
+//Next returns the endpoint with fewer queries in progress
+func (balancer *LeastOutstandingBalancer) Next(endpoints []Endpoint, user string, address string) int {
+	var least []int
+	for i, endpoint := range endpoints {
+		if len(least) > 0 && endpoint.Outstanding > endpoints[least[0]].Outstanding {
+			continue
+		} else if len(least) > 0 && endpoint.Outstanding < endpoints[least[0]].Outstanding {
+			least = least[:0]
+		}
+		least = append(least, i)
+	}
+	return least[(atomic.AddUint64(&balancer.counter, 1)-1)%uint64(len(least))]
+}
+
+//HashBalancer chooses the endpoint of the client user, or address, on a consistent hash ring.
+//Removing an endpoint only moves its clients
+type HashBalancer struct {
+	byAddress bool
+	mutex     sync.Mutex
+	names     string     // endpoint names of the ring
+	ring      []hashNode // sorted by hash
+}
+
+//hashNode virtual node of an endpoint on the ring
+type hashNode struct {
+	hash     uint32
+	endpoint int
+}
+
+//Next returns the first endpoint on the ring after the hash of the client
+func (balancer *HashBalancer) Next(endpoints []Endpoint, user string, address string) int {
+	key := user
+	if balancer.byAddress {
+		key = address
+	}
+	ring := balancer.getRing(endpoints)
+	hash := hash32(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= hash })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].endpoint
+}
+
+//getRing returns the ring of the endpoints, built again when they change
+func (balancer *HashBalancer) getRing(endpoints []Endpoint) []hashNode {
+	names := make([]string, len(endpoints))
+	for i, endpoint := range endpoints {
+		names[i] = endpoint.Name
+	}
+	key := strings.Join(names, "\n")
+	balancer.mutex.Lock()
+	defer balancer.mutex.Unlock()
+	if balancer.ring != nil && balancer.names == key {
+		return balancer.ring
+	}
+	ring := make([]hashNode, 0, len(endpoints)*hashReplicas)
+	for i, name := range names {
+		for replica := 0; replica < hashReplicas; replica++ {
+			ring = append(ring, hashNode{hash32(name + "#" + strconv.Itoa(replica)), i})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	balancer.names = key
+	balancer.ring = ring
+	return ring
+}
+
+//hash32 first 32 bits of the MD5 of the string, evenly spread for similar strings
+func hash32(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
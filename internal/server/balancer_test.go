@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+func newEndpoints(names ...string) []Endpoint {
+	endpoints := make([]Endpoint, len(names))
+	for i, name := range names {
+		endpoints[i] = Endpoint{Name: name, Weight: 1}
+	}
+	return endpoints
+}
+
+//distribution returns the choices of each endpoint after n calls
+func distribution(balancer Balancer, endpoints []Endpoint, n int) []int {
+	counts := make([]int, len(endpoints))
+	for i := 0; i < n; i++ {
+		counts[balancer.Next(endpoints, "user1", "10.0.0.1")]++
+	}
+	return counts
+}
+
+func TestNewBalancer(t *testing.T) {
+	for policy, expected := range map[string]Balancer{
+		"":                      &RoundRobinBalancer{},
+		BalanceRoundRobin:       &RoundRobinBalancer{},
+		BalanceLeastOutstanding: &LeastOutstandingBalancer{},
+	} {
+		balancer, err := NewBalancer(policy)
+		assert.NilError(t, err)
+		assert.Equal(t, fmt.Sprintf("%T", balancer), fmt.Sprintf("%T", expected))
+	}
+	for policy, byAddress := range map[string]bool{BalanceHashUser: false, BalanceHashAddress: true} {
+		balancer, err := NewBalancer(policy)
+		assert.NilError(t, err)
+		assert.Equal(t, balancer.(*HashBalancer).byAddress, byAddress)
+	}
+	_, err := NewBalancer(BalanceWeighted)
+	assert.NilError(t, err)
+	_, err = NewBalancer("random")
+	assert.Error(t, err, "Balancer random not supported")
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(BalanceRoundRobin)
+	endpoints := newEndpoints("a", "b", "c")
+	var order []int
+	for i := 0; i < 4; i++ {
+		order = append(order, balancer.Next(endpoints, "user1", "10.0.0.1"))
+	}
+	assert.DeepEqual(t, order, []int{0, 1, 2, 0})
+	assert.DeepEqual(t, distribution(balancer, endpoints, 300), []int{100, 100, 100})
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(BalanceWeighted)
+	endpoints := []Endpoint{{"a", 5, 0}, {"b", 1, 0}, {"c", 1, 0}}
+	//the turns of the heaviest endpoint are spread
+	var order []int
+	for i := 0; i < 7; i++ {
+		order = append(order, balancer.Next(endpoints, "user1", "10.0.0.1"))
+	}
+	assert.DeepEqual(t, order, []int{0, 0, 1, 0, 2, 0, 0})
+	assert.DeepEqual(t, distribution(balancer, endpoints, 700), []int{500, 100, 100})
+	//weights not positive count as 1
+	endpoints = []Endpoint{{"a", 3, 0}, {"b", 0, 0}}
+	assert.DeepEqual(t, distribution(balancer, endpoints, 400), []int{300, 100})
+}
+
+func TestLeastOutstandingBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(BalanceLeastOutstanding)
+	endpoints := []Endpoint{{"a", 1, 3}, {"b", 1, 0}, {"c", 1, 2}}
+	assert.DeepEqual(t, distribution(balancer, endpoints, 30), []int{0, 30, 0})
+	//ties are chosen in turn
+	endpoints = []Endpoint{{"a", 1, 1}, {"b", 1, 1}, {"c", 1, 4}}
+	assert.DeepEqual(t, distribution(balancer, endpoints, 30), []int{15, 15, 0})
+	assert.DeepEqual(t, distribution(balancer, newEndpoints("a", "b", "c"), 30), []int{10, 10, 10})
+}
+
+func TestHashBalancer(t *testing.T) {
+	balancer, _ := NewBalancer(BalanceHashUser)
+	endpoints := newEndpoints("tcp(db1:3306)/", "tcp(db2:3306)/", "tcp(db3:3306)/")
+	counts := make([]int, len(endpoints))
+	chosen := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		chosen[user] = balancer.Next(endpoints, user, "10.0.0.1")
+		counts[chosen[user]]++
+		//the same user always goes to the same endpoint
+		assert.Equal(t, balancer.Next(endpoints, user, "10.0.0.2"), chosen[user])
+	}
+	for _, count := range counts {
+		assert.Assert(t, count > 700 && count < 1300, "%v", counts)
+	}
+	//removing an endpoint only moves its users
+	remaining := endpoints[:2]
+	for user, endpoint := range chosen {
+		if endpoint < 2 {
+			assert.Equal(t, balancer.Next(remaining, user, "10.0.0.1"), endpoint, user)
+		}
+	}
+
+	balancer, _ = NewBalancer(BalanceHashAddress)
+	counts = make([]int, len(endpoints))
+	for i := 0; i < 3000; i++ {
+		address := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		endpoint := balancer.Next(endpoints, "user1", address)
+		assert.Equal(t, balancer.Next(endpoints, "user2", address), endpoint)
+		counts[endpoint]++
+	}
+	for _, count := range counts {
+		assert.Assert(t, count > 700 && count < 1300, "%v", counts)
+	}
+}
+
+func TestRouteBalancer(t *testing.T) {
+	primary, replica1, replica2 := newBackend(t), newBackend(t), newBackend(t)
+	connection := config.Connection{ID: "test1", User: "user1", Password: "password1", DBUser: "dbuser1", DBPassword: "dbpassword1",
+		DSNS: config.DSNList{"tcp(" + primary.Addr + ")/"}, Replicas: config.DSNList{"tcp(" + replica1.Addr + ")/", "tcp(" + replica2.Addr + ")/"},
+		Balancer: BalanceWeighted, ReplicaWeights: []int{3}}
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, []config.Connection{connection})
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	for i := 0; i < 8; i++ {
+		conn := connectClient(t, server)
+		_, err = conn.Exec("SELECT a FROM t")
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, len(replica1.Queries()), 6)
+	assert.Equal(t, len(replica2.Queries()), 2)
+	assert.Equal(t, len(primary.Queries()), 0)
+
+	connection.Balancer = "random"
+	_, err = NewServer("5.5.5-test", mysql.AuthNativePassword, []config.Connection{connection})
+	assert.Error(t, err, "Balancer random not supported")
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//health check defaults
+const (
+	DefaultHealthTimeout   = time.Second
+	DefaultHealthFailures  = 3
+	DefaultHealthSuccesses = 2
+)
+
+//EndpointState circuit breaker state of a backend endpoint
+type EndpointState int
+
+//endpoint states, only up endpoints are used
+const (
+	EndpointUp       EndpointState = iota //admitted
+	EndpointDown                          //consecutive failed pings
+	EndpointHalfOpen                      //probing after a successful ping while down
+)
+
+func (state EndpointState) String() string {
+	switch state {
+	case EndpointUp:
+		return "up"
+	case EndpointDown:
+		return "down"
+	case EndpointHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//HealthChecker pings a backend endpoint periodically on a dedicated connection.
+//The endpoint is down after Failures consecutive failed pings, half-open after a successful one,
+//and up again after Successes consecutive successful ones
+type HealthChecker struct {
+	connection *config.Connection
+	dsn        string
+	interval   time.Duration
+	timeout    time.Duration // of the connection and each ping
+	failures   int           // threshold to mark the endpoint down
+	successes  int           // threshold to admit the endpoint again
+	mutex      sync.Mutex
+	state      EndpointState
+	failed     int         // consecutive failed pings
+	probed     int         // consecutive successful pings while not up
+	conn       *mysql.Conn // nil until the next ping
+	done       chan struct{}
+}
+
+//NewHealthChecker creates a checker of the DSN of the connection, pinging it every interval until closed
+func NewHealthChecker(connection *config.Connection, dsn string, interval time.Duration, timeout time.Duration, failures int, successes int) *HealthChecker {
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	if failures <= 0 {
+		failures = DefaultHealthFailures
+	}
+	if successes <= 0 {
+		successes = DefaultHealthSuccesses
+	}
+	checker := &HealthChecker{
+		connection: connection,
+		dsn:        dsn,
+		interval:   interval,
+		timeout:    timeout,
+		failures:   failures,
+		successes:  successes,
+		done:       make(chan struct{}),
+	}
+	go checker.run()
+	return checker
+}
+
+//run pings the endpoint every interval
+func (checker *HealthChecker) run() {
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-checker.done:
+			checker.closeConn()
+			return
+		case <-ticker.C:
+			checker.record(checker.ping())
+		}
+	}
+}
+
+//ping pings the endpoint, opening the connection if needed. The connection is closed on errors
+func (checker *HealthChecker) ping() error {
+	if checker.conn == nil {
+		dsn, err := backendDSN(checker.connection, checker.dsn, "")
+		if err != nil {
+			return err
+		}
+		dsn.Timeout = checker.timeout
+		dsn.ReadTimeout = checker.timeout
+		dsn.WriteTimeout = checker.timeout
+		checker.conn, err = mysql.Dial(dsn)
+		if err != nil {
+			return err
+		}
+	}
+	err := checker.conn.Ping()
+	if err != nil {
+		checker.closeConn()
+	}
+	return err
+}
+
+//record updates the state with the result of a ping
+func (checker *HealthChecker) record(err error) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if err != nil {
+		checker.failed++
+		checker.probed = 0
+		if checker.state == EndpointHalfOpen || (checker.state == EndpointUp && checker.failed >= checker.failures) {
+			log.Printf("DSN %s of %s is down: %v", checker.dsn, checker.connection.ID, err)
+			checker.state = EndpointDown
+		}
+		return
+	}
+	checker.failed = 0
+	if checker.state == EndpointUp {
+		return
+	}
+	checker.probed++
+	checker.state = EndpointHalfOpen
+	if checker.probed >= checker.successes {
+		log.Printf("DSN %s of %s is up", checker.dsn, checker.connection.ID)
+		checker.state = EndpointUp
+		checker.probed = 0
+	}
+}
+
+//State returns the circuit breaker state of the endpoint
+func (checker *HealthChecker) State() EndpointState {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	return checker.state
+}
+
+//closeConn closes the dedicated connection
+func (checker *HealthChecker) closeConn() {
+	if checker.conn != nil {
+		checker.conn.Close()
+		checker.conn = nil
+	}
+}
+
+//Close stops the pings
+func (checker *HealthChecker) Close() {
+	select {
+	case <-checker.done:
+	default:
+		close(checker.done)
+	}
+}
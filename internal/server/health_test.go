@@ -0,0 +1,92 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+func TestHealthCheckerStates(t *testing.T) {
+	connection := &config.Connection{ID: "test1"}
+	checker := NewHealthChecker(connection, "tcp(127.0.0.1:1)/", time.Hour, 0, 2, 2)
+	defer checker.Close()
+	failure := errNotChecked
+	steps := []struct {
+		err   error
+		state EndpointState
+	}{
+		{nil, EndpointUp},
+		{failure, EndpointUp},
+		{failure, EndpointDown},
+		{failure, EndpointDown},
+		{nil, EndpointHalfOpen},
+		{failure, EndpointDown},
+		{nil, EndpointHalfOpen},
+		{nil, EndpointUp},
+		//failures are consecutive
+		{failure, EndpointUp},
+		{nil, EndpointUp},
+		{failure, EndpointUp},
+	}
+	for i, step := range steps {
+		checker.record(step.err)
+		assert.Equal(t, checker.State(), step.state, "step %d", i)
+	}
+	assert.Equal(t, EndpointHalfOpen.String(), "half-open")
+}
+
+func TestHealthCheckerPing(t *testing.T) {
+	backend := newBackend(t)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewHealthChecker(connection, "tcp("+backend.Addr+")/", 10*time.Millisecond, 100*time.Millisecond, 2, 2)
+	defer checker.Close()
+	waitFor(t, func() bool { return backend.Connections() == 1 })
+	assert.Equal(t, checker.State(), EndpointUp)
+
+	backend.SetDown(true)
+	backend.CloseConnections()
+	waitFor(t, func() bool { return checker.State() == EndpointDown })
+	backend.SetDown(false)
+	waitFor(t, func() bool { return checker.State() == EndpointUp })
+}
+
+func TestPoolHealthChecks(t *testing.T) {
+	primary, secondary := newBackend(t), newBackend(t)
+	cfg := PoolConfig{MaxSize: 2, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second, Retries: 3, Backoff: time.Second,
+		FailbackInterval: 10 * time.Millisecond, HealthInterval: 10 * time.Millisecond, HealthFailures: 1, HealthSuccesses: 1}
+	pool := newFailoverPool(t, cfg, primary, secondary)
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	pool.Put(conn)
+
+	primary.SetDown(true)
+	primary.CloseConnections()
+	waitFor(t, func() bool { return !pool.isUp(0) })
+	//the DSN down is skipped without retries
+	start := time.Now()
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, time.Since(start) < cfg.Backoff)
+	assert.Equal(t, conn.endpoint, 1)
+	pool.Put(conn)
+
+	secondary.SetDown(true)
+	secondary.CloseConnections()
+	waitFor(t, func() bool { return !pool.Available() })
+	start = time.Now()
+	_, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.Error(t, err, "All DSNs of test1 are down")
+	assert.Assert(t, time.Since(start) < cfg.Backoff)
+	assertStats(t, pool, 0, 0)
+
+	//the primary is admitted again and failed back to
+	primary.SetDown(false)
+	waitFor(t, func() bool { return pool.ActiveDSN() == pool.dsns[0] })
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.endpoint, 0)
+	pool.Put(conn)
+}
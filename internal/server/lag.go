@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//DefaultLagInterval between replica lag checks
+const DefaultLagInterval = time.Second
+
+//lag check limits
+const (
+	minLagTimeout  = 100 * time.Millisecond // of the connection and the query, the interval if it is longer
+	lagStaleChecks = 3                      // checks without a measure to take the replica out of rotation
+)
+
+//lagColumns of SHOW REPLICA STATUS, and of SHOW SLAVE STATUS before MySQL 8.0.22
+var lagColumns = []string{"Seconds_Behind_Source", "Seconds_Behind_Master"}
+
+//errNotChecked lag of a replica before its first check
+var errNotChecked = errors.New("Lag not checked yet")
+
+//LagChecker measures the replication lag of a replica periodically on a dedicated backend connection.
+//The replica is out of rotation while its lag is over MaxLag or it cannot be measured
+type LagChecker struct {
+	connection *config.Connection
+	dsn        string // replica DSN
+	query      string // returns the lag in seconds, empty for SHOW REPLICA STATUS
+	maxLag     time.Duration
+	interval   time.Duration
+	timeout    time.Duration // of the connection and the query
+	mutex      sync.Mutex
+	conn       *mysql.Conn // nil until the next check
+	lag        time.Duration
+	err        error     // of the last check
+	measured   time.Time // of the last measure
+	done       chan struct{}
+}
+
+//NewLagChecker creates a checker of the replica DSN of the connection, checking it every interval until closed
+func NewLagChecker(connection *config.Connection, dsn string, query string, maxLag time.Duration, interval time.Duration) *LagChecker {
+	if interval <= 0 {
+		interval = DefaultLagInterval
+	}
+	timeout := interval
+	if timeout < minLagTimeout {
+		timeout = minLagTimeout
+	}
+	checker := &LagChecker{
+		connection: connection,
+		dsn:        dsn,
+		query:      query,
+		maxLag:     maxLag,
+		interval:   interval,
+		timeout:    timeout,
+		err:        errNotChecked,
+		done:       make(chan struct{}),
+	}
+	go checker.run()
+	return checker
+}
+
+//run checks the lag now and every interval
+func (checker *LagChecker) run() {
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	for {
+		checker.check()
+		select {
+		case <-checker.done:
+			checker.closeConn()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//check measures the lag of the replica
+func (checker *LagChecker) check() {
+	lag, err := checker.measure()
+	if err != nil {
+		log.Printf("Error checking the lag of replica %s of %s: %v", checker.dsn, checker.connection.ID, err)
+	}
+	checker.mutex.Lock()
+	checker.lag = lag
+	checker.err = err
+	if err == nil {
+		checker.measured = time.Now()
+	}
+	checker.mutex.Unlock()
+}
+
+//measure runs the lag query, opening the connection if needed.
+//The connection is closed on errors other than a mysql.Error
+func (checker *LagChecker) measure() (time.Duration, error) {
+	if checker.conn == nil {
+		dsn, err := backendDSN(checker.connection, checker.dsn, "")
+		if err != nil {
+			return 0, err
+		}
+		dsn.Timeout = checker.timeout
+		dsn.ReadTimeout = checker.timeout
+		dsn.WriteTimeout = checker.timeout
+		checker.conn, err = mysql.Dial(dsn)
+		if err != nil {
+			return 0, err
+		}
+	}
+	lag, err := checker.queryLag()
+	var sqlErr *mysql.Error
+	if err != nil && !errors.As(err, &sqlErr) {
+		checker.closeConn()
+	}
+	return lag, err
+}
+
+//queryLag reads the lag of the first row of the query
+func (checker *LagChecker) queryLag() (time.Duration, error) {
+	query := checker.query
+	if query == "" {
+		query = "SHOW REPLICA STATUS"
+	}
+	rows, err := checker.conn.Query(query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	column := 0
+	if checker.query == "" {
+		column = lagColumn(rows.Fields)
+		if column < 0 {
+			return 0, fmt.Errorf("No lag column in %s", query)
+		}
+	}
+	row, err := rows.Next()
+	if err == io.EOF {
+		return 0, errors.New("Not a replica")
+	} else if err != nil {
+		return 0, err
+	} else if column >= len(row) {
+		return 0, fmt.Errorf("No lag column in %s", query)
+	}
+	return parseLag(row[column])
+}
+
+//lagColumn returns the index of the lag column of the replica status, -1 if it is missing
+func lagColumn(fields []*mysql.Field) int {
+	for i, field := range fields {
+		for _, name := range lagColumns {
+			if field.Name == name {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+//parseLag parses a lag in seconds, NULL while the replication is stopped
+func parseLag(value interface{}) (time.Duration, error) {
+	if value == nil {
+		return 0, errors.New("Replication stopped")
+	}
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	default:
+		s = fmt.Sprint(v)
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid lag %s", s)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+//Lag returns the last measured lag, or the error of the last check.
+//A measure older than lagStaleChecks checks is an error
+func (checker *LagChecker) Lag() (time.Duration, error) {
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	stale := lagStaleChecks * (checker.interval + checker.timeout)
+	if checker.err == nil && time.Since(checker.measured) > stale {
+		return checker.lag, fmt.Errorf("Lag not measured for %v", time.Since(checker.measured).Round(time.Millisecond))
+	}
+	return checker.lag, checker.err
+}
+
+//InRotation checks if the last measured lag is within MaxLag
+func (checker *LagChecker) InRotation() bool {
+	lag, err := checker.Lag()
+	return err == nil && lag <= checker.maxLag
+}
+
+//closeConn closes the dedicated connection
+func (checker *LagChecker) closeConn() {
+	if checker.conn != nil {
+		checker.conn.Close()
+		checker.conn = nil
+	}
+}
+
+//Close stops the checks
+func (checker *LagChecker) Close() {
+	select {
+	case <-checker.done:
+	default:
+		close(checker.done)
+	}
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysqltest "github.com/rafalopez79/godriver/internal/mysqltest"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+//setReplicaLag sets the lag of SHOW REPLICA STATUS, nil while the replication is stopped
+func setReplicaLag(backend *mysqltest.Server, lag interface{}) {
+	backend.SetResult("SHOW REPLICA STATUS", &mysqltest.Result{
+		Fields: []*mysql.Field{mysql.NewField("Replica_IO_State", mysql.MYSQLTypeVarString), mysql.NewField("Seconds_Behind_Source", mysql.MYSQLTypeLongLong)},
+		Rows:   [][]interface{}{{"Waiting for source to send event", lag}},
+	})
+}
+
+//waitFor waits up to 2 seconds for the condition
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		assert.Assert(t, time.Now().Before(deadline), "condition not met")
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+//waitForLag waits for a check of the checker with the error, nil for a measured lag
+func waitForLag(t *testing.T, checker *LagChecker, errMessage string) time.Duration {
+	var lag time.Duration
+	waitFor(t, func() bool {
+		var err error
+		lag, err = checker.Lag()
+		if errMessage == "" {
+			return err == nil
+		}
+		return err != nil && err.Error() == errMessage
+	})
+	return lag
+}
+
+func TestLagChecker(t *testing.T) {
+	backend := newBackend(t)
+	setReplicaLag(backend, 2)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewLagChecker(connection, "tcp("+backend.Addr+")/", "", 5*time.Second, 10*time.Millisecond)
+	defer checker.Close()
+	assert.Equal(t, waitForLag(t, checker, ""), 2*time.Second)
+	assert.Assert(t, checker.InRotation())
+
+	setReplicaLag(backend, 10)
+	waitFor(t, func() bool { return !checker.InRotation() })
+	lag, err := checker.Lag()
+	assert.NilError(t, err)
+	assert.Equal(t, lag, 10*time.Second)
+
+	setReplicaLag(backend, nil)
+	waitForLag(t, checker, "Replication stopped")
+	assert.Assert(t, !checker.InRotation())
+
+	backend.SetResult("SHOW REPLICA STATUS", &mysqltest.Result{Fields: []*mysql.Field{mysql.NewField("Seconds_Behind_Source", mysql.MYSQLTypeLongLong)}})
+	waitForLag(t, checker, "Not a replica")
+
+	//the connection is opened again after a backend failure
+	setReplicaLag(backend, 0)
+	backend.CloseConnections()
+	waitFor(t, func() bool { return backend.Connections() == 1 && checker.InRotation() })
+}
+
+func TestLagCheckerQuery(t *testing.T) {
+	backend := newBackend(t)
+	backend.SetResult("SELECT lag FROM heartbeat", &mysqltest.Result{
+		Fields: []*mysql.Field{mysql.NewField("lag", mysql.MYSQLTypeVarString)},
+		Rows:   [][]interface{}{{"0.5"}},
+	})
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewLagChecker(connection, "tcp("+backend.Addr+")/", "SELECT lag FROM heartbeat", time.Second, 10*time.Millisecond)
+	defer checker.Close()
+	assert.Equal(t, waitForLag(t, checker, ""), 500*time.Millisecond)
+	assert.Assert(t, checker.InRotation())
+
+	backend.SetResult("SELECT lag FROM heartbeat", &mysqltest.Result{Err: mysql.NewError(mysql.ErrParseError, "near 'lag'")})
+	waitFor(t, func() bool { return !checker.InRotation() })
+	//SQL errors keep the connection
+	assert.Equal(t, backend.Connections(), 1)
+}
+
+func TestLagCheckerDown(t *testing.T) {
+	backend := newBackend(t)
+	backend.SetDown(true)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewLagChecker(connection, "tcp("+backend.Addr+")/", "", time.Second, 10*time.Millisecond)
+	defer checker.Close()
+	assert.Assert(t, !checker.InRotation())
+	waitFor(t, func() bool {
+		_, err := checker.Lag()
+		return err != errNotChecked
+	})
+	assert.Assert(t, !checker.InRotation())
+}
+
+func TestLagCheckerHang(t *testing.T) {
+	//the replica accepts connections but never answers
+	addr := newHangingListener(t)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewLagChecker(connection, "tcp("+addr+")/", "", time.Second, 10*time.Millisecond)
+	defer checker.Close()
+	waitFor(t, func() bool {
+		_, err := checker.Lag()
+		return err != errNotChecked
+	})
+	_, err := checker.Lag()
+	assert.ErrorContains(t, err, "timeout")
+	assert.Assert(t, !checker.InRotation())
+}
+
+func TestLagCheckerStale(t *testing.T) {
+	backend := newBackend(t)
+	setReplicaLag(backend, 0)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	checker := NewLagChecker(connection, "tcp("+backend.Addr+")/", "", time.Second, 10*time.Millisecond)
+	waitForLag(t, checker, "")
+	assert.Assert(t, checker.InRotation())
+	//the checks stop, like a check hanging
+	checker.Close()
+	time.Sleep(50 * time.Millisecond)
+	checker.mutex.Lock()
+	checker.measured = time.Now().Add(-time.Second)
+	checker.mutex.Unlock()
+	_, err := checker.Lag()
+	assert.ErrorContains(t, err, "Lag not measured for")
+	assert.Assert(t, !checker.InRotation())
+}
+
+//userQueries returns the queries of the backend without the lag checks
+func userQueries(backend *mysqltest.Server) (queries []string) {
+	for _, query := range backend.Queries() {
+		if query != "SHOW REPLICA STATUS" {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+func TestRouteLaggingReplica(t *testing.T) {
+	primary, replica1, replica2 := newBackend(t), newBackend(t), newBackend(t)
+	setReplicaLag(replica1, 0)
+	setReplicaLag(replica2, 30)
+	connection := config.Connection{ID: "test1", User: "user1", Password: "password1", DBUser: "dbuser1", DBPassword: "dbpassword1",
+		DSNS: config.DSNList{"tcp(" + primary.Addr + ")/"}, Replicas: config.DSNList{"tcp(" + replica1.Addr + ")/", "tcp(" + replica2.Addr + ")/"},
+		ReplicaMaxLag: 10}
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, []config.Connection{connection})
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	waitFor(t, func() bool {
+		lags := server.ReplicaLags()
+		return lags[0].Error == "" && lags[1].Error == ""
+	})
+	for i := 0; i < 4; i++ {
+		conn := connectClient(t, server)
+		_, err = conn.Exec("SELECT a FROM t")
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, len(userQueries(primary)), 0)
+	assert.Equal(t, len(userQueries(replica1)), 4)
+	assert.Equal(t, len(userQueries(replica2)), 0)
+
+	recorder := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/replicas", nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	var lags []ReplicaLag
+	assert.NilError(t, json.Unmarshal(recorder.Body.Bytes(), &lags))
+	assert.DeepEqual(t, lags, []ReplicaLag{
+		{"test1", "tcp(" + replica1.Addr + ")/", 0, 10, true, ""},
+		{"test1", "tcp(" + replica2.Addr + ")/", 30, 10, false, ""},
+	})
+
+	recorder = httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/replicas", nil))
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,544 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//pool defaults
+const (
+	DefaultPoolMaxSize     = 10
+	DefaultPoolIdleTimeout = 5 * time.Minute
+	DefaultPoolMaxLifetime = time.Hour
+	DefaultPoolWaitTimeout = 10 * time.Second
+	DefaultFailoverBackoff = 100 * time.Millisecond
+)
+
+//failbackTimeout of the probes of the DSNs before the active one, the FailbackInterval if it is shorter
+const failbackTimeout = time.Second
+
+//PoolConfig limits of a backend pool
+type PoolConfig struct {
+	MinSize     int           // idle connections kept open
+	MaxSize     int           // idle and borrowed connections
+	IdleTimeout time.Duration // idle connections above MinSize are closed after it
+	MaxLifetime time.Duration // connections are closed after it
+	WaitTimeout time.Duration // time waiting for a free connection at MaxSize
+	//failover
+	Retries          int           // connection retries of a DSN before the next one
+	Backoff          time.Duration // wait before the first retry, doubled on each one
+	FailbackInterval time.Duration // checks of the DSNs before the active one, 0 to stay on the active one
+	//health checks, 0 for the defaults
+	HealthInterval  time.Duration // pings of each DSN, 0 not to check
+	HealthTimeout   time.Duration
+	HealthFailures  int // consecutive failed pings to mark a DSN down
+	HealthSuccesses int // consecutive successful pings to mark it up again
+}
+
+//NewPoolConfig returns the pool limits of the connection with the defaults
+func NewPoolConfig(connection *config.Connection) PoolConfig {
+	cfg := PoolConfig{
+		connection.PoolMinSize,
+		connection.PoolMaxSize,
+		time.Duration(connection.PoolIdleTimeout) * time.Second,
+		time.Duration(connection.PoolMaxLifetime) * time.Second,
+		time.Duration(connection.PoolWaitTimeout) * time.Second,
+		connection.FailoverRetries,
+		time.Duration(connection.FailoverBackoff) * time.Millisecond,
+		time.Duration(connection.FailbackInterval) * time.Second,
+		time.Duration(connection.HealthCheckInterval) * time.Second,
+		time.Duration(connection.HealthCheckTimeout) * time.Millisecond,
+		connection.HealthCheckFailures,
+		connection.HealthCheckSuccesses,
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultPoolMaxSize
+	}
+	if cfg.MinSize > cfg.MaxSize {
+		cfg.MinSize = cfg.MaxSize
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = DefaultPoolMaxLifetime
+	}
+	if cfg.WaitTimeout <= 0 {
+		cfg.WaitTimeout = DefaultPoolWaitTimeout
+	}
+	if cfg.Retries < 0 {
+		cfg.Retries = 0
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultFailoverBackoff
+	}
+	return cfg
+}
+
+//PooledConn backend connection of a pool
+type PooledConn struct {
+	*mysql.Conn
+	pool       *Pool
+	capability uint32 // requested capabilities
+	collation  byte   // requested collation
+	endpoint   int    // index of the DSN
+	db         string // current schema
+	created    time.Time
+	returned   time.Time
+}
+
+//Pool of authenticated backend connections of a config.Connection.
+//Connections are borrowed with Get and returned with Put, or closed with Discard if their state is unknown.
+//New connections go to the active DSN, failing over to the next ones when it is unreachable,
+//and failing back to the previous ones when they are healthy again.
+//With health checks, the DSNs down are skipped
+type Pool struct {
+	connection  *config.Connection
+	dsns        config.DSNList // the first one is the preferred
+	cfg         PoolConfig
+	mutex       sync.Mutex
+	active      int           // index of the DSN of new connections
+	checked     time.Time     // last fail back check
+	idle        []*PooledConn // last returned at the end
+	open        int           // idle and borrowed
+	borrowed    bool          // Get was called, the MinSize connections are kept from then on
+	capability  uint32        // of the last borrow, to open the MinSize connections
+	collation   byte          // of the last borrow
+	closed      bool
+	available   chan struct{}    // a connection is returned or closed
+	health      []*HealthChecker // of each DSN, nil without health checks
+	outstanding int64            // queries in progress, updated atomically
+	done        chan struct{}
+}
+
+//NewPool creates a pool of the connection to the DSNs, keeping MinSize idle connections once it is used
+func NewPool(connection *config.Connection, dsns config.DSNList, cfg PoolConfig) *Pool {
+	pool := &Pool{
+		connection: connection,
+		dsns:       dsns,
+		cfg:        cfg,
+		available:  make(chan struct{}, cfg.MaxSize),
+		done:       make(chan struct{}),
+	}
+	if cfg.HealthInterval > 0 {
+		pool.health = make([]*HealthChecker, len(dsns))
+		for i, dsn := range dsns {
+			pool.health[i] = NewHealthChecker(connection, dsn, cfg.HealthInterval, cfg.HealthTimeout, cfg.HealthFailures, cfg.HealthSuccesses)
+		}
+	}
+	go pool.maintain()
+	return pool
+}
+
+//Get borrows a healthy connection with the capabilities and the collation, switched to db if it is not empty.
+//It waits for a free connection up to WaitTimeout, returning ERR 1040 after it
+func (pool *Pool) Get(capability uint32, collation byte, db string) (*PooledConn, error) {
+	if collation == 0 {
+		collation = mysql.DefaultCollationID
+	}
+	timer := time.NewTimer(pool.cfg.WaitTimeout)
+	defer timer.Stop()
+	for {
+		pool.mutex.Lock()
+		if pool.closed {
+			pool.mutex.Unlock()
+			return nil, errors.New("Pool closed")
+		}
+		pool.borrowed = true
+		pool.capability = capability
+		pool.collation = collation
+		conn, stale := pool.takeIdle(capability, collation)
+		if conn == nil && stale == nil && pool.open < pool.cfg.MaxSize {
+			pool.open++
+			pool.mutex.Unlock()
+			conn, err := pool.dial(capability, collation, db)
+			if err != nil {
+				pool.removed()
+				return nil, err
+			}
+			return conn, nil
+		}
+		pool.mutex.Unlock()
+		if stale != nil {
+			//an idle connection of other capabilities or collation makes room for a new one
+			pool.Discard(stale)
+			continue
+		} else if conn != nil {
+			if pool.check(conn, db) {
+				return conn, nil
+			}
+			pool.Discard(conn)
+			continue
+		}
+		select {
+		case <-pool.available:
+		case <-timer.C:
+			return nil, mysql.NewError(mysql.ErrConCountError)
+		}
+	}
+}
+
+//takeIdle removes the last returned idle connection with the capabilities and the collation, or an idle connection
+//of others as stale if the pool is full. Called with the mutex held
+func (pool *Pool) takeIdle(capability uint32, collation byte) (conn *PooledConn, stale *PooledConn) {
+	for i := len(pool.idle) - 1; i >= 0; i-- {
+		if pool.idle[i].capability == capability && pool.idle[i].collation == collation {
+			conn = pool.idle[i]
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			return conn, nil
+		}
+	}
+	if len(pool.idle) > 0 && pool.open >= pool.cfg.MaxSize {
+		stale = pool.idle[0]
+		pool.idle = pool.idle[1:]
+	}
+	return nil, stale
+}
+
+//check pings a borrowed connection and switches it to db, false if it is not usable
+func (pool *Pool) check(conn *PooledConn, db string) bool {
+	if time.Since(conn.created) >= pool.cfg.MaxLifetime || !pool.isActive(conn) || !pool.isUp(conn.endpoint) {
+		return false
+	}
+	err := conn.Ping()
+	if err == nil && db != "" && db != conn.db {
+		err = conn.InitDB(db)
+		if err == nil {
+			conn.db = db
+		}
+	}
+	if err != nil {
+		log.Printf("Discarding backend connection of %s: %v", pool.connection.ID, err)
+		return false
+	}
+	return true
+}
+
+//dial opens a backend connection as the db user of the connection, trying the DSNs up from the active one
+//and failing over to the next one on fatal errors
+func (pool *Pool) dial(capability uint32, collation byte, db string) (conn *PooledConn, err error) {
+	pool.mutex.Lock()
+	active := pool.active
+	pool.mutex.Unlock()
+	dsns := pool.dsns
+	err = fmt.Errorf("All DSNs of %s are down", pool.connection.ID)
+	for i := range dsns {
+		endpoint := (active + i) % len(dsns)
+		if !pool.isUp(endpoint) {
+			continue
+		}
+		conn, err = pool.dialEndpoint(endpoint, capability, collation, db)
+		if err == nil {
+			if endpoint != active {
+				pool.activate(active, endpoint)
+			}
+			return conn, nil
+		} else if !isFatal(err) {
+			return nil, err
+		}
+		log.Printf("Error connecting to DSN %d of %s: %v", endpoint, pool.connection.ID, err)
+	}
+	return nil, err
+}
+
+//dialEndpoint opens a backend connection to the DSN, retrying with backoff
+func (pool *Pool) dialEndpoint(endpoint int, capability uint32, collation byte, db string) (*PooledConn, error) {
+	dsn, err := backendDSN(pool.connection, pool.dsns[endpoint], db)
+	if err != nil {
+		return nil, err
+	}
+	backoff := pool.cfg.Backoff
+	for retry := 0; ; retry++ {
+		var conn *mysql.Conn
+		conn, err = mysql.Dial(dsn, mysql.WithCapability(capability), mysql.WithCollation(collation))
+		if err == nil {
+			now := time.Now()
+			return &PooledConn{conn, pool, capability, conn.Collation(), endpoint, dsn.DBName, now, now}, nil
+		} else if retry >= pool.cfg.Retries || !isFatal(err) {
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+//isFatal checks if a connection error is caused by the backend endpoint, a reason to fail over
+func isFatal(err error) bool {
+	var sqlErr *mysql.Error
+	if !errors.As(err, &sqlErr) {
+		//network or protocol errors
+		return true
+	}
+	switch sqlErr.Number {
+	case mysql.ErrConCountError, mysql.ErrServerShutdown, mysql.ErrHostIsBlocked, mysql.ErrHostNotPrivileged,
+		mysql.CRConnectionError, mysql.CRServerGoneError, mysql.CRServerLost:
+		return true
+	}
+	return false
+}
+
+//activate switches the active DSN from the one the caller saw to the endpoint, unless another caller switched it meanwhile
+func (pool *Pool) activate(from int, endpoint int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.active == from {
+		log.Printf("Connection %s switched from DSN %d to %d", pool.connection.ID, from, endpoint)
+		pool.active = endpoint
+	}
+}
+
+//isActive checks if the connection is to the active DSN
+func (pool *Pool) isActive(conn *PooledConn) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return conn.endpoint == pool.active
+}
+
+//isUp checks if the health checks of the DSN admit it, always true without health checks
+func (pool *Pool) isUp(endpoint int) bool {
+	return pool.health == nil || pool.health[endpoint].State() == EndpointUp
+}
+
+//Outstanding returns the number of queries in progress on the connections of the pool
+func (pool *Pool) Outstanding() int64 {
+	return atomic.LoadInt64(&pool.outstanding)
+}
+
+//Available checks if a DSN of the pool is up
+func (pool *Pool) Available() bool {
+	for endpoint := range pool.dsns {
+		if pool.isUp(endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+//ActiveDSN returns the DSN of new connections
+func (pool *Pool) ActiveDSN() string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.dsns[pool.active]
+}
+
+//failback activates the first healthy DSN before the active one, checked every FailbackInterval
+func (pool *Pool) failback() {
+	pool.mutex.Lock()
+	active := pool.active
+	due := pool.cfg.FailbackInterval > 0 && active > 0 && time.Since(pool.checked) >= pool.cfg.FailbackInterval
+	if due {
+		pool.checked = time.Now()
+	}
+	pool.mutex.Unlock()
+	if !due {
+		return
+	}
+	for endpoint := 0; endpoint < active; endpoint++ {
+		if pool.health != nil {
+			//the health checks ping the DSNs already
+			if pool.isUp(endpoint) {
+				pool.activate(active, endpoint)
+				return
+			}
+			continue
+		}
+		dsn, err := backendDSN(pool.connection, pool.dsns[endpoint], "")
+		if err != nil {
+			continue
+		}
+		//the probe runs on the maintain loop, an unreachable DSN must not stall it
+		timeout := failbackTimeout
+		if pool.cfg.FailbackInterval < timeout {
+			timeout = pool.cfg.FailbackInterval
+		}
+		dsn.Timeout = timeout
+		dsn.ReadTimeout = timeout
+		dsn.WriteTimeout = timeout
+		conn, err := mysql.Dial(dsn)
+		if err != nil {
+			continue
+		}
+		err = conn.Ping()
+		conn.Close()
+		if err == nil {
+			pool.activate(active, endpoint)
+			return
+		}
+	}
+}
+
+//Put returns a borrowed connection, resetting its session state with COM_RESET_CONNECTION,
+//or COM_CHANGE_USER if the server does not support it or the schema is not the one of the DSN
+func (pool *Pool) Put(conn *PooledConn) {
+	if time.Since(conn.created) >= pool.cfg.MaxLifetime || !pool.isActive(conn) || !pool.isUp(conn.endpoint) {
+		pool.Discard(conn)
+		return
+	}
+	db := pool.defaultDB(conn.endpoint)
+	var err error
+	if conn.db != db {
+		//only COM_CHANGE_USER leaves a schema, the DSN may have none
+		err = conn.ChangeUser(db)
+	} else {
+		err = conn.ResetConnection()
+		var sqlErr *mysql.Error
+		if errors.As(err, &sqlErr) && sqlErr.Number == mysql.ErrUnknownComError {
+			err = conn.ChangeUser(db)
+		}
+	}
+	conn.db = db
+	if err != nil {
+		log.Printf("Error resetting backend connection of %s: %v", pool.connection.ID, err)
+		pool.Discard(conn)
+		return
+	}
+	conn.returned = time.Now()
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		pool.Discard(conn)
+		return
+	}
+	pool.idle = append(pool.idle, conn)
+	pool.mutex.Unlock()
+	pool.signal()
+}
+
+//defaultDB returns the schema of the DSN of the endpoint, empty for none
+func (pool *Pool) defaultDB(endpoint int) string {
+	dsn, err := mysql.ParseDSN(pool.dsns[endpoint])
+	if err != nil {
+		return ""
+	}
+	return dsn.DBName
+}
+
+//Discard closes a borrowed or idle connection
+func (pool *Pool) Discard(conn *PooledConn) {
+	conn.Close()
+	pool.removed()
+}
+
+//removed accounts a closed connection
+func (pool *Pool) removed() {
+	pool.mutex.Lock()
+	pool.open--
+	pool.mutex.Unlock()
+	pool.signal()
+}
+
+//signal wakes up a borrower waiting for a free connection
+func (pool *Pool) signal() {
+	select {
+	case pool.available <- struct{}{}:
+	default:
+	}
+}
+
+//Stats returns the number of open and idle connections
+func (pool *Pool) Stats() (open int, idle int) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.open, len(pool.idle)
+}
+
+//Close closes the idle connections, the borrowed ones are closed when returned
+func (pool *Pool) Close() {
+	pool.mutex.Lock()
+	if pool.closed {
+		pool.mutex.Unlock()
+		return
+	}
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.mutex.Unlock()
+	close(pool.done)
+	for _, checker := range pool.health {
+		checker.Close()
+	}
+	for _, conn := range idle {
+		pool.Discard(conn)
+	}
+}
+
+//maintain closes the expired idle connections and opens the MinSize ones periodically
+func (pool *Pool) maintain() {
+	interval := time.Second
+	if pool.cfg.IdleTimeout > 0 && pool.cfg.IdleTimeout/2 < interval {
+		interval = pool.cfg.IdleTimeout / 2
+	}
+	if pool.cfg.FailbackInterval > 0 && pool.cfg.FailbackInterval < interval {
+		interval = pool.cfg.FailbackInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pool.done:
+			return
+		case <-ticker.C:
+			pool.failback()
+			pool.expire()
+			pool.fill()
+		}
+	}
+}
+
+//expire closes the idle connections past MaxLifetime or to other DSNs than the active one or down, and past IdleTimeout above MinSize
+func (pool *Pool) expire() {
+	now := time.Now()
+	var expired []*PooledConn
+	pool.mutex.Lock()
+	idle := pool.idle[:0]
+	for _, conn := range pool.idle {
+		//the first ones are the longest idle
+		aboveMin := pool.open-len(expired) > pool.cfg.MinSize
+		if now.Sub(conn.created) >= pool.cfg.MaxLifetime || conn.endpoint != pool.active || !pool.isUp(conn.endpoint) || (aboveMin && now.Sub(conn.returned) >= pool.cfg.IdleTimeout) {
+			expired = append(expired, conn)
+		} else {
+			idle = append(idle, conn)
+		}
+	}
+	pool.idle = idle
+	pool.mutex.Unlock()
+	for _, conn := range expired {
+		pool.Discard(conn)
+	}
+}
+
+//fill opens idle connections up to MinSize, with the capabilities and the collation of the last borrow
+func (pool *Pool) fill() {
+	for {
+		pool.mutex.Lock()
+		if pool.closed || !pool.borrowed || pool.open >= pool.cfg.MinSize {
+			pool.mutex.Unlock()
+			return
+		}
+		pool.open++
+		capability, collation := pool.capability, pool.collation
+		pool.mutex.Unlock()
+		conn, err := pool.dial(capability, collation, "")
+		if err != nil {
+			log.Printf("Error opening backend connection of %s: %v", pool.connection.ID, err)
+			pool.removed()
+			return
+		}
+		pool.mutex.Lock()
+		if pool.closed {
+			pool.mutex.Unlock()
+			pool.Discard(conn)
+			return
+		}
+		pool.idle = append(pool.idle, conn)
+		pool.mutex.Unlock()
+		pool.signal()
+	}
+}
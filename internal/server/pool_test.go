@@ -0,0 +1,360 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysqltest "github.com/rafalopez79/godriver/internal/mysqltest"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+//newHangingListener listens on a local address accepting connections but never answering
+func newHangingListener(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestPool(t *testing.T, backend *mysqltest.Server, cfg PoolConfig) *Pool {
+	return newFailoverPool(t, cfg, backend)
+}
+
+//newFailoverPool creates a pool with a DSN of each backend, the first one is the primary
+func newFailoverPool(t *testing.T, cfg PoolConfig, backends ...*mysqltest.Server) *Pool {
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1"}
+	for _, backend := range backends {
+		connection.DSNS = append(connection.DSNS, "tcp("+backend.Addr+")/db1")
+	}
+	pool := NewPool(connection, connection.DSNS, cfg)
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func assertStats(t *testing.T, pool *Pool, open, idle int) {
+	o, i := pool.Stats()
+	assert.Equal(t, o, open)
+	assert.Equal(t, i, idle)
+}
+
+func TestPoolReuse(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MaxSize: 2, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	id := conn.ConnectionID()
+	_, err = conn.Exec("BEGIN")
+	assert.NilError(t, err)
+	assertStats(t, pool, 1, 0)
+	pool.Put(conn)
+	assertStats(t, pool, 1, 1)
+	assert.Equal(t, backend.Resets(), 1)
+
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "db2")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.ConnectionID(), id)
+	assert.Equal(t, conn.db, "db2")
+	assert.Equal(t, conn.Status()&mysql.ServerStatusInTrans, uint16(0))
+
+	//other capabilities need another connection
+	other, err := pool.Get(forwardedCapability&^mysql.ClientLocalFiles, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, other.ConnectionID() != id)
+	pool.Put(other)
+	pool.Put(conn)
+	assertStats(t, pool, 2, 2)
+	assert.Equal(t, backend.Connections(), 2)
+}
+
+func TestPoolMaxSize(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MaxSize: 1, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: 50 * time.Millisecond})
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	_, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assertSQLError(t, err, mysql.ErrConCountError)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(conn)
+	}()
+	again, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, again.ConnectionID(), conn.ConnectionID())
+
+	//an idle connection of other capabilities is replaced
+	pool.Put(again)
+	other, err := pool.Get(mysql.ClientMultiResults, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, other.ConnectionID() != conn.ConnectionID())
+	assertStats(t, pool, 1, 0)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MaxSize: 1, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	id := conn.ConnectionID()
+	pool.Put(conn)
+	backend.CloseConnections()
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, conn.ConnectionID() != id)
+	assert.NilError(t, conn.Ping())
+	assertStats(t, pool, 1, 0)
+}
+
+func TestPoolChangeUser(t *testing.T) {
+	backend, err := mysqltest.NewServer("dbuser1", "dbpassword1", mysqltest.WithoutResetConnection(), mysqltest.WithAuthMethod(mysql.AuthCachingSHA2Password))
+	assert.NilError(t, err)
+	defer backend.Close()
+	pool := newTestPool(t, backend, PoolConfig{MaxSize: 1, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	pool.Put(conn)
+	assert.Equal(t, backend.Resets(), 1)
+	assertStats(t, pool, 1, 1)
+	assert.DeepEqual(t, backend.Collations(), []byte{mysql.DefaultCollationID, mysql.DefaultCollationID})
+}
+
+func TestPoolResetsSchema(t *testing.T) {
+	backend := newBackend(t)
+	for _, dsn := range []string{"/db1", "/"} {
+		connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1", DSNS: config.DSNList{"tcp(" + backend.Addr + ")" + dsn}}
+		pool := NewPool(connection, connection.DSNS, PoolConfig{MaxSize: 1, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+		defer pool.Close()
+
+		conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "db2")
+		assert.NilError(t, err)
+		pool.Put(conn)
+		//a borrower without a schema gets the one of the DSN, not the one of the previous borrower
+		again, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+		assert.NilError(t, err)
+		assert.Equal(t, again, conn)
+		rows, err := again.Query("SELECT DATABASE()")
+		assert.NilError(t, err)
+		var db interface{}
+		if dsn != "/" {
+			db = []byte(dsn[1:])
+		}
+		assert.DeepEqual(t, readAll(t, rows), [][]interface{}{{db}})
+		pool.Put(again)
+	}
+}
+
+func TestPoolCollation(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MaxSize: 2, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+	conn, err := pool.Get(forwardedCapability, 255, "")
+	assert.NilError(t, err)
+	pool.Put(conn)
+	//idle connections of other collations are not reused
+	other, err := pool.Get(forwardedCapability, 0, "")
+	assert.NilError(t, err)
+	assert.Assert(t, other != conn)
+	again, err := pool.Get(forwardedCapability, 255, "")
+	assert.NilError(t, err)
+	assert.Equal(t, again, conn)
+	pool.Put(again)
+	pool.Put(other)
+	assert.DeepEqual(t, backend.Collations(), []byte{255, mysql.DefaultCollationID})
+}
+
+func TestPoolTimeouts(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MinSize: 1, MaxSize: 3, IdleTimeout: 20 * time.Millisecond, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+
+	var conns []*PooledConn
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+		assert.NilError(t, err)
+		conns = append(conns, conn)
+	}
+	for _, conn := range conns {
+		pool.Put(conn)
+	}
+	assertStats(t, pool, 3, 3)
+	//idle connections above MinSize are closed
+	deadline := time.Now().Add(2 * time.Second)
+	for open, _ := pool.Stats(); open > 1 && time.Now().Before(deadline); open, _ = pool.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertStats(t, pool, 1, 1)
+
+	//connections past MaxLifetime are not returned
+	pool.cfg.MaxLifetime = 10 * time.Millisecond
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	pool.Put(conn)
+	open, _ := pool.Stats()
+	assert.Assert(t, open <= 1)
+}
+
+func TestPoolMinSize(t *testing.T) {
+	backend := newBackend(t)
+	pool := newTestPool(t, backend, PoolConfig{MinSize: 2, MaxSize: 3, IdleTimeout: 20 * time.Millisecond, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+	//no connection is opened before the first borrow
+	time.Sleep(30 * time.Millisecond)
+	assertStats(t, pool, 0, 0)
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	deadline := time.Now().Add(2 * time.Second)
+	for _, idle := pool.Stats(); idle < 1 && time.Now().Before(deadline); _, idle = pool.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertStats(t, pool, 2, 1)
+	pool.Put(conn)
+	pool.Close()
+	assertStats(t, pool, 0, 0)
+	_, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.ErrorContains(t, err, "Pool closed")
+
+	//a borrow without capabilities counts too
+	pool = newTestPool(t, backend, PoolConfig{MinSize: 2, MaxSize: 3, IdleTimeout: 20 * time.Millisecond, MaxLifetime: time.Hour, WaitTimeout: time.Second})
+	conn, err = pool.Get(0, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	deadline = time.Now().Add(2 * time.Second)
+	for _, idle := pool.Stats(); idle < 1 && time.Now().Before(deadline); _, idle = pool.Stats() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertStats(t, pool, 2, 1)
+	pool.Put(conn)
+}
+
+func TestPoolFailover(t *testing.T) {
+	primary, secondary := newBackend(t), newBackend(t)
+	cfg := PoolConfig{MaxSize: 2, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second, Retries: 2, Backoff: 10 * time.Millisecond}
+	pool := newFailoverPool(t, cfg, primary, secondary)
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	pool.Put(conn)
+	primary.SetDown(true)
+	primary.CloseConnections()
+
+	//the idle connection fails the ping, the primary is retried with backoff before failing over
+	start := time.Now()
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Assert(t, time.Since(start) >= 30*time.Millisecond)
+	assert.Equal(t, pool.ActiveDSN(), pool.dsns[1])
+	assert.Equal(t, secondary.Connections(), 1)
+	assertStats(t, pool, 1, 0)
+
+	//without fail back new connections stay on the secondary
+	primary.SetDown(false)
+	other, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, other.endpoint, 1)
+	pool.Put(other)
+	pool.Put(conn)
+	assert.Equal(t, secondary.Connections(), 2)
+
+	//all down
+	secondary.SetDown(true)
+	secondary.CloseConnections()
+	primary.SetDown(true)
+	_, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.Assert(t, err != nil)
+	assertStats(t, pool, 0, 0)
+}
+
+func TestPoolFailback(t *testing.T) {
+	primary, secondary := newBackend(t), newBackend(t)
+	cfg := PoolConfig{MaxSize: 2, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second, Backoff: time.Millisecond, FailbackInterval: 20 * time.Millisecond}
+	pool := newFailoverPool(t, cfg, primary, secondary)
+	primary.SetDown(true)
+
+	conn, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.endpoint, 1)
+	borrowed, err := pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	pool.Put(conn)
+
+	primary.SetDown(false)
+	deadline := time.Now().Add(2 * time.Second)
+	for pool.ActiveDSN() != pool.dsns[0] && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, pool.ActiveDSN(), pool.dsns[0])
+
+	//connections to the secondary are closed when idle or returned
+	conn, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.endpoint, 0)
+	pool.Put(borrowed)
+	pool.Put(conn)
+	assertStats(t, pool, 1, 1)
+	deadline = time.Now().Add(2 * time.Second)
+	for secondary.Connections() > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, secondary.Connections(), 0)
+}
+
+func TestPoolNoFailoverOnAccessDenied(t *testing.T) {
+	primary, err := mysqltest.NewServer("dbuser1", "other")
+	assert.NilError(t, err)
+	defer primary.Close()
+	secondary := newBackend(t)
+	pool := newFailoverPool(t, PoolConfig{MaxSize: 1, WaitTimeout: time.Second, Backoff: time.Millisecond}, primary, secondary)
+
+	_, err = pool.Get(forwardedCapability, mysql.DefaultCollationID, "")
+	assertSQLError(t, err, mysql.ErrAccessDeniedError)
+	assert.Equal(t, pool.ActiveDSN(), pool.dsns[0])
+	assert.Equal(t, secondary.Connections(), 0)
+}
+
+func TestNewPoolConfig(t *testing.T) {
+	cfg := NewPoolConfig(&config.Connection{PoolMinSize: 20, FailoverRetries: -1, FailoverBackoff: 50, FailbackInterval: 30})
+	assert.DeepEqual(t, cfg, PoolConfig{DefaultPoolMaxSize, DefaultPoolMaxSize, DefaultPoolIdleTimeout, DefaultPoolMaxLifetime,
+		DefaultPoolWaitTimeout, 0, 50 * time.Millisecond, 30 * time.Second, 0, 0, 0, 0})
+	cfg = NewPoolConfig(&config.Connection{HealthCheckInterval: 5, HealthCheckTimeout: 500, HealthCheckFailures: 2, HealthCheckSuccesses: 1})
+	assert.Equal(t, cfg.HealthInterval, 5*time.Second)
+	assert.Equal(t, cfg.HealthTimeout, 500*time.Millisecond)
+	assert.Equal(t, cfg.HealthFailures, 2)
+	assert.Equal(t, cfg.HealthSuccesses, 1)
+}
+
+func TestPoolFailbackTimeout(t *testing.T) {
+	//the primary accepts connections but never answers
+	addr := newHangingListener(t)
+	secondary := newBackend(t)
+	connection := &config.Connection{ID: "test1", DBUser: "dbuser1", DBPassword: "dbpassword1",
+		DSNS: config.DSNList{"tcp(" + addr + ")/", "tcp(" + secondary.Addr + ")/"}}
+	cfg := PoolConfig{MaxSize: 1, IdleTimeout: time.Minute, MaxLifetime: time.Hour, WaitTimeout: time.Second, Backoff: time.Millisecond,
+		FailbackInterval: 50 * time.Millisecond}
+	pool := NewPool(connection, connection.DSNS, cfg)
+	defer pool.Close()
+	pool.activate(0, 1)
+	start := time.Now()
+	pool.failback()
+	assert.Assert(t, time.Since(start) < time.Second)
+	assert.Equal(t, pool.ActiveDSN(), pool.dsns[1])
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//route returns the backend session of the command: a replica for the reads out of transactions
+//and the primary for everything else. fresh is true if the backend session is borrowed for the command
+func (session *Session) route(command byte, query string) (backend *PooledConn, fresh bool, err error) {
+	if session.readsFromReplica(command, query) {
+		fresh = session.replica == nil
+		if replica := session.connectReplica(); replica != nil {
+			err = replica.useDB(session.db)
+			if err == nil {
+				return replica, fresh, nil
+			}
+			log.Printf("Error switching replica of session %d to %s: %v", session.sessionID, session.db, err)
+			session.closeBackend(replica)
+		}
+	} else if command == mysql.ComSTMTExecute || (command == mysql.ComQuery && !isReadOnlyQuery(query)) {
+		session.server.recordWrite(session.identity.User)
+		//the replicas do not see SET NAMES, time_zone, user variables or temporary tables of the session
+		session.pinned = session.pinned || changesSession(command, query)
+	}
+	fresh = session.backend == nil
+	backend, err = session.connectBackend()
+	return backend, fresh, err
+}
+
+//readsFromReplica checks if the command is a read out of a transaction, without recent writes of the user
+//nor session state on the primary
+func (session *Session) readsFromReplica(command byte, query string) bool {
+	connection := session.identity.Connection
+	if len(connection.Replicas) == 0 || command != mysql.ComQuery || session.pinned {
+		return false
+	} else if session.status&mysql.ServerStatusInTrans != 0 || session.status&mysql.ServerStatusAutocommit == 0 {
+		return false
+	} else if !isReadOnlyQuery(query) {
+		return false
+	}
+	window := time.Duration(connection.ReadYourWrites) * time.Millisecond
+	return !session.server.wroteWithin(session.identity.User, window)
+}
+
+//useDB switches the backend session to the schema if it is not empty
+func (conn *PooledConn) useDB(db string) error {
+	if db == "" || db == conn.db {
+		return nil
+	}
+	err := conn.InitDB(db)
+	if err != nil {
+		return err
+	}
+	conn.db = db
+	return nil
+}
+
+//recordWrite records the time of a write of the user
+func (server *Server) recordWrite(user string) {
+	server.lastWrites.Store(user, time.Now())
+}
+
+//wroteWithin checks if the user wrote within the window
+func (server *Server) wroteWithin(user string, window time.Duration) bool {
+	if window <= 0 {
+		return false
+	}
+	last, ok := server.lastWrites.Load(user)
+	return ok && time.Since(last.(time.Time)) < window
+}
+
+//readOnlyExclusions make a SELECT lock rows, write, or depend on the session state of the primary
+var readOnlyExclusions = []string{
+	"FOR UPDATE", "FOR SHARE", "LOCK IN SHARE MODE", "INTO", "@",
+	"LAST_INSERT_ID", "FOUND_ROWS", "ROW_COUNT", "GET_LOCK", "RELEASE_LOCK", "IS_USED_LOCK", "IS_FREE_LOCK",
+}
+
+//isReadOnlyQuery checks if the query is a plain SELECT
+func isReadOnlyQuery(query string) bool {
+	query = strings.ToUpper(strings.TrimRight(skipComments(query), "; \t\r\n"))
+	if !strings.HasPrefix(query, "SELECT") || strings.Contains(query, ";") {
+		return false
+	}
+	for _, exclusion := range readOnlyExclusions {
+		if strings.Contains(query, exclusion) {
+			return false
+		}
+	}
+	return true
+}
+
+//useDB returns the schema of a USE statement, empty for other queries
+func useDB(query string) string {
+	query = strings.TrimRight(skipComments(query), "; \t\r\n")
+	if len(query) < 4 || !strings.EqualFold(query[:4], "USE ") {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(query[4:]), "`")
+}
+
+//skipComments removes the leading spaces and comments of the query
+func skipComments(query string) string {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n")
+		switch {
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+2:]
+		case strings.HasPrefix(query, "#"), strings.HasPrefix(query, "-- "):
+			end := strings.Index(query, "\n")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+1:]
+		default:
+			return query
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	mysqltest "github.com/rafalopez79/godriver/internal/mysqltest"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+func TestIsReadOnlyQuery(t *testing.T) {
+	tests := []struct {
+		query    string
+		readOnly bool
+	}{
+		{"SELECT 1", true},
+		{"  select a FROM t WHERE b = 1;", true},
+		{"/* comment */ SELECT a FROM t", true},
+		{"-- comment\n# other\nSELECT a FROM t", true},
+		{"SELECT a FROM t FOR UPDATE", false},
+		{"SELECT a FROM t FOR SHARE", false},
+		{"SELECT a FROM t LOCK IN SHARE MODE", false},
+		{"SELECT a INTO @a FROM t", false},
+		{"SELECT LAST_INSERT_ID()", false},
+		{"SELECT GET_LOCK('a', 1)", false},
+		{"SELECT 1; DELETE FROM t", false},
+		{"UPDATE t SET a = 1", false},
+		{"BEGIN", false},
+		{"/* unterminated SELECT 1", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, isReadOnlyQuery(test.query), test.readOnly, test.query)
+	}
+}
+
+func TestUseDB(t *testing.T) {
+	assert.Equal(t, useDB("USE db1"), "db1")
+	assert.Equal(t, useDB(" use `db2`;"), "db2")
+	assert.Equal(t, useDB("/* c */ USE db3"), "db3")
+	assert.Equal(t, useDB("SELECT 1"), "")
+	assert.Equal(t, useDB("USER"), "")
+}
+
+//newSplittingServer creates a server forwarding user1 to the primary and the replicas
+func newSplittingServer(t *testing.T, readYourWrites int, primary *mysqltest.Server, replicas ...*mysqltest.Server) *Server {
+	connection := config.Connection{ID: "test1", User: "user1", Password: "password1", DBUser: "dbuser1", DBPassword: "dbpassword1",
+		DSNS: config.DSNList{"tcp(" + primary.Addr + ")/"}, ReadYourWrites: readYourWrites}
+	for _, replica := range replicas {
+		connection.Replicas = append(connection.Replicas, "tcp("+replica.Addr+")/")
+	}
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, []config.Connection{connection})
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRouteReadsToReplica(t *testing.T) {
+	primary, replica := newBackend(t), newBackend(t)
+	conn := connectClient(t, newSplittingServer(t, 0, primary, replica))
+	_, err := conn.Exec("SELECT a FROM t")
+	assert.NilError(t, err)
+	_, err = conn.Exec("UPDATE t SET a = 1")
+	assert.NilError(t, err)
+	_, err = conn.Exec("SELECT a FROM t FOR UPDATE")
+	assert.NilError(t, err)
+	//reads of a transaction go to the primary
+	_, err = conn.Exec("BEGIN")
+	assert.NilError(t, err)
+	_, err = conn.Exec("SELECT b FROM t")
+	assert.NilError(t, err)
+	_, err = conn.Exec("COMMIT")
+	assert.NilError(t, err)
+	_, err = conn.Exec("SELECT c FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, replica.Queries(), []string{"SELECT a FROM t", "SELECT c FROM t"})
+	assert.DeepEqual(t, primary.Queries(), []string{"UPDATE t SET a = 1", "SELECT a FROM t FOR UPDATE", "BEGIN", "SELECT b FROM t", "COMMIT"})
+}
+
+func TestRouteReadYourWrites(t *testing.T) {
+	primary, replica := newBackend(t), newBackend(t)
+	server := newSplittingServer(t, 200, primary, replica)
+	writer, reader := connectClient(t, server), connectClient(t, server)
+	_, err := writer.Exec("UPDATE t SET a = 1")
+	assert.NilError(t, err)
+	//the window is per user, not per session
+	_, err = reader.Exec("SELECT a FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, primary.Queries(), []string{"UPDATE t SET a = 1", "SELECT a FROM t"})
+	time.Sleep(250 * time.Millisecond)
+	_, err = reader.Exec("SELECT b FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, replica.Queries(), []string{"SELECT b FROM t"})
+}
+
+func TestRouteReplicaDown(t *testing.T) {
+	primary, replica := newBackend(t), newBackend(t)
+	replica.SetDown(true)
+	conn := connectClient(t, newSplittingServer(t, 0, primary, replica))
+	_, err := conn.Exec("SELECT a FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, primary.Queries(), []string{"SELECT a FROM t"})
+	assert.Equal(t, len(replica.Queries()), 0)
+}
+
+func TestRouteSessionState(t *testing.T) {
+	primary, replica := newBackend(t), newBackend(t)
+	conn := connectClient(t, newSplittingServer(t, 0, primary, replica))
+	_, err := conn.Exec("SET TRANSACTION ISOLATION LEVEL READ COMMITTED")
+	assert.NilError(t, err)
+	_, err = conn.Exec("SELECT a FROM t")
+	assert.NilError(t, err)
+	//the replica session would read with other charset semantics
+	_, err = conn.Exec("SET NAMES utf8mb4")
+	assert.NilError(t, err)
+	_, err = conn.Exec("SELECT b FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, replica.Queries(), []string{"SELECT a FROM t"})
+	assert.DeepEqual(t, primary.Queries(), []string{"SET TRANSACTION ISOLATION LEVEL READ COMMITTED", "SET NAMES utf8mb4", "SELECT b FROM t"})
+
+	//a new client session reads from the replica again
+	conn = connectClient(t, newSplittingServer(t, 0, primary, replica))
+	_, err = conn.Exec("SELECT c FROM t")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, replica.Queries(), []string{"SELECT a FROM t", "SELECT c FROM t"})
+}
@@ -1,13 +1,16 @@
 package server
 
 import (
+	"crypto/rsa"
 	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	config "github.com/rafalopez79/godriver/internal/config"
 	util "github.com/rafalopez79/godriver/internal/util"
 	mysql "github.com/rafalopez79/godriver/mysql"
 )
@@ -20,19 +23,41 @@ type Server struct {
 	collationID       uint8
 	defaultAuthMethod string // default authentication method, 'mysql_native_password'
 	pubKey            []byte
+	privKey           *rsa.PrivateKey
 	tlsConfig         *tls.Config
-	cacheShaPassword  *sync.Map        // 'user@host' -> SHA256(SHA256(PASSWORD))
+	cacheShaPassword  *sync.Map        // 'user@host' -> *cachedPassword
 	connectionCount   uint32           //conn id tracker
 	sessions          *sync.Map        //[uint64]Session
 	bufferPool        *util.BufferPool //bufferpool
 	listener          *net.TCPListener //listener
+	authenticator     Authenticator    //client credentials
+	//allowed compression algorithms, nil for all
+	compressionAlgorithms []string
+	zstdLevel             int              //0 for the client level
+	statementHandler      StatementHandler //prepared statements, nil if not supported
+	pools                 *sync.Map        //Connection.ID, or Connection.ID#replica -> *Pool
+	lastWrites            *sync.Map        //user -> time.Time of the last write
+	lagCheckers           *sync.Map        //Connection.ID#replica -> *LagChecker
+	balancers             *sync.Map        //Connection.ID -> Balancer of the replicas
+	maxPacketSize         uint32           //limit of the packets read, lowered by the client after the handshake
+}
+
+//DefaultMaxPacketSize of the packets read from clients, the max_allowed_packet default of MySQL 8
+const DefaultMaxPacketSize = 64 << 20
+
+//cachedPassword of a caching_sha2_password full auth
+type cachedPassword struct {
+	hash     []byte // SHA256(SHA256(PASSWORD))
+	identity *Identity
 }
 
 //NewServer creates a new server
-func NewServer(serverVersion string, defaultAuthMethod string) (server *Server, err error) {
+func NewServer(serverVersion string, defaultAuthMethod string, connections []config.Connection, options ...func(*Server)) (server *Server, err error) {
 	const capability uint32 = mysql.ClientLongPassword | mysql.ClientLongFlag | mysql.ClientConnectWithDB |
 		mysql.ClientProtocol41 | mysql.ClientTransactions | mysql.ClientSecureConnection | mysql.ClientPluginAuth |
-		mysql.ClientPluginAuthLENENCClientData | mysql.ClientCompress | mysql.ClientSSL
+		mysql.ClientPluginAuthLENENCClientData | mysql.ClientCompress | mysql.ClientZstdCompressionAlgorithm | mysql.ClientSSL |
+		mysql.ClientFoundRows | mysql.ClientIgnoreSpace | mysql.ClientInteractive | mysql.ClientLocalFiles |
+		mysql.ClientMultiStatements | mysql.ClientMultiResults | mysql.ClientPSMultiResults
 	caPem, caKey, err := generateCA()
 	if err != nil {
 		return nil, err
@@ -49,6 +74,13 @@ func NewServer(serverVersion string, defaultAuthMethod string) (server *Server,
 	if err != nil {
 		return nil, err
 	}
+	privKey, err := getPrivateKey(keyPem)
+	if err != nil {
+		return nil, err
+	}
+	if !isAuthMethodSupported(defaultAuthMethod) {
+		return nil, fmt.Errorf("Auth method %s not supported", defaultAuthMethod)
+	}
 	server = &Server{
 		serverVersion,
 		mysql.MinProtocolVersion,
@@ -56,16 +88,86 @@ func NewServer(serverVersion string, defaultAuthMethod string) (server *Server,
 		mysql.DefaultCollationID,
 		defaultAuthMethod,
 		pubKey,
+		privKey,
 		tlsConfig,
 		new(sync.Map),
 		0,
 		new(sync.Map),
 		util.NewBufferPool(),
 		nil,
+		nil,
+		nil,
+		0,
+		nil,
+		new(sync.Map),
+		new(sync.Map),
+		new(sync.Map),
+		new(sync.Map),
+		DefaultMaxPacketSize,
+	}
+	for _, option := range options {
+		option(server)
 	}
+	server.capability, err = compressionCapability(server.capability, server.compressionAlgorithms)
+	if err != nil {
+		return nil, err
+	}
+	if server.authenticator == nil {
+		server.authenticator, err = NewConfigAuthenticator(connections)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, connection := range connections {
+		balancer, err := NewBalancer(connection.Balancer)
+		if err != nil {
+			return nil, err
+		}
+		server.balancers.Store(connection.ID, balancer)
+	}
+	server.startLagCheckers(connections)
+	server.startHealthChecks(connections)
 	return server, nil
 }
 
+//WithCompression sets the allowed compression algorithms and the zstd level, 0 for the client level
+func WithCompression(algorithms []string, zstdLevel int) func(*Server) {
+	return func(server *Server) {
+		server.compressionAlgorithms = algorithms
+		server.zstdLevel = zstdLevel
+	}
+}
+
+//WithMaxPacketSize sets the limit of the packets read from clients, also before the handshake response. 0 keeps the default
+func WithMaxPacketSize(size uint32) func(*Server) {
+	return func(server *Server) {
+		if size > 0 {
+			server.maxPacketSize = size
+		}
+	}
+}
+
+//compressionCapability keeps the compression capabilities of the allowed algorithms
+func compressionCapability(capability uint32, algorithms []string) (uint32, error) {
+	if algorithms == nil {
+		return capability, nil
+	}
+	allowed := capability
+	capability &^= mysql.ClientCompress | mysql.ClientZstdCompressionAlgorithm
+	for _, algorithm := range algorithms {
+		switch algorithm {
+		case mysql.CompressionZlib:
+			capability |= allowed & mysql.ClientCompress
+		case mysql.CompressionZstd:
+			capability |= allowed & mysql.ClientZstdCompressionAlgorithm
+		case mysql.CompressionUncompressed:
+		default:
+			return 0, fmt.Errorf("Compression algorithm %s not supported", algorithm)
+		}
+	}
+	return capability, nil
+}
+
 //Serve on requests
 func (server *Server) Serve(port int) error {
 	service := fmt.Sprintf(":%d", port)
@@ -88,11 +190,117 @@ func (server *Server) Serve(port int) error {
 	}
 }
 
-//Close closes the socket
+//Close closes the socket, the backend pools and the lag checkers
 func (server *Server) Close() {
 	if server.listener != nil {
 		server.listener.Close()
 	}
+	server.lagCheckers.Range(func(key, checker interface{}) bool {
+		checker.(*LagChecker).Close()
+		return true
+	})
+	server.pools.Range(func(id, pool interface{}) bool {
+		pool.(*Pool).Close()
+		return true
+	})
+}
+
+//getPool returns the backend pool of the connection primary, created on first use
+func (server *Server) getPool(connection *config.Connection) *Pool {
+	return server.loadPool(connection.ID, connection, connection.DSNS)
+}
+
+//getReplicaPools returns the backend pools of the connection replicas in rotation and available,
+//with their balancing endpoints
+func (server *Server) getReplicaPools(connection *config.Connection) (pools []*Pool, endpoints []Endpoint) {
+	for i, dsn := range connection.Replicas {
+		key := replicaKey(connection, i)
+		if checker, ok := server.lagCheckers.Load(key); ok && !checker.(*LagChecker).InRotation() {
+			continue
+		}
+		pool := server.loadPool(key, connection, config.DSNList{dsn})
+		if !pool.Available() {
+			continue
+		}
+		weight := 1
+		if i < len(connection.ReplicaWeights) {
+			weight = connection.ReplicaWeights[i]
+		}
+		pools = append(pools, pool)
+		endpoints = append(endpoints, Endpoint{dsn, weight, pool.Outstanding()})
+	}
+	return pools, endpoints
+}
+
+//getBalancer returns the replica balancer of the connection
+func (server *Server) getBalancer(connection *config.Connection) Balancer {
+	if balancer, ok := server.balancers.Load(connection.ID); ok {
+		return balancer.(Balancer)
+	}
+	balancer, err := NewBalancer(connection.Balancer)
+	if err != nil {
+		log.Printf("Balancing the replicas of %s round-robin: %v", connection.ID, err)
+		balancer = &RoundRobinBalancer{}
+	}
+	actual, _ := server.balancers.LoadOrStore(connection.ID, balancer)
+	return actual.(Balancer)
+}
+
+//replicaKey of the pool and the lag checker of a connection replica
+func replicaKey(connection *config.Connection, replica int) string {
+	return fmt.Sprintf("%s#%d", connection.ID, replica)
+}
+
+//startHealthChecks opens the pools of the connections with health checks, their DSNs are pinged from the start
+func (server *Server) startHealthChecks(connections []config.Connection) {
+	for i := range connections {
+		connection := &connections[i]
+		if connection.HealthCheckInterval <= 0 {
+			continue
+		}
+		if len(connection.DSNS) > 0 {
+			server.getPool(connection)
+		}
+		for replica, dsn := range connection.Replicas {
+			server.loadPool(replicaKey(connection, replica), connection, config.DSNList{dsn})
+		}
+	}
+}
+
+//startLagCheckers starts a lag checker of each replica of the connections with ReplicaMaxLag
+func (server *Server) startLagCheckers(connections []config.Connection) {
+	for i := range connections {
+		connection := &connections[i]
+		if connection.ReplicaMaxLag <= 0 {
+			continue
+		}
+		maxLag := time.Duration(connection.ReplicaMaxLag) * time.Second
+		interval := time.Duration(connection.ReplicaLagInterval) * time.Second
+		for replica, dsn := range connection.Replicas {
+			server.lagCheckers.Store(replicaKey(connection, replica), NewLagChecker(connection, dsn, connection.ReplicaLagQuery, maxLag, interval))
+		}
+	}
+}
+
+//loadPool returns the pool of the key, created on first use
+func (server *Server) loadPool(key string, connection *config.Connection, dsns config.DSNList) *Pool {
+	if pool, ok := server.pools.Load(key); ok {
+		return pool.(*Pool)
+	}
+	pool := NewPool(connection, dsns, NewPoolConfig(connection))
+	if actual, loaded := server.pools.LoadOrStore(key, pool); loaded {
+		pool.Close()
+		return actual.(*Pool)
+	}
+	return pool
+}
+
+//getAuthMethod returns the auth method of the user
+func (server *Server) getAuthMethod(user string) string {
+	if authMethod := server.authenticator.AuthMethod(user); authMethod != "" {
+		return authMethod
+	}
+	return server.defaultAuthMethod
 }
 
 func (server *Server) handle(conn net.Conn) {
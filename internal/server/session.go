@@ -1,10 +1,14 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"compress/zlib"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math/rand"
 	"net"
 	"time"
@@ -25,13 +29,26 @@ type Session struct {
 	salt          []byte // 8 + 12
 	rand          *rand.Rand
 	capability    uint32
-	maxPacketSize uint32
+	maxPacketSize uint32 //limit of the packets read
 	collation     byte
+	//client handshake response
+	handshakeResponse *mysql.HandshakeResponse
+	db                string    //current schema
+	identity          *Identity //authenticated identity
+	status            uint16    //server status flags
+	compressSeq       byte      //compressed protocol sequence
+	//prepared statements by id
+	statements      map[uint32]*Statement
+	lastStatementID uint32
+	backend         *PooledConn //primary backend session, nil until the first forwarded command
+	backendState    bool        //state the client relies on was sent to the primary backend session
+	pinned          bool        //session state statements were sent to the primary backend session, reads stay on it
+	replica         *PooledConn //replica backend session, nil until the first read
 }
 
 //NewSession creates a new session
 func NewSession(sessionID uint32, server *Server, conn net.Conn) *Session {
-	var reader io.Reader = conn
+	var reader io.Reader = bufio.NewReader(conn)
 	var writer io.Writer = conn
 	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
 	salt, _ := util.RandomBuffer(rand, 20)
@@ -46,8 +63,19 @@ func NewSession(sessionID uint32, server *Server, conn net.Conn) *Session {
 		salt,
 		rand,
 		0,
+		server.maxPacketSize,
 		0,
+		nil,
+		"",
+		nil,
+		mysql.ServerStatusAutocommit,
 		0,
+		make(map[uint32]*Statement),
+		0,
+		nil,
+		false,
+		false,
+		nil,
 	}
 }
 
@@ -64,224 +92,451 @@ func (session *Session) AcceptClient() (err error) {
 	}
 	if useSSL {
 		//switch to tls
-		tlsConn := tls.Server(session.conn, session.server.tlsConfig)
+		tlsConn := tls.Server(&bufferedConn{session.conn, session.reader}, session.server.tlsConfig)
 		if err := tlsConn.Handshake(); err != nil {
 			return err
 		}
 		session.conn = tlsConn
-		session.reader = tlsConn
+		session.reader = bufio.NewReader(tlsConn)
 		session.writer = tlsConn
 		useSSL, err = session.readClientHandShakePacket()
 		if err != nil {
 			return err
 		}
-	} else {
+	}
+	err = session.authenticate()
+	if err != nil {
+		if writeErr := session.writeError(err); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+	if session.capability&(mysql.ClientCompress|mysql.ClientZstdCompressionAlgorithm) != 0 {
+		return session.startCompression()
+	}
+	return nil
+}
 
+//startCompression switches the session to the compressed protocol, zstd if negotiated, zlib otherwise
+func (session *Session) startCompression() (err error) {
+	var compression mysql.Compression
+	if session.capability&mysql.ClientZstdCompressionAlgorithm != 0 {
+		level := session.server.zstdLevel
+		if level == 0 {
+			level = int(session.handshakeResponse.ZstdCompressionLevel)
+		}
+		if level == 0 {
+			level = mysql.DefaultZstdCompressionLevel
+		}
+		compression, err = mysql.NewZstdCompression(level)
+	} else {
+		compression, err = mysql.NewZlibCompression(zlib.DefaultCompression)
+	}
+	if err != nil {
+		return err
 	}
+	session.reader = mysql.NewCompressedReader(session.reader, &session.compressSeq, compression)
+	session.writer = mysql.NewCompressedWriter(session.writer, &session.compressSeq, compression)
 	return nil
 }
 
 //Handle client request after client accept
 func (session *Session) Handle() (err error) {
-	//server := session.server
+	session.resetSeq()
+	packet, err := session.readPacket()
+	if err == mysql.ErrPacketTooLarge {
+		session.writeError(mysql.NewError(mysql.ErrNetPacketTooLarge))
+		return err
+	} else if err != nil {
+		return err
+	}
+	defer session.releasePacket(packet)
+	command, err := packet.Body.ReadByte()
+	if err != nil {
+		return fmt.Errorf("Empty command packet")
+	}
+	if session.forwarded() {
+		err = session.forward(command, packet)
+	} else {
+		err = session.dispatch(command, packet)
+	}
+	var sqlErr *mysql.Error
+	if errors.As(err, &sqlErr) {
+		//the client gets the error, the session goes on
+		return session.writeError(sqlErr)
+	}
+	return err
+}
 
-	//read packet
-	//packetIn, err := session.readPacket()
-	//write response
+//dispatch runs the command, a returned mysql.Error is sent to the client
+func (session *Session) dispatch(command byte, packet *mysql.Packet) (err error) {
+	switch command {
+	case mysql.ComQuit:
+		return io.EOF
+	case mysql.ComPing:
+		return session.writeOK()
+	case mysql.ComInitDB:
+		session.db = packet.Body.String()
+		return session.writeOK()
+	case mysql.ComSTMTPrepare:
+		return session.stmtPrepare(packet.Body.String())
+	case mysql.ComSTMTExecute:
+		return session.stmtExecute(packet.Body)
+	case mysql.ComSTMTFetch:
+		return session.stmtFetch(packet.Body)
+	case mysql.ComSTMTSendLongData:
+		session.stmtSendLongData(packet.Body)
+		return nil
+	case mysql.ComSTMTReset:
+		return session.stmtReset(packet.Body)
+	case mysql.ComSTMTClose:
+		session.stmtClose(packet.Body)
+		return nil
+	default:
+		return mysql.NewError(mysql.ErrUnknownComError)
+	}
+}
 
-	return nil
+//writeOK sends an OK packet with the session status
+func (session *Session) writeOK() error {
+	return session.writePacket(mysql.NewOKPacket(&mysql.OKPacket{Status: session.status}, session.capability))
+}
+
+//writeError sends a mysql.Error as an ERR packet for the client capabilities, other errors are returned
+func (session *Session) writeError(err error) error {
+	var sqlErr *mysql.Error
+	if !errors.As(err, &sqlErr) {
+		return err
+	}
+	return session.writePacket(mysql.NewERRPacket(sqlErr.ERRPacket(), session.capability))
 }
 
 //Close closes session related resources
 func (session *Session) Close() error {
-	//TODO release resources
+	for _, stmt := range session.statements {
+		session.closeStatement(stmt)
+	}
+	session.releaseBackend()
 	return nil
 }
 
-func isAuthMethodSupported(authMethod string) bool {
-	return authMethod == mysql.AuthNativePassword ||
-		authMethod == mysql.AuthCachingSHA2Password ||
-		authMethod == mysql.AuthSHA2Password
+//Identity returns the authenticated identity
+func (session *Session) Identity() *Identity {
+	return session.identity
 }
 
-func (session *Session) writeInitialHandShakePacket() (err error) {
-	buffer := session.bufferPool.Get()
-	defer session.bufferPool.Return(buffer)
+//DB returns the current schema
+func (session *Session) DB() string {
+	return session.db
+}
 
+//authenticate resolves the client credentials with the server authenticator
+func (session *Session) authenticate() (err error) {
 	server := session.server
-	//proto version
-	mysql.WriteBytes(buffer, server.protocolVersion)
-	//server version
-	mysql.WriteNullTerminatedString(buffer, server.serverVersion)
-	//conn id
-	mysql.WriteInt4(buffer, session.sessionID)
-	//salt
-	mysql.Write(buffer, session.salt[:8])
-	mysql.WriteBytes(buffer, 0)
-	//server caps
-
-	//server default collation
-	mysql.WriteBytes(buffer, server.collationID)
-	//status flags
-
-	//server caps 2
-
-	//if
-	mysql.WriteBytes(buffer, 0, 0, 0, 0, 0, 0)
-	//if
-
-	//if
-
-	packet := mysql.NewPacket(func(p *mysql.Packet) {
-		p.Body = buffer
-	})
-	return session.writePacket(packet)
+	resp := session.handshakeResponse
+	ok, err := session.switchAuthMethod(server.getAuthMethod(resp.User))
+	if err != nil {
+		return err
+	} else if !ok {
+		return session.accessDenied()
+	}
+	request := &AuthRequest{
+		Response:   resp,
+		AuthMethod: session.authMethod(),
+		Salt:       session.salt,
+		TLS:        session.tlsState(),
+		RemoteAddr: session.conn.RemoteAddr(),
+	}
+	var identity *Identity
+	switch request.AuthMethod {
+	case mysql.AuthCachingSHA2Password:
+		identity, err = session.authCachingSHA2Password(request)
+	case mysql.AuthSHA2Password:
+		identity, err = session.authSHA256Password(request)
+	default:
+		identity = session.checkCredentials(request)
+	}
+	if err != nil {
+		return err
+	} else if identity == nil {
+		return session.accessDenied()
+	}
+	session.identity = identity
+	return session.writeOK()
 }
 
-func (session *Session) readClientHandShakePacket() (useSSL bool, err error) {
-	packet, err := session.readSimplePacket(session.reader)
+//checkCredentials calls the authenticator, nil identity if access is denied
+func (session *Session) checkCredentials(request *AuthRequest) *Identity {
+	identity, err := session.server.authenticator.Authenticate(request)
 	if err != nil {
-		return false, err
-	}
-	//check SSL req
-	len := packet.Len()
-	useSSL = len == 32 || len == 5
-	server := session.server
-	if useSSL {
-		if server.capability&mysql.ClientSSL == 0 {
-			return false, fmt.Errorf("SSL not supported by server")
+		if err != ErrAccessDenied {
+			log.Printf("Error authenticating user %s: %v", request.Response.User, err)
 		}
+		return nil
 	}
-	if len == 5 && server.capability&mysql.ClientProtocol41 != 0 {
-		//protocol41
-		capability, err := mysql.ReadInt2(packet.Body)
-		if err != nil {
-			return false, err
-		}
-		session.capability = uint32(capability)
-		maxPacketSize, err := mysql.ReadInt3(packet.Body)
-		if err != nil {
-			return false, err
-		}
-		session.maxPacketSize = maxPacketSize
+	return identity
+}
+
+//authMethod returns the auth plugin the client answered with
+func (session *Session) authMethod() string {
+	resp := session.handshakeResponse
+	if resp.Capability&mysql.ClientPluginAuth == 0 || resp.AuthPlugin == "" {
+		return session.server.defaultAuthMethod
+	}
+	return resp.AuthPlugin
+}
+
+//switchAuthMethod sends an AuthSwitchRequest with a fresh salt if the client answered with
+//another auth method, ok is false if the client can not switch
+func (session *Session) switchAuthMethod(authMethod string) (ok bool, err error) {
+	if session.authMethod() == authMethod {
 		return true, nil
-	} else if len < 32 {
-		return false, fmt.Errorf("Wrong client handshake packet lenght")
 	}
-	capability, err := mysql.ReadInt4(packet.Body)
+	resp := session.handshakeResponse
+	if resp.Capability&mysql.ClientPluginAuth == 0 {
+		return false, nil
+	}
+	salt, err := util.RandomBuffer(session.rand, len(session.salt))
 	if err != nil {
 		return false, err
 	}
-	session.capability = capability
-	maxPacketSize, err := mysql.ReadInt4(packet.Body)
+	buffer := session.bufferPool.Get()
+	defer session.bufferPool.Return(buffer)
+	mysql.WriteBytes(buffer, mysql.AuthSwitchHeader)
+	mysql.WriteNullTerminatedString(buffer, authMethod)
+	mysql.Write(buffer, salt)
+	mysql.WriteBytes(buffer, 0)
+	packet := mysql.NewPacket(func(p *mysql.Packet) {
+		p.Body = buffer
+	})
+	err = session.writePacket(packet)
 	if err != nil {
 		return false, err
 	}
-	session.maxPacketSize = maxPacketSize
-	collation, err := packet.Body.ReadByte()
+	packet, err = session.readPacket()
 	if err != nil {
 		return false, err
 	}
-	session.collation = collation
-	packet.Body.Next(19) //reserved
-	var clientCapsExtra uint32
-	if session.server.capability&mysql.ClientProtocol41 != 0 {
-		clientCapsExtra, err = mysql.ReadInt4(packet.Body)
-		if err != nil {
-			return false, err
+	defer session.releasePacket(packet)
+	session.salt = salt
+	resp.AuthPlugin = authMethod
+	resp.AuthResponse = append([]byte{}, packet.Body.Bytes()...)
+	return true, nil
+}
+
+//authCachingSHA2Password performs fast auth on a cache hit still valid for the authenticator, full auth otherwise
+func (session *Session) authCachingSHA2Password(request *AuthRequest) (identity *Identity, err error) {
+	cache := session.server.cacheShaPassword
+	auth := request.Response.AuthResponse
+	if len(auth) == 0 {
+		//empty password
+		request.HasPassword = true
+		return session.checkCredentials(request), nil
+	}
+	key := session.cacheKey()
+	authenticator := session.server.authenticator
+	if entry, found := cache.Load(key); found {
+		cached := entry.(*cachedPassword)
+		if mysql.CheckSHA256Password(request.Salt, auth, cached.hash) {
+			if revalidate(authenticator, request, cached.identity) {
+				return cached.identity, session.writeAuthMoreData([]byte{mysql.CacheSHA2FastAuth})
+			}
+			cache.Delete(key)
 		}
-		//TODO
-		clientCapsExtra++
-	} else {
-		clientCapsExtra = 0
 	}
-	if len > 32 {
-		//not a ssl req, nrmal handshake
-
+	err = session.writeAuthMoreData([]byte{mysql.CacheSHA2FullAuth})
+	if err != nil {
+		return nil, err
 	}
-	return useSSL, nil
+	packet, err := session.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer session.releasePacket(packet)
+	password, ok, err := session.readPassword(packet.Body.Bytes(), mysql.CacheSHA2RequestPublicKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	request.Password = password
+	request.HasPassword = true
+	identity = session.checkCredentials(request)
+	if identity != nil && cachesIdentities(authenticator) {
+		cache.Store(key, &cachedPassword{mysql.SHA256PasswordHash(password), identity})
+	}
+	return identity, nil
 }
 
-func (session *Session) readPacket() (packets []mysql.Packet, err error) {
-
-	return nil, nil
+//authSHA256Password checks the clear text password over TLS or the RSA encrypted one
+func (session *Session) authSHA256Password(request *AuthRequest) (identity *Identity, err error) {
+	auth := request.Response.AuthResponse
+	request.HasPassword = true
+	if len(auth) == 0 || (len(auth) == 1 && auth[0] == 0) {
+		//empty password
+		return session.checkCredentials(request), nil
+	}
+	password, ok, err := session.readPassword(auth, mysql.SHA256RequestPublicKey)
+	if err != nil || !ok {
+		return nil, err
+	}
+	request.Password = password
+	return session.checkCredentials(request), nil
 }
 
-func (session *Session) writePacket(p *mysql.Packet) (err error) {
-	const max = mysql.MaxPayloadLen
-	var header [4]byte
-
-	writer := session.writer
-	body := p.Body.Bytes()
-	len := len(body)
-
-	for len >= max {
-		header[0] = byte(0xff)
-		header[1] = byte(0xff)
-		header[2] = byte(0xff)
-		header[3] = byte(session.seq)
-		err = write(writer, header[:])
+//readPassword returns the password of an auth response, in clear text over TLS or RSA encrypted otherwise,
+//sending the public key first if the client asks for it. ok is false if the password can not be decrypted
+func (session *Session) readPassword(auth []byte, requestPublicKey byte) (password string, ok bool, err error) {
+	if session.isSecure() {
+		password, err = mysql.ReadNullTerminatedString(bytes.NewBuffer(auth))
+		return password, err == nil, err
+	}
+	if len(auth) == 1 && auth[0] == requestPublicKey {
+		err = session.writeAuthMoreData(session.server.pubKey)
 		if err != nil {
-			return err
+			return "", false, err
 		}
-		err = write(writer, body[:max])
+		packet, err := session.readPacket()
 		if err != nil {
-			return err
+			return "", false, err
 		}
-		session.seq++
-		len -= max
-		body = body[max:]
-	}
-	header[0] = byte(len)
-	header[1] = byte(len >> 8)
-	header[2] = byte(len >> 16)
-	header[3] = byte(session.seq)
-	err = write(writer, header[:])
+		defer session.releasePacket(packet)
+		auth = packet.Body.Bytes()
+	}
+	password, err = mysql.DecryptPassword(session.salt, auth, session.server.privKey)
 	if err != nil {
-		return err
+		return "", false, nil
 	}
-	return write(writer, body)
+	return password, true, nil
 }
 
-func write(writer io.Writer, buff []byte) (err error) {
-	n, err := writer.Write(buff)
-	if err != nil {
-		return err
-	} else if n != len(buff) {
-		return fmt.Errorf("Write failed. only %v bytes written while %v expected", n, len(buff))
+//writeAuthMoreData sends an AuthMoreData packet
+func (session *Session) writeAuthMoreData(data []byte) (err error) {
+	buffer := session.bufferPool.Get()
+	defer session.bufferPool.Return(buffer)
+	mysql.WriteBytes(buffer, mysql.MoreDataHeader)
+	mysql.Write(buffer, data)
+	packet := mysql.NewPacket(func(p *mysql.Packet) {
+		p.Body = buffer
+	})
+	return session.writePacket(packet)
+}
+
+//isSecure checks if the client connection is over TLS
+func (session *Session) isSecure() bool {
+	_, ok := session.conn.(*tls.Conn)
+	return ok
+}
+
+//tlsState of the client connection, nil without TLS
+func (session *Session) tlsState() *tls.ConnectionState {
+	tlsConn, ok := session.conn.(*tls.Conn)
+	if !ok {
+		return nil
 	}
-	return nil
+	state := tlsConn.ConnectionState()
+	return &state
 }
 
-func (session *Session) resetSeq() {
-	session.seq = 0
+//cacheKey of the session for the caching_sha2_password cache, 'user@host'
+func (session *Session) cacheKey() string {
+	host, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+	return session.handshakeResponse.User + "@" + host
 }
 
-//readSimplePacket reads a packet
-func (session *Session) readSimplePacket(reader io.Reader) (packet *mysql.Packet, err error) {
-	var n int
-	var header [4]byte
-	n, err = reader.Read(header[:])
+//accessDenied returns ERR 1045 for the client
+func (session *Session) accessDenied() error {
+	resp := session.handshakeResponse
+	usingPassword := "NO"
+	if len(resp.AuthResponse) > 0 {
+		usingPassword = "YES"
+	}
+	host, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+	return mysql.NewError(mysql.ErrAccessDeniedError, resp.User, host, usingPassword)
+}
+
+func (session *Session) writeInitialHandShakePacket() (err error) {
+	buffer := session.bufferPool.Get()
+	defer session.bufferPool.Return(buffer)
+
+	server := session.server
+	handshake := &mysql.Handshake{
+		ProtocolVersion: server.protocolVersion,
+		ServerVersion:   server.serverVersion,
+		ConnectionID:    session.sessionID,
+		Salt:            session.salt,
+		Capability:      server.capability,
+		Collation:       server.collationID,
+		Status:          mysql.ServerStatusAutocommit,
+		AuthPlugin:      server.defaultAuthMethod,
+	}
+	handshake.Write(buffer)
+	return session.writeBuffer(buffer)
+}
+
+func (session *Session) readClientHandShakePacket() (useSSL bool, err error) {
+	packet, err := session.readPacket()
 	if err != nil {
-		return nil, err
-	} else if n != 4 {
-		return nil, fmt.Errorf("Wrong byte number read %d", n)
+		return false, err
 	}
-	var len int = int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
-	var seq byte = header[3]
-	if seq != session.seq {
-		return nil, fmt.Errorf("invalid sequence %d != %d", seq, session.seq)
+	defer session.releasePacket(packet)
+	//check SSL req
+	useSSL = mysql.IsSSLRequest(packet.Len())
+	server := session.server
+	if useSSL && server.capability&mysql.ClientSSL == 0 {
+		return false, fmt.Errorf("SSL not supported by server")
 	}
-	session.seq++
-	buff := make([]byte, len)
-	n, err = reader.Read(buff)
+	resp, err := mysql.ReadHandshakeResponse(packet.Body)
 	if err != nil {
-		return nil, err
-	} else if n != len {
-		return nil, fmt.Errorf("Read failed. only %d bytes read while %d expected", n, len)
+		return false, err
 	}
-	packet = mysql.NewPacket(func(p *mysql.Packet) {
-		p.Body = bytes.NewBuffer(buff)
-	})
-	return packet, nil
+	if resp.Capability&mysql.ClientProtocol41 == 0 && server.capability&mysql.ClientProtocol41 != 0 && !useSSL {
+		return false, fmt.Errorf("Protocol 320 not supported")
+	}
+	session.capability = resp.Capability & server.capability
+	//the client may lower the limit of the server, 0 is unlimited for it
+	session.maxPacketSize = server.maxPacketSize
+	if resp.MaxPacketSize > 0 && resp.MaxPacketSize < server.maxPacketSize {
+		session.maxPacketSize = resp.MaxPacketSize
+	}
+	session.collation = resp.Collation
+	if !useSSL {
+		session.handshakeResponse = resp
+		session.db = resp.Database
+	}
+	return useSSL, nil
+}
+
+func (session *Session) writePacket(p *mysql.Packet) (err error) {
+	return mysql.WritePacket(session.writer, &session.seq, p)
+}
+
+//writeBuffer sends the buffer as a packet
+func (session *Session) writeBuffer(buffer *bytes.Buffer) (err error) {
+	return session.writePacket(mysql.NewPacket(func(p *mysql.Packet) {
+		p.Body = buffer
+	}))
+}
+
+func (session *Session) resetSeq() {
+	session.seq = 0
+	session.compressSeq = 0
+}
+
+//readPacket reads a packet with a pooled body, release it with releasePacket
+func (session *Session) readPacket() (packet *mysql.Packet, err error) {
+	return mysql.ReadPacket(session.reader, &session.seq, int(session.maxPacketSize), session.bufferPool)
+}
+
+//releasePacket returns the packet body to the pool
+func (session *Session) releasePacket(packet *mysql.Packet) {
+	session.bufferPool.Return(packet.Body)
+}
+
+//bufferedConn reads through a buffered reader, keeping the bytes already buffered
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (n int, err error) {
+	return conn.reader.Read(b)
 }
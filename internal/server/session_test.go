@@ -0,0 +1,689 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	config "github.com/rafalopez79/godriver/internal/config"
+	util "github.com/rafalopez79/godriver/internal/util"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+var testConnections = []config.Connection{
+	{ID: "test1", User: "user1", Password: "password1"},
+	{ID: "test2", User: "user2", Password: "*" + strings.ToUpper(hex.EncodeToString(mysql.NativePasswordHash("password2")))},
+	{ID: "test3", User: "user3", Password: ""},
+	{ID: "test4", User: "user4", Password: "password4", AuthPlugin: mysql.AuthCachingSHA2Password},
+	{ID: "test5", User: "user5", Password: "*" + strings.ToUpper(hex.EncodeToString(mysql.NativePasswordHash("password5"))), AuthPlugin: mysql.AuthSHA2Password},
+}
+
+func newTestServer(t *testing.T) *Server {
+	s, err := NewServer("5.5.5-test", mysql.AuthNativePassword, testConnections)
+	assert.NilError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func readTestPacket(t *testing.T, r io.Reader) (seq byte, body []byte) {
+	var header [4]byte
+	_, err := io.ReadFull(r, header[:])
+	assert.NilError(t, err)
+	l := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	body = make([]byte, l)
+	_, err = io.ReadFull(r, body)
+	assert.NilError(t, err)
+	return header[3], body
+}
+
+func TestInitialHandShakePacket(t *testing.T) {
+	server := newTestServer(t)
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	session := NewSession(42, server, serverConn)
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- session.writeInitialHandShakePacket()
+	}()
+	seq, body := readTestPacket(t, clientConn)
+	assert.NilError(t, <-ch)
+	assert.Equal(t, seq, byte(0))
+	assert.Equal(t, session.seq, byte(1))
+
+	buff := bytes.NewBuffer(body)
+	proto, _ := buff.ReadByte()
+	assert.Equal(t, proto, mysql.MinProtocolVersion)
+	version, err := buff.ReadString(0)
+	assert.NilError(t, err)
+	assert.Equal(t, version, "5.5.5-test\x00")
+	connID, _ := mysql.ReadInt4(buff)
+	assert.Equal(t, connID, uint32(42))
+	salt1 := buff.Next(8)
+	assert.DeepEqual(t, salt1, session.salt[:8])
+	filler, _ := buff.ReadByte()
+	assert.Equal(t, filler, byte(0))
+	capLow, _ := mysql.ReadInt2(buff)
+	collation, _ := buff.ReadByte()
+	assert.Equal(t, collation, mysql.DefaultCollationID)
+	status, _ := mysql.ReadInt2(buff)
+	assert.Equal(t, status, mysql.ServerStatusAutocommit)
+	capHigh, _ := mysql.ReadInt2(buff)
+	assert.Equal(t, uint32(capLow)|uint32(capHigh)<<16, server.capability)
+	saltLen, _ := buff.ReadByte()
+	assert.Equal(t, saltLen, byte(21))
+	assert.DeepEqual(t, buff.Next(10), make([]byte, 10))
+	salt2 := buff.Next(int(saltLen) - 8)
+	assert.DeepEqual(t, salt2[:12], session.salt[8:])
+	assert.Equal(t, salt2[12], byte(0))
+	plugin, err := buff.ReadString(0)
+	assert.NilError(t, err)
+	assert.Equal(t, plugin, mysql.AuthNativePassword+"\x00")
+	assert.Equal(t, buff.Len(), 0)
+}
+
+func writeTestPacket(t *testing.T, w io.Writer, seq byte, body []byte) {
+	header := []byte{byte(len(body)), byte(len(body) >> 8), byte(len(body) >> 16), seq}
+	_, err := w.Write(append(header, body...))
+	assert.NilError(t, err)
+}
+
+func TestReadClientHandShakePacket(t *testing.T) {
+	server := newTestServer(t)
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	session := NewSession(1, server, serverConn)
+	session.seq = 1
+
+	resp := &mysql.HandshakeResponse{
+		Capability:    mysql.ClientProtocol41 | mysql.ClientSecureConnection | mysql.ClientPluginAuth | mysql.ClientConnectWithDB | mysql.ClientMultiStatements,
+		MaxPacketSize: 1 << 24,
+		Collation:     mysql.DefaultCollationID,
+		User:          "user1",
+		AuthResponse:  make([]byte, 20),
+		Database:      "db1",
+		AuthPlugin:    mysql.AuthNativePassword,
+	}
+	buff := new(bytes.Buffer)
+	assert.NilError(t, resp.Write(buff))
+	go writeTestPacket(t, clientConn, 1, buff.Bytes())
+
+	useSSL, err := session.readClientHandShakePacket()
+	assert.NilError(t, err)
+	assert.Assert(t, !useSSL)
+	assert.DeepEqual(t, session.handshakeResponse, resp)
+	assert.Equal(t, session.db, "db1")
+	assert.Equal(t, session.capability, resp.Capability&server.capability)
+	assert.Equal(t, session.maxPacketSize, uint32(1<<24))
+}
+
+//testClient is the client side of a session over a pipe
+type testClient struct {
+	t          *testing.T
+	conn       net.Conn
+	seq        byte
+	salt       []byte
+	plugin     string
+	session    *Session
+	capability uint32     // handshake response capability
+	maxPacket  uint32     // handshake response max packet size
+	result     chan error // AcceptClient result
+	handled    chan error // Handle result ending the command phase
+}
+
+//startTestClient starts a session accepting the client and reads the initial handshake
+func startTestClient(t *testing.T, server *Server) *testClient {
+	serverConn, clientConn := net.Pipe()
+	session := NewSession(1, server, serverConn)
+	client := &testClient{t: t, conn: clientConn, session: session, result: make(chan error, 1), handled: make(chan error, 1),
+		capability: mysql.ClientProtocol41 | mysql.ClientSecureConnection | mysql.ClientPluginAuth | mysql.ClientPluginAuthLENENCClientData,
+		maxPacket:  1 << 24}
+	go func() {
+		defer serverConn.Close()
+		err := session.AcceptClient()
+		client.result <- err
+		for err == nil {
+			err = session.Handle()
+		}
+		client.handled <- err
+	}()
+	body := client.readPacket()
+	buff := bytes.NewBuffer(body)
+	buff.ReadByte()
+	buff.ReadString(0)
+	buff.Next(4)
+	client.salt = append([]byte{}, buff.Next(8)...)
+	buff.Next(1 + 2 + 1 + 2 + 2 + 1 + 10)
+	client.salt = append(client.salt, buff.Next(12)...)
+	buff.ReadByte()
+	client.plugin, _ = mysql.ReadNullTerminatedString(buff)
+	return client
+}
+
+func (client *testClient) readPacket() []byte {
+	seq, body := readTestPacket(client.t, client.conn)
+	assert.Equal(client.t, seq, client.seq)
+	client.seq++
+	return body
+}
+
+func (client *testClient) writePacket(body []byte) {
+	writeTestPacket(client.t, client.conn, client.seq, body)
+	client.seq++
+}
+
+//startTLS sends an SSLRequest and switches the client to TLS
+func (client *testClient) startTLS() {
+	resp := &mysql.HandshakeResponse{
+		Capability:    mysql.ClientProtocol41 | mysql.ClientSecureConnection | mysql.ClientPluginAuth | mysql.ClientSSL,
+		MaxPacketSize: 1 << 24,
+		Collation:     mysql.DefaultCollationID,
+	}
+	buff := new(bytes.Buffer)
+	assert.NilError(client.t, resp.Write(buff))
+	client.writePacket(buff.Bytes()[:mysql.SSLRequestLen])
+	tlsConn := tls.Client(client.conn, &tls.Config{InsecureSkipVerify: true})
+	assert.NilError(client.t, tlsConn.Handshake())
+	client.conn = tlsConn
+}
+
+//sendHandshakeResponse sends the HandshakeResponse41
+func (client *testClient) sendHandshakeResponse(user string, plugin string, auth []byte) {
+	resp := &mysql.HandshakeResponse{
+		Capability:    client.capability,
+		MaxPacketSize: client.maxPacket,
+		Collation:     mysql.DefaultCollationID,
+		User:          user,
+		AuthResponse:  auth,
+		AuthPlugin:    plugin,
+	}
+	buff := new(bytes.Buffer)
+	assert.NilError(client.t, resp.Write(buff))
+	client.writePacket(buff.Bytes())
+}
+
+//command sends a command packet and returns the first answer packet
+func (client *testClient) command(command byte, data []byte) []byte {
+	client.seq = 0
+	client.writePacket(append([]byte{command}, data...))
+	return client.readPacket()
+}
+
+func (client *testClient) close() error {
+	client.conn.Close()
+	return <-client.result
+}
+
+//connectTestClient performs the client side of the handshake and returns the server answer
+func connectTestClient(t *testing.T, server *Server, user, password string) (session *Session, answer []byte, err error) {
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse(user, mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, password))
+	answer = client.readPacket()
+	return client.session, answer, client.close()
+}
+
+func assertAccessDenied(t *testing.T, answer []byte) {
+	assert.Equal(t, answer[0], mysql.ERRHeader)
+	assert.Equal(t, uint16(answer[1])|uint16(answer[2])<<8, mysql.ErrAccessDeniedError)
+	assert.Equal(t, string(answer[3:9]), "#28000")
+}
+
+func TestNativePasswordAuth(t *testing.T) {
+	server := newTestServer(t)
+	for user, password := range map[string]string{"user1": "password1", "user2": "password2", "user3": ""} {
+		session, answer, err := connectTestClient(t, server, user, password)
+		assert.NilError(t, err)
+		assert.Equal(t, answer[0], mysql.OKHeader)
+		assert.Equal(t, session.identity.User, user)
+	}
+}
+
+func TestNativePasswordAccessDenied(t *testing.T) {
+	server := newTestServer(t)
+	for user, password := range map[string]string{"user1": "wrong", "user2": "", "user3": "x", "nobody": "password1"} {
+		session, answer, err := connectTestClient(t, server, user, password)
+		assert.ErrorContains(t, err, "Access denied for user '"+user+"'")
+		assertAccessDenied(t, answer)
+		assert.Assert(t, session.identity == nil)
+	}
+}
+
+func TestCachingSHA2PasswordFullAndFastAuth(t *testing.T) {
+	server := newTestServer(t)
+	//full auth, requesting the public key
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user4", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, "password4"))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte{mysql.CacheSHA2RequestPublicKey})
+	keyPacket := client.readPacket()
+	assert.Equal(t, keyPacket[0], mysql.MoreDataHeader)
+	assert.DeepEqual(t, keyPacket[1:], server.pubKey)
+	pubKey, err := mysql.ParsePublicKey(keyPacket[1:])
+	assert.NilError(t, err)
+	cipher, err := mysql.EncryptPassword(client.salt, "password4", pubKey)
+	assert.NilError(t, err)
+	client.writePacket(cipher)
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+	_, cached := server.cacheShaPassword.Load(client.session.cacheKey())
+	assert.Assert(t, cached)
+
+	//fast auth from the cache
+	client = startTestClient(t, server)
+	client.sendHandshakeResponse("user4", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, "password4"))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FastAuth})
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+}
+
+func TestCachingSHA2PasswordTLS(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("user4", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, "password4"))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte("password4\x00"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+}
+
+func TestCachingSHA2PasswordHashAccessDenied(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.startTLS()
+	hash := "*" + strings.ToUpper(hex.EncodeToString(mysql.NativePasswordHash("password4")))
+	client.sendHandshakeResponse("user4", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, hash))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte(hash + "\x00"))
+	answer := client.readPacket()
+	assertAccessDenied(t, answer)
+	assert.Equal(t, uint16(answer[1])|uint16(answer[2])<<8, mysql.ErrAccessDeniedError)
+	assert.ErrorContains(t, client.close(), "Access denied")
+}
+
+func TestCachingSHA2PasswordAccessDenied(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("user4", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, "wrong"))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte("wrong\x00"))
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+	_, cached := server.cacheShaPassword.Load(client.session.cacheKey())
+	assert.Assert(t, !cached)
+}
+
+func TestSHA256PasswordAuth(t *testing.T) {
+	server := newTestServer(t)
+	//public key request
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, []byte{mysql.SHA256RequestPublicKey})
+	keyPacket := client.readPacket()
+	assert.Equal(t, keyPacket[0], mysql.MoreDataHeader)
+	pubKey, err := mysql.ParsePublicKey(keyPacket[1:])
+	assert.NilError(t, err)
+	cipher, err := mysql.EncryptPassword(client.salt, "password5", pubKey)
+	assert.NilError(t, err)
+	client.writePacket(cipher)
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+
+	//known public key
+	client = startTestClient(t, server)
+	cipher, err = mysql.EncryptPassword(client.salt, "password5", pubKey)
+	assert.NilError(t, err)
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, cipher)
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+
+	//TLS
+	client = startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, []byte("password5\x00"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+}
+
+func TestSHA256PasswordAccessDenied(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	pubKey, err := mysql.ParsePublicKey(server.pubKey)
+	assert.NilError(t, err)
+	cipher, err := mysql.EncryptPassword(client.salt, "wrong", pubKey)
+	assert.NilError(t, err)
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, cipher)
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+
+	client = startTestClient(t, server)
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, []byte("garbage"))
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+
+	//the configured '*HEX' hash is not a password
+	client = startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("user5", mysql.AuthSHA2Password, []byte(testConnections[4].Password+"\x00"))
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+}
+
+func TestAuthSwitch(t *testing.T) {
+	server := newTestServer(t)
+	//native answer switched to caching_sha2_password
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user4", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password4"))
+	switchRequest := bytes.NewBuffer(client.readPacket())
+	header, _ := switchRequest.ReadByte()
+	assert.Equal(t, header, mysql.AuthSwitchHeader)
+	plugin, _ := mysql.ReadNullTerminatedString(switchRequest)
+	assert.Equal(t, plugin, mysql.AuthCachingSHA2Password)
+	salt := switchRequest.Next(20)
+	assert.Assert(t, !bytes.Equal(salt, client.salt))
+	client.writePacket(mysql.ScrambleSHA256Password(salt, "password4"))
+	assert.DeepEqual(t, client.readPacket(), []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte{mysql.CacheSHA2RequestPublicKey})
+	pubKey, err := mysql.ParsePublicKey(client.readPacket()[1:])
+	assert.NilError(t, err)
+	cipher, err := mysql.EncryptPassword(salt, "password4", pubKey)
+	assert.NilError(t, err)
+	client.writePacket(cipher)
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+
+	//caching_sha2_password answer switched to native
+	client = startTestClient(t, server)
+	client.sendHandshakeResponse("user1", mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, "password1"))
+	switchRequest = bytes.NewBuffer(client.readPacket())
+	switchRequest.ReadByte()
+	plugin, _ = mysql.ReadNullTerminatedString(switchRequest)
+	assert.Equal(t, plugin, mysql.AuthNativePassword)
+	client.writePacket(mysql.ScrambleNativePassword(switchRequest.Next(20), "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+}
+
+//testAuthenticator accepts any user with the clear text password "secret"
+type testAuthenticator struct {
+	requests []*AuthRequest
+}
+
+func (authenticator *testAuthenticator) AuthMethod(user string) string {
+	return mysql.AuthSHA2Password
+}
+
+func (authenticator *testAuthenticator) Authenticate(request *AuthRequest) (*Identity, error) {
+	authenticator.requests = append(authenticator.requests, request)
+	if !request.HasPassword || request.Password != "secret" {
+		return nil, ErrAccessDenied
+	}
+	return &Identity{request.Response.User, &testConnections[0]}, nil
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	authenticator := &testAuthenticator{}
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithAuthenticator(authenticator))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+
+	client := startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("anyone", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "secret"))
+	switchRequest := bytes.NewBuffer(client.readPacket())
+	switchRequest.ReadByte()
+	plugin, _ := mysql.ReadNullTerminatedString(switchRequest)
+	assert.Equal(t, plugin, mysql.AuthSHA2Password)
+	client.writePacket([]byte("secret\x00"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+	assert.Equal(t, client.session.identity.User, "anyone")
+	assert.Equal(t, client.session.identity.Connection.ID, "test1")
+
+	request := authenticator.requests[0]
+	assert.Equal(t, request.AuthMethod, mysql.AuthSHA2Password)
+	assert.Assert(t, request.TLS != nil)
+	assert.Assert(t, request.TLS.HandshakeComplete)
+
+	client = startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse("anyone", mysql.AuthSHA2Password, []byte("wrong\x00"))
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+}
+
+//cachingSHA2Authenticator testAuthenticator with caching_sha2_password
+type cachingSHA2Authenticator struct {
+	testAuthenticator
+}
+
+func (authenticator *cachingSHA2Authenticator) AuthMethod(user string) string {
+	return mysql.AuthCachingSHA2Password
+}
+
+//revokingAuthenticator cachingSHA2Authenticator with revocable users, allowing fast auth
+type revokingAuthenticator struct {
+	cachingSHA2Authenticator
+	revoked map[string]bool
+}
+
+func (authenticator *revokingAuthenticator) Authenticate(request *AuthRequest) (*Identity, error) {
+	if authenticator.revoked[request.Response.User] {
+		return nil, ErrAccessDenied
+	}
+	return authenticator.testAuthenticator.Authenticate(request)
+}
+
+func (authenticator *revokingAuthenticator) Revalidate(request *AuthRequest, identity *Identity) bool {
+	return !authenticator.revoked[identity.User]
+}
+
+//connectSHA2Client connects with caching_sha2_password over TLS, returning the auth more data answer
+func connectSHA2Client(t *testing.T, server *Server, user string, password string) (answer []byte, client *testClient) {
+	client = startTestClient(t, server)
+	client.startTLS()
+	client.sendHandshakeResponse(user, mysql.AuthCachingSHA2Password, mysql.ScrambleSHA256Password(client.salt, password))
+	return client.readPacket(), client
+}
+
+func TestCachingSHA2PasswordCustomAuthenticator(t *testing.T) {
+	//identities of authenticators without Revalidate are not cached
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithAuthenticator(&cachingSHA2Authenticator{}))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	for i := 0; i < 2; i++ {
+		answer, client := connectSHA2Client(t, server, "anyone", "secret")
+		assert.DeepEqual(t, answer, []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+		client.writePacket([]byte("secret\x00"))
+		assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+		assert.NilError(t, client.close())
+	}
+
+	authenticator := &revokingAuthenticator{revoked: make(map[string]bool)}
+	server, err = NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithAuthenticator(authenticator))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	answer, client := connectSHA2Client(t, server, "anyone", "secret")
+	assert.DeepEqual(t, answer, []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte("secret\x00"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+	answer, client = connectSHA2Client(t, server, "anyone", "secret")
+	assert.DeepEqual(t, answer, []byte{mysql.MoreDataHeader, mysql.CacheSHA2FastAuth})
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, client.close())
+
+	//a revoked user cannot fast auth with the cached password
+	authenticator.revoked["anyone"] = true
+	answer, client = connectSHA2Client(t, server, "anyone", "secret")
+	assert.DeepEqual(t, answer, []byte{mysql.MoreDataHeader, mysql.CacheSHA2FullAuth})
+	client.writePacket([]byte("secret\x00"))
+	assertAccessDenied(t, client.readPacket())
+	assert.ErrorContains(t, client.close(), "Access denied")
+	_, cached := server.cacheShaPassword.Load(client.session.cacheKey())
+	assert.Assert(t, !cached)
+}
+
+func TestHandleCommands(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+
+	assert.Equal(t, client.command(mysql.ComPing, nil)[0], mysql.OKHeader)
+	assert.Equal(t, client.seq, byte(2))
+	assert.Equal(t, client.command(mysql.ComInitDB, []byte("db2"))[0], mysql.OKHeader)
+	assert.Equal(t, client.session.db, "db2")
+	answer := client.command(mysql.ComDaemon, nil)
+	assert.Equal(t, answer[0], mysql.ERRHeader)
+	assert.Equal(t, uint16(answer[1])|uint16(answer[2])<<8, mysql.ErrUnknownComError)
+	assert.Equal(t, string(answer[3:9]), "#08S01")
+
+	client.seq = 0
+	client.writePacket([]byte{mysql.ComQuit})
+	assert.Equal(t, <-client.handled, io.EOF)
+	assert.NilError(t, client.close())
+}
+
+func TestReadPacketMultiFrame(t *testing.T) {
+	server := newTestServer(t)
+	const max = mysql.MaxPayloadLen
+	for _, size := range []int{0, 1, max - 1, max, max + 1, 2*max + 5} {
+		serverConn, clientConn := net.Pipe()
+		writer := NewSession(1, server, clientConn)
+		reader := NewSession(1, server, serverConn)
+		body := make([]byte, size)
+		for i := range body {
+			body[i] = byte(i)
+		}
+		ch := make(chan error, 1)
+		go func() {
+			ch <- writer.writePacket(mysql.NewPacket(func(p *mysql.Packet) {
+				p.Body = bytes.NewBuffer(body)
+			}))
+		}()
+		packet, err := reader.readPacket()
+		assert.NilError(t, err)
+		assert.NilError(t, <-ch)
+		assert.Equal(t, packet.Len(), size)
+		assert.Assert(t, bytes.Equal(packet.Body.Bytes(), body))
+		assert.Equal(t, reader.seq, writer.seq)
+		assert.Equal(t, int(reader.seq), size/max+1)
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+func TestReadPacketWrongSequence(t *testing.T) {
+	server := newTestServer(t)
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	session := NewSession(1, server, serverConn)
+	go func() {
+		clientConn.Write([]byte{0xff, 0xff, 0xff, 0})
+		clientConn.Write(make([]byte, mysql.MaxPayloadLen))
+		clientConn.Write([]byte{1, 0, 0, 2, 0})
+	}()
+	_, err := session.readPacket()
+	assert.ErrorContains(t, err, "invalid sequence 2 != 1")
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.maxPacket = 1024
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+
+	//the server answers without reading the whole packet
+	conn := client.conn
+	go conn.Write(append([]byte{0x01, 0x04, 0, 0, mysql.ComQuery}, make([]byte, 1024)...))
+	client.seq = 1
+	answer := client.readPacket()
+	assert.Equal(t, answer[0], mysql.ERRHeader)
+	assert.Equal(t, uint16(answer[1])|uint16(answer[2])<<8, mysql.ErrNetPacketTooLarge)
+	assert.Equal(t, <-client.handled, mysql.ErrPacketTooLarge)
+	assert.NilError(t, client.close())
+}
+
+func TestReadPacketTooLargeBeforeAuth(t *testing.T) {
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, testConnections, WithMaxPacketSize(uint32(mysql.MaxPayloadLen)+100))
+	assert.NilError(t, err)
+	defer server.Close()
+
+	//the limit of the server applies to a client announcing none
+	client := startTestClient(t, server)
+	client.maxPacket = 0
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.Equal(t, client.session.maxPacketSize, uint32(mysql.MaxPayloadLen)+100)
+	assert.NilError(t, client.close())
+
+	//a handshake response of two frames is refused before it is parsed
+	client = startTestClient(t, server)
+	conn := client.conn
+	go func() {
+		conn.Write(append([]byte{0xff, 0xff, 0xff, 1}, make([]byte, mysql.MaxPayloadLen)...))
+		conn.Write(append([]byte{200, 0, 0, 2}, make([]byte, 200)...))
+	}()
+	assert.Equal(t, <-client.result, mysql.ErrPacketTooLarge)
+	conn.Close()
+}
+
+func testCompressedSession(t *testing.T, server *Server, capability uint32, compression mysql.Compression) {
+	client := startTestClient(t, server)
+	client.capability |= capability
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assert.NilError(t, <-client.result)
+
+	var seq, compressSeq byte
+	writer := mysql.NewCompressedWriter(client.conn, &compressSeq, compression)
+	reader := mysql.NewCompressedReader(client.conn, &compressSeq, compression)
+	query := append([]byte{mysql.ComInitDB}, bytes.Repeat([]byte("d"), 100)...)
+	assert.NilError(t, mysql.WritePacket(writer, &seq, mysql.NewPacket(func(p *mysql.Packet) {
+		p.Body = bytes.NewBuffer(query)
+	})))
+	packet, err := mysql.ReadPacket(reader, &seq, 0, util.NewBufferPool())
+	assert.NilError(t, err)
+	assert.Equal(t, packet.Body.Bytes()[0], mysql.OKHeader)
+	assert.Equal(t, seq, byte(2))
+	assert.Equal(t, compressSeq, byte(2))
+	assert.Equal(t, client.session.db, strings.Repeat("d", 100))
+	client.conn.Close()
+}
+
+func TestCompressedSession(t *testing.T) {
+	server := newTestServer(t)
+	zlibCompression, err := mysql.NewZlibCompression(zlib.DefaultCompression)
+	assert.NilError(t, err)
+	testCompressedSession(t, server, mysql.ClientCompress, zlibCompression)
+	zstdCompression, err := mysql.NewZstdCompression(mysql.DefaultZstdCompressionLevel)
+	assert.NilError(t, err)
+	testCompressedSession(t, server, mysql.ClientZstdCompressionAlgorithm, zstdCompression)
+	//zstd preferred
+	testCompressedSession(t, server, mysql.ClientCompress|mysql.ClientZstdCompressionAlgorithm, zstdCompression)
+}
+
+func TestCompressionAlgorithms(t *testing.T) {
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithCompression([]string{mysql.CompressionZlib}, 0))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	assert.Assert(t, server.capability&mysql.ClientCompress != 0)
+	assert.Assert(t, server.capability&mysql.ClientZstdCompressionAlgorithm == 0)
+	server, err = NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithCompression([]string{mysql.CompressionUncompressed}, 0))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	assert.Assert(t, server.capability&(mysql.ClientCompress|mysql.ClientZstdCompressionAlgorithm) == 0)
+	_, err = NewServer("5.5.5-test", mysql.AuthNativePassword, nil, WithCompression([]string{"lz4"}, 0))
+	assert.ErrorContains(t, err, "lz4")
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"log"
+
+	mysql "github.com/rafalopez79/godriver/mysql"
+)
+
+//Statement prepared by a session
+type Statement struct {
+	ID      uint32
+	Query   string
+	Params  []*mysql.Field // parameter definitions, set by the handler
+	Columns []*mysql.Field // column definitions, set by the handler
+	Data    interface{}    // handler data
+	//types bound by the last execution
+	paramTypes []uint16
+	//param id -> COM_STMT_SEND_LONG_DATA data
+	longData map[uint16][]byte
+	//a long data param id out of range
+	longDataErr bool
+	//rows pending of COM_STMT_FETCH
+	cursor *cursor
+}
+
+//cursor of a statement executed with CursorTypeReadOnly
+type cursor struct {
+	fields []*mysql.Field
+	rows   [][]interface{}
+}
+
+//Result of an executed statement, a resultset if Fields is set
+type Result struct {
+	Fields       []*mysql.Field
+	Rows         [][]interface{}
+	AffectedRows uint64
+	LastInsertID uint64
+	Warnings     uint16
+}
+
+//StatementHandler prepares and executes the prepared statements of the sessions
+type StatementHandler interface {
+	//Prepare sets the Params and Columns of the statement
+	Prepare(session *Session, stmt *Statement) error
+	//Execute runs the statement with the params, values as decoded by mysql.ReadBinaryValue
+	Execute(session *Session, stmt *Statement, params []interface{}) (*Result, error)
+	//Close releases the statement
+	Close(session *Session, stmt *Statement) error
+}
+
+//WithStatementHandler sets the handler of the prepared statements
+func WithStatementHandler(handler StatementHandler) func(*Server) {
+	return func(server *Server) {
+		server.statementHandler = handler
+	}
+}
+
+//stmtPrepare handles COM_STMT_PREPARE
+func (session *Session) stmtPrepare(query string) (err error) {
+	handler := session.server.statementHandler
+	if handler == nil {
+		return mysql.NewError(mysql.ErrUnsupportedPS)
+	}
+	session.lastStatementID++
+	stmt := &Statement{ID: session.lastStatementID, Query: query}
+	err = handler.Prepare(session, stmt)
+	if err != nil {
+		return err
+	}
+	session.statements[stmt.ID] = stmt
+	buffer := session.bufferPool.Get()
+	defer session.bufferPool.Return(buffer)
+	ok := &mysql.StmtPrepareOK{StatementID: stmt.ID, ColumnCount: uint16(len(stmt.Columns)), ParamCount: uint16(len(stmt.Params))}
+	ok.Write(buffer)
+	err = session.writeBuffer(buffer)
+	if err != nil {
+		return err
+	}
+	err = session.writeFields(stmt.Params)
+	if err != nil {
+		return err
+	}
+	return session.writeFields(stmt.Columns)
+}
+
+//writeFields writes the definitions of a COM_STMT_PREPARE response, followed by EOF
+func (session *Session) writeFields(fields []*mysql.Field) (err error) {
+	if len(fields) == 0 {
+		return nil
+	}
+	buffer := session.bufferPool.Get()
+	defer session.bufferPool.Return(buffer)
+	for _, field := range fields {
+		buffer.Reset()
+		field.Write(buffer)
+		err = session.writeBuffer(buffer)
+		if err != nil {
+			return err
+		}
+	}
+	if session.capability&mysql.ClientDeprecateEOF != 0 {
+		return nil
+	}
+	buffer.Reset()
+	(&mysql.EOFPacket{Status: session.status}).Write(buffer, session.capability)
+	return session.writeBuffer(buffer)
+}
+
+//stmtExecute handles COM_STMT_EXECUTE
+func (session *Session) stmtExecute(body *bytes.Buffer) (err error) {
+	stmt, err := session.lookupStatement(body.Bytes(), "mysqld_stmt_execute")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		stmt.longData = nil
+		stmt.longDataErr = false
+	}()
+	if stmt.longDataErr {
+		return mysql.NewError(mysql.ErrWrongArguments, "mysqld_stmt_send_long_data")
+	}
+	execute, err := mysql.ReadStmtExecute(body, len(stmt.Params), stmt.paramTypes, stmt.longData)
+	if err != nil {
+		return mysql.NewError(mysql.ErrWrongArguments, "mysqld_stmt_execute")
+	}
+	stmt.paramTypes = execute.ParamTypes
+	stmt.cursor = nil
+	result, err := session.server.statementHandler.Execute(session, stmt, execute.Params)
+	if err != nil {
+		return err
+	} else if result == nil {
+		result = &Result{}
+	}
+	if result.Fields == nil {
+		ok := &mysql.OKPacket{
+			AffectedRows: result.AffectedRows,
+			LastInsertID: result.LastInsertID,
+			Status:       session.status,
+			Warnings:     result.Warnings,
+		}
+		return session.writePacket(mysql.NewOKPacket(ok, session.capability))
+	}
+	rs := mysql.NewResultset(session.writer, &session.seq, session.capability, result.Fields)
+	if execute.Flags&mysql.CursorTypeReadOnly != 0 {
+		//rows are sent by COM_STMT_FETCH
+		stmt.cursor = &cursor{result.Fields, result.Rows}
+		status := session.status | mysql.ServerStatusCursorExists
+		err = rs.WriteFields(status)
+		if err != nil || session.capability&mysql.ClientDeprecateEOF == 0 {
+			return err
+		}
+		return rs.WriteEnd(status, result.Warnings)
+	}
+	err = rs.WriteFields(session.status)
+	if err != nil {
+		return err
+	}
+	for _, row := range result.Rows {
+		err = rs.WriteBinaryRow(row...)
+		if err != nil {
+			return err
+		}
+	}
+	return rs.WriteEnd(session.status, result.Warnings)
+}
+
+//stmtFetch handles COM_STMT_FETCH
+func (session *Session) stmtFetch(body *bytes.Buffer) (err error) {
+	stmt, err := session.lookupStatement(body.Bytes(), "mysqld_stmt_fetch")
+	if err != nil {
+		return err
+	}
+	fetch, err := mysql.ReadStmtFetch(body)
+	if err != nil {
+		return mysql.NewError(mysql.ErrMalformedPacket)
+	}
+	cursor := stmt.cursor
+	if cursor == nil {
+		return mysql.NewError(mysql.ErrStmtHasNoOpenCursor, stmt.ID)
+	}
+	rs := mysql.NewResultset(session.writer, &session.seq, session.capability, cursor.fields)
+	n := mysql.Min(int(fetch.NumRows), len(cursor.rows))
+	for _, row := range cursor.rows[:n] {
+		err = rs.WriteBinaryRow(row...)
+		if err != nil {
+			return err
+		}
+	}
+	cursor.rows = cursor.rows[n:]
+	status := session.status | mysql.ServerStatusCursorExists
+	if len(cursor.rows) == 0 {
+		status |= mysql.ServerStatusLastRowSend
+		stmt.cursor = nil
+	}
+	return rs.WriteEnd(status, 0)
+}
+
+//stmtSendLongData handles COM_STMT_SEND_LONG_DATA, errors are reported by the next execution
+func (session *Session) stmtSendLongData(body *bytes.Buffer) {
+	longData, err := mysql.ReadStmtSendLongData(body)
+	if err != nil {
+		return
+	}
+	stmt, ok := session.statements[longData.StatementID]
+	if !ok {
+		return
+	}
+	if int(longData.ParamID) >= len(stmt.Params) {
+		stmt.longDataErr = true
+		return
+	}
+	if stmt.longData == nil {
+		stmt.longData = make(map[uint16][]byte)
+	}
+	stmt.longData[longData.ParamID] = append(stmt.longData[longData.ParamID], longData.Data...)
+}
+
+//stmtReset handles COM_STMT_RESET, clearing the long data and closing the cursor
+func (session *Session) stmtReset(body *bytes.Buffer) (err error) {
+	stmt, err := session.lookupStatement(body.Bytes(), "mysqld_stmt_reset")
+	if err != nil {
+		return err
+	}
+	stmt.longData = nil
+	stmt.longDataErr = false
+	stmt.cursor = nil
+	return session.writeOK()
+}
+
+//stmtClose handles COM_STMT_CLOSE, without response
+func (session *Session) stmtClose(body *bytes.Buffer) {
+	stmt, err := session.lookupStatement(body.Bytes(), "mysqld_stmt_close")
+	if err != nil {
+		return
+	}
+	session.closeStatement(stmt)
+}
+
+//closeStatement releases the statement
+func (session *Session) closeStatement(stmt *Statement) {
+	delete(session.statements, stmt.ID)
+	err := session.server.statementHandler.Close(session, stmt)
+	if err != nil {
+		log.Printf("Error closing statement %d of session %d: %v", stmt.ID, session.sessionID, err)
+	}
+}
+
+//lookupStatement returns the statement of the id starting the body
+func (session *Session) lookupStatement(body []byte, command string) (*Statement, error) {
+	if len(body) < 4 {
+		return nil, mysql.NewError(mysql.ErrMalformedPacket)
+	}
+	id := uint32(body[0]) | uint32(body[1])<<8 | uint32(body[2])<<16 | uint32(body[3])<<24
+	stmt, ok := session.statements[id]
+	if !ok {
+		return nil, mysql.NewError(mysql.ErrUnknownStmtHandler, id, command)
+	}
+	return stmt, nil
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+//testStatementHandler echoes the params of "SELECT ?" in 2 rows
+type testStatementHandler struct {
+	closed []uint32
+}
+
+func (handler *testStatementHandler) Prepare(session *Session, stmt *Statement) error {
+	switch stmt.Query {
+	case "SELECT ?":
+		stmt.Params = []*mysql.Field{mysql.NewField("?", mysql.MYSQLTypeVarString)}
+		stmt.Columns = []*mysql.Field{mysql.NewField("id", mysql.MYSQLTypeLongLong), mysql.NewField("value", mysql.MYSQLTypeVarString)}
+	case "DELETE":
+	default:
+		return mysql.NewError(mysql.ErrParseError, "near '"+stmt.Query+"'")
+	}
+	return nil
+}
+
+func (handler *testStatementHandler) Execute(session *Session, stmt *Statement, params []interface{}) (*Result, error) {
+	if stmt.Query == "DELETE" {
+		return &Result{AffectedRows: 3}, nil
+	}
+	return &Result{
+		Fields: stmt.Columns,
+		Rows:   [][]interface{}{{int64(1), params[0]}, {int64(2), nil}},
+	}, nil
+}
+
+func (handler *testStatementHandler) Close(session *Session, stmt *Statement) error {
+	handler.closed = append(handler.closed, stmt.ID)
+	return nil
+}
+
+func startStatementTestClient(t *testing.T, handler StatementHandler) *testClient {
+	server, err := NewServer("5.5.5-test", mysql.AuthNativePassword, testConnections, WithStatementHandler(handler))
+	assert.NilError(t, err)
+	t.Cleanup(server.Close)
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	return client
+}
+
+//execute sends COM_STMT_EXECUTE and returns the first answer packet
+func (client *testClient) execute(execute *mysql.StmtExecute) []byte {
+	buffer := new(bytes.Buffer)
+	assert.NilError(client.t, execute.Write(buffer))
+	return client.command(buffer.Bytes()[0], buffer.Bytes()[1:])
+}
+
+//readBinaryRows reads binary rows until EOF returning its status
+func (client *testClient) readBinaryRows(fields []*mysql.Field) (rows [][]interface{}, status uint16) {
+	for {
+		body := client.readPacket()
+		if mysql.IsEOFPacket(body, client.capability) {
+			eof, err := mysql.ReadEOFPacket(bytes.NewBuffer(body), client.capability)
+			assert.NilError(client.t, err)
+			return rows, eof.Status
+		}
+		row, err := mysql.ReadBinaryRow(bytes.NewBuffer(body), fields)
+		assert.NilError(client.t, err)
+		rows = append(rows, row)
+	}
+}
+
+//readFields reads count definitions and the EOF
+func (client *testClient) readFields(count int) (fields []*mysql.Field, status uint16) {
+	for i := 0; i < count; i++ {
+		field, err := mysql.ReadField(bytes.NewBuffer(client.readPacket()))
+		assert.NilError(client.t, err)
+		fields = append(fields, field)
+	}
+	eof, err := mysql.ReadEOFPacket(bytes.NewBuffer(client.readPacket()), client.capability)
+	assert.NilError(client.t, err)
+	return fields, eof.Status
+}
+
+func assertError(t *testing.T, answer []byte, code uint16) {
+	e, err := mysql.ReadERRPacket(bytes.NewBuffer(answer), mysql.ClientProtocol41)
+	assert.NilError(t, err)
+	assert.Equal(t, e.Code, code)
+}
+
+func TestPreparedStatement(t *testing.T) {
+	handler := &testStatementHandler{}
+	client := startStatementTestClient(t, handler)
+
+	ok, err := mysql.ReadStmtPrepareOK(bytes.NewBuffer(client.command(mysql.ComSTMTPrepare, []byte("SELECT ?"))))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, ok, &mysql.StmtPrepareOK{StatementID: 1, ColumnCount: 2, ParamCount: 1})
+	params, _ := client.readFields(1)
+	assert.Equal(t, params[0].Type, mysql.MYSQLTypeVarString)
+	columns, _ := client.readFields(2)
+	assert.Equal(t, columns[1].Name, "value")
+
+	answer := client.execute(&mysql.StmtExecute{StatementID: 1, NewParamsBound: true, Params: []interface{}{"abc"}})
+	assert.DeepEqual(t, answer, []byte{2})
+	client.readFields(2)
+	rows, status := client.readBinaryRows(columns)
+	assert.DeepEqual(t, rows, [][]interface{}{{int64(1), []byte("abc")}, {int64(2), nil}})
+	assert.Equal(t, status, mysql.ServerStatusAutocommit)
+
+	//long data with the types bound by the previous execution
+	for _, data := range []string{"long ", "data"} {
+		buffer := new(bytes.Buffer)
+		(&mysql.StmtSendLongData{StatementID: 1, ParamID: 0, Data: []byte(data)}).Write(buffer)
+		client.seq = 0
+		client.writePacket(buffer.Bytes())
+	}
+	answer = client.execute(&mysql.StmtExecute{StatementID: 1, ParamTypes: []uint16{uint16(mysql.MYSQLTypeVarString)}, Params: []interface{}{nil}})
+	assert.DeepEqual(t, answer, []byte{2})
+	client.readFields(2)
+	rows, _ = client.readBinaryRows(columns)
+	assert.DeepEqual(t, rows[0], []interface{}{int64(1), []byte("long data")})
+
+	//long data of an unknown param
+	buffer := new(bytes.Buffer)
+	(&mysql.StmtSendLongData{StatementID: 1, ParamID: 1, Data: []byte("x")}).Write(buffer)
+	client.seq = 0
+	client.writePacket(buffer.Bytes())
+	answer = client.execute(&mysql.StmtExecute{StatementID: 1, NewParamsBound: true, Params: []interface{}{"abc"}})
+	assertError(t, answer, mysql.ErrWrongArguments)
+
+	ok, err = mysql.ReadStmtPrepareOK(bytes.NewBuffer(client.command(mysql.ComSTMTPrepare, []byte("DELETE"))))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, ok, &mysql.StmtPrepareOK{StatementID: 2})
+	okPacket, err := mysql.ReadOKPacket(bytes.NewBuffer(client.execute(&mysql.StmtExecute{StatementID: 2})), mysql.ClientProtocol41)
+	assert.NilError(t, err)
+	assert.Equal(t, okPacket.AffectedRows, uint64(3))
+
+	assertError(t, client.command(mysql.ComSTMTPrepare, []byte("SELEC")), mysql.ErrParseError)
+	assertError(t, client.execute(&mysql.StmtExecute{StatementID: 9}), mysql.ErrUnknownStmtHandler)
+
+	//close without answer
+	client.seq = 0
+	client.writePacket([]byte{mysql.ComSTMTClose, 2, 0, 0, 0})
+	assert.Equal(t, client.command(mysql.ComPing, nil)[0], mysql.OKHeader)
+	assert.DeepEqual(t, handler.closed, []uint32{2})
+	assertError(t, client.execute(&mysql.StmtExecute{StatementID: 2}), mysql.ErrUnknownStmtHandler)
+
+	client.seq = 0
+	client.writePacket([]byte{mysql.ComQuit})
+	assert.Equal(t, <-client.handled, io.EOF)
+	assert.NilError(t, client.close())
+	assert.NilError(t, client.session.Close())
+	assert.DeepEqual(t, handler.closed, []uint32{2, 1})
+	assert.Equal(t, len(client.session.statements), 0)
+}
+
+func TestPreparedStatementCursor(t *testing.T) {
+	client := startStatementTestClient(t, &testStatementHandler{})
+	client.command(mysql.ComSTMTPrepare, []byte("SELECT ?"))
+	client.readFields(1)
+	columns, _ := client.readFields(2)
+
+	answer := client.execute(&mysql.StmtExecute{StatementID: 1, Flags: mysql.CursorTypeReadOnly, NewParamsBound: true, Params: []interface{}{"abc"}})
+	assert.DeepEqual(t, answer, []byte{2})
+	_, status := client.readFields(2)
+	assert.Equal(t, status, mysql.ServerStatusAutocommit|mysql.ServerStatusCursorExists)
+
+	fetch := func(numRows uint32) []byte {
+		buffer := new(bytes.Buffer)
+		(&mysql.StmtFetch{StatementID: 1, NumRows: numRows}).Write(buffer)
+		client.seq = 0
+		client.writePacket(buffer.Bytes())
+		return client.readPacket()
+	}
+	row, err := mysql.ReadBinaryRow(bytes.NewBuffer(fetch(1)), columns)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, row, []interface{}{int64(1), []byte("abc")})
+	rows, status := client.readBinaryRows(columns)
+	assert.Equal(t, len(rows), 0)
+	assert.Equal(t, status, mysql.ServerStatusAutocommit|mysql.ServerStatusCursorExists)
+
+	row, err = mysql.ReadBinaryRow(bytes.NewBuffer(fetch(10)), columns)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, row, []interface{}{int64(2), nil})
+	_, status = client.readBinaryRows(columns)
+	assert.Equal(t, status, mysql.ServerStatusAutocommit|mysql.ServerStatusCursorExists|mysql.ServerStatusLastRowSend)
+
+	assertError(t, fetch(1), mysql.ErrStmtHasNoOpenCursor)
+
+	//reset closes the cursor
+	client.execute(&mysql.StmtExecute{StatementID: 1, Flags: mysql.CursorTypeReadOnly, Params: []interface{}{"abc"}})
+	client.readFields(2)
+	assert.Equal(t, client.command(mysql.ComSTMTReset, []byte{1, 0, 0, 0})[0], mysql.OKHeader)
+	assertError(t, fetch(1), mysql.ErrStmtHasNoOpenCursor)
+	assertError(t, client.command(mysql.ComSTMTReset, []byte{7, 0, 0, 0}), mysql.ErrUnknownStmtHandler)
+}
+
+func TestPreparedStatementNotSupported(t *testing.T) {
+	server := newTestServer(t)
+	client := startTestClient(t, server)
+	client.sendHandshakeResponse("user1", mysql.AuthNativePassword, mysql.ScrambleNativePassword(client.salt, "password1"))
+	assert.Equal(t, client.readPacket()[0], mysql.OKHeader)
+	assertError(t, client.command(mysql.ComSTMTPrepare, []byte("SELECT 1")), mysql.ErrUnsupportedPS)
+}
@@ -44,6 +44,15 @@ func getPublicKeyFromCert(certPem []byte) (pk []byte, err error) {
 	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubKey}), nil
 }
 
+// extract RSA private key from pem
+func getPrivateKey(keyPem []byte) (key *rsa.PrivateKey, err error) {
+	block, _ := pem.Decode(keyPem)
+	if block == nil {
+		return nil, fmt.Errorf("Error decoding private key")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
 // generate and sign RSA certificates with given CA
 func generateAndSignRSACerts(caPem, caKey []byte) (certPem []byte, keyPem []byte, err error) {
 	// Load CA
@@ -0,0 +1,160 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+//ScrambleNativePassword computes the mysql_native_password auth response
+//SHA1(password) XOR SHA1(salt + SHA1(SHA1(password)))
+func ScrambleNativePassword(salt []byte, password string) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	h := sha1.New()
+	h.Write(salt)
+	h.Write(stage2[:])
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+//NativePasswordHash returns SHA1(SHA1(password)), the password may be plain text
+//or the '*HEX' form stored by mysql. An empty password has an empty hash
+func NativePasswordHash(password string) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	if len(password) == 2*sha1.Size+1 && password[0] == '*' {
+		hash, err := hex.DecodeString(strings.ToLower(password[1:]))
+		if err == nil {
+			return hash
+		}
+	}
+	return PasswordHash(password)
+}
+
+//PasswordHash returns SHA1(SHA1(password)) of a clear text password, '*HEX' is not a hash here
+func PasswordHash(password string) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	stage1 := sha1.Sum([]byte(password))
+	stage2 := sha1.Sum(stage1[:])
+	return stage2[:]
+}
+
+//CheckNativePassword verifies a mysql_native_password auth response against SHA1(SHA1(password))
+func CheckNativePassword(salt []byte, scramble []byte, hash []byte) bool {
+	if len(hash) == 0 {
+		return len(scramble) == 0
+	}
+	if len(scramble) != sha1.Size || len(hash) != sha1.Size {
+		return false
+	}
+	h := sha1.New()
+	h.Write(salt)
+	h.Write(hash)
+	stage1 := h.Sum(nil)
+	for i := range stage1 {
+		stage1[i] ^= scramble[i]
+	}
+	candidate := sha1.Sum(stage1)
+	return subtle.ConstantTimeCompare(candidate[:], hash) == 1
+}
+
+//ScrambleSHA256Password computes the caching_sha2_password auth response
+//SHA256(password) XOR SHA256(SHA256(SHA256(password)) + salt)
+func ScrambleSHA256Password(salt []byte, password string) []byte {
+	if len(password) == 0 {
+		return nil
+	}
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	h := sha256.New()
+	h.Write(stage2[:])
+	h.Write(salt)
+	scramble := h.Sum(nil)
+	for i := range scramble {
+		scramble[i] ^= stage1[i]
+	}
+	return scramble
+}
+
+//SHA256PasswordHash returns SHA256(SHA256(password)), the caching_sha2_password cache entry
+func SHA256PasswordHash(password string) []byte {
+	stage1 := sha256.Sum256([]byte(password))
+	stage2 := sha256.Sum256(stage1[:])
+	return stage2[:]
+}
+
+//CheckSHA256Password verifies a caching_sha2_password auth response against SHA256(SHA256(password))
+func CheckSHA256Password(salt []byte, scramble []byte, hash []byte) bool {
+	if len(scramble) != sha256.Size || len(hash) != sha256.Size {
+		return false
+	}
+	h := sha256.New()
+	h.Write(hash)
+	h.Write(salt)
+	stage1 := h.Sum(nil)
+	for i := range stage1 {
+		stage1[i] ^= scramble[i]
+	}
+	candidate := sha256.Sum256(stage1)
+	return subtle.ConstantTimeCompare(candidate[:], hash) == 1
+}
+
+//EncryptPassword encrypts the NUL terminated password XOR salt with the server public key (RSA-OAEP)
+func EncryptPassword(salt []byte, password string, pubKey *rsa.PublicKey) ([]byte, error) {
+	plain := xorSalt([]byte(password+"\x00"), salt)
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pubKey, plain, nil)
+}
+
+//DecryptPassword decrypts a password encrypted with EncryptPassword
+func DecryptPassword(salt []byte, cipher []byte, privKey *rsa.PrivateKey) (string, error) {
+	plain, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, privKey, cipher, nil)
+	if err != nil {
+		return "", err
+	}
+	plain = xorSalt(plain, salt)
+	return strings.TrimRight(String(plain), "\x00"), nil
+}
+
+//ParsePublicKey parses a PEM encoded RSA public key
+func ParsePublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Not a RSA public key")
+	}
+	return rsaPub, nil
+}
+
+func xorSalt(data []byte, salt []byte) []byte {
+	if len(salt) == 0 {
+		return data
+	}
+	for i := range data {
+		data[i] ^= salt[i%len(salt)]
+	}
+	return data
+}
@@ -0,0 +1,42 @@
+package mysql
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestNativePassword(t *testing.T) {
+	salt := []byte("01234567890123456789")
+	hash := NativePasswordHash("secret")
+	assert.Assert(t, CheckNativePassword(salt, ScrambleNativePassword(salt, "secret"), hash))
+	assert.Assert(t, !CheckNativePassword(salt, ScrambleNativePassword(salt, "other"), hash))
+	assert.Assert(t, !CheckNativePassword(salt, nil, hash))
+	//mysql PASSWORD('secret')
+	assert.DeepEqual(t, NativePasswordHash("*14E65567ABDB5135D0CFD9A70B3032C179A49EE7"), hash)
+	assert.DeepEqual(t, PasswordHash("secret"), hash)
+	assert.Assert(t, len(PasswordHash("*14E65567ABDB5135D0CFD9A70B3032C179A49EE7")) == 20)
+	assert.Assert(t, string(PasswordHash("*14E65567ABDB5135D0CFD9A70B3032C179A49EE7")) != string(hash))
+	assert.Assert(t, CheckNativePassword(salt, nil, NativePasswordHash("")))
+}
+
+func TestSHA256Password(t *testing.T) {
+	salt := []byte("01234567890123456789")
+	hash := SHA256PasswordHash("secret")
+	assert.Assert(t, CheckSHA256Password(salt, ScrambleSHA256Password(salt, "secret"), hash))
+	assert.Assert(t, !CheckSHA256Password(salt, ScrambleSHA256Password(salt, "other"), hash))
+	assert.Assert(t, !CheckSHA256Password(salt, nil, hash))
+}
+
+func TestEncryptPassword(t *testing.T) {
+	salt := []byte("01234567890123456789")
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NilError(t, err)
+	cipher, err := EncryptPassword(salt, "a password longer than the salt", &key.PublicKey)
+	assert.NilError(t, err)
+	password, err := DecryptPassword(salt, cipher, key)
+	assert.NilError(t, err)
+	assert.Equal(t, password, "a password longer than the salt")
+}
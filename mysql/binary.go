@@ -0,0 +1,404 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+//binaryRowNullOffset bits reserved at the start of the NULL bitmap of binary rows
+const binaryRowNullOffset = 2
+
+//NullBitmapLen bytes of a NULL bitmap of n values with the bit offset
+func NullBitmapLen(n int, offset int) int {
+	return (n + offset + 7) / 8
+}
+
+//IsNull checks if the value is sent as NULL
+func IsNull(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case []byte:
+		return v == nil
+	}
+	return false
+}
+
+//WriteBinaryRow writes a binary protocol row, a value per field
+func WriteBinaryRow(buffer *bytes.Buffer, fields []*Field, values []interface{}) (err error) {
+	if len(values) != len(fields) {
+		return fmt.Errorf("Row of %d values for %d fields", len(values), len(fields))
+	}
+	WriteBytes(buffer, OKHeader)
+	bitmap := make([]byte, NullBitmapLen(len(values), binaryRowNullOffset))
+	for i, value := range values {
+		if IsNull(value) {
+			pos := i + binaryRowNullOffset
+			bitmap[pos/8] |= 1 << uint(pos%8)
+		}
+	}
+	buffer.Write(bitmap)
+	for i, value := range values {
+		if IsNull(value) {
+			continue
+		}
+		err = WriteBinaryValue(buffer, fields[i].Type, value)
+		if err != nil {
+			return fmt.Errorf("Field %s: %v", fields[i].Name, err)
+		}
+	}
+	return nil
+}
+
+//ReadBinaryRow reads a binary protocol row, NULL values are nil
+func ReadBinaryRow(buffer *bytes.Buffer, fields []*Field) (values []interface{}, err error) {
+	header, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if header != OKHeader {
+		return nil, fmt.Errorf("Wrong binary row header %x", header)
+	}
+	bitmapLen := NullBitmapLen(len(fields), binaryRowNullOffset)
+	if buffer.Len() < bitmapLen {
+		return nil, fmt.Errorf("Short NULL bitmap")
+	}
+	bitmap := buffer.Next(bitmapLen)
+	values = make([]interface{}, len(fields))
+	for i, field := range fields {
+		pos := i + binaryRowNullOffset
+		if bitmap[pos/8]&(1<<uint(pos%8)) != 0 {
+			continue
+		}
+		values[i], err = ReadBinaryValue(buffer, field.Type, field.Flags&UnsignedFlag != 0)
+		if err != nil {
+			return nil, fmt.Errorf("Field %s: %v", field.Name, err)
+		}
+	}
+	return values, nil
+}
+
+//WriteBinaryValue writes a non NULL value with the binary encoding of the type
+func WriteBinaryValue(buffer *bytes.Buffer, fieldType byte, value interface{}) (err error) {
+	var data [8]byte
+	switch fieldType {
+	case MYSQLTypeTiny:
+		n, err := binaryInt(value)
+		if err != nil {
+			return err
+		}
+		return buffer.WriteByte(byte(n))
+	case MYSQLTypeShort, MYSQLTypeYear:
+		n, err := binaryInt(value)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint16(data[:], uint16(n))
+		_, err = buffer.Write(data[:2])
+		return err
+	case MYSQLTypeLong, MYSQLTypeInt24:
+		n, err := binaryInt(value)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(data[:], uint32(n))
+		_, err = buffer.Write(data[:4])
+		return err
+	case MYSQLTypeLongLong:
+		n, err := binaryInt(value)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(data[:], n)
+		_, err = buffer.Write(data[:8])
+		return err
+	case MYSQLTypeFloat:
+		f, err := binaryFloat(value)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint32(data[:], math.Float32bits(float32(f)))
+		_, err = buffer.Write(data[:4])
+		return err
+	case MYSQLTypeDouble:
+		f, err := binaryFloat(value)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(data[:], math.Float64bits(f))
+		_, err = buffer.Write(data[:8])
+		return err
+	case MYSQLTypeDate, MYSQLTypeNewDate, MYSQLTypeDateTime, MYSQLTypeDateTime2, MYSQLTypeTimestamp, MYSQLTypeTimestamp2:
+		t, ok := value.(time.Time)
+		if !ok {
+			return fmt.Errorf("Value %T is not a time.Time", value)
+		}
+		return writeBinaryTime(buffer, t)
+	case MYSQLTypeTime, MYSQLTypeTime2:
+		d, ok := value.(time.Duration)
+		if !ok {
+			return fmt.Errorf("Value %T is not a time.Duration", value)
+		}
+		return writeBinaryDuration(buffer, d)
+	case MYSQLTypeNull:
+		return nil
+	default:
+		//DECIMAL, strings, blobs, enums, sets, bits, JSON and geometries as length encoded strings
+		return WriteTextValue(buffer, value)
+	}
+}
+
+//ReadBinaryValue reads a non NULL value of the type, integers as int64 or uint64 if unsigned,
+//FLOAT as float32, DOUBLE as float64, dates as time.Time, TIME as time.Duration, others as []byte
+func ReadBinaryValue(buffer *bytes.Buffer, fieldType byte, unsigned bool) (value interface{}, err error) {
+	switch fieldType {
+	case MYSQLTypeTiny:
+		data, err := readBinaryFixed(buffer, 1)
+		if err != nil {
+			return nil, err
+		} else if unsigned {
+			return uint64(data[0]), nil
+		}
+		return int64(int8(data[0])), nil
+	case MYSQLTypeShort, MYSQLTypeYear:
+		data, err := readBinaryFixed(buffer, 2)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint16(data)
+		if unsigned {
+			return uint64(n), nil
+		}
+		return int64(int16(n)), nil
+	case MYSQLTypeLong, MYSQLTypeInt24:
+		data, err := readBinaryFixed(buffer, 4)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if unsigned {
+			return uint64(n), nil
+		}
+		return int64(int32(n)), nil
+	case MYSQLTypeLongLong:
+		data, err := readBinaryFixed(buffer, 8)
+		if err != nil {
+			return nil, err
+		}
+		n := binary.LittleEndian.Uint64(data)
+		if unsigned {
+			return n, nil
+		}
+		return int64(n), nil
+	case MYSQLTypeFloat:
+		data, err := readBinaryFixed(buffer, 4)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(data)), nil
+	case MYSQLTypeDouble:
+		data, err := readBinaryFixed(buffer, 8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case MYSQLTypeDate, MYSQLTypeNewDate, MYSQLTypeDateTime, MYSQLTypeDateTime2, MYSQLTypeTimestamp, MYSQLTypeTimestamp2:
+		return readBinaryTime(buffer)
+	case MYSQLTypeTime, MYSQLTypeTime2:
+		return readBinaryDuration(buffer)
+	case MYSQLTypeNull:
+		return nil, nil
+	default:
+		return ReadRLEBytes(buffer)
+	}
+}
+
+//writeBinaryTime writes a DATE, DATETIME or TIMESTAMP with the shortest length
+func writeBinaryTime(buffer *bytes.Buffer, t time.Time) (err error) {
+	if t.IsZero() {
+		return buffer.WriteByte(0)
+	}
+	year, month, day := t.Date()
+	hour, min, sec := t.Clock()
+	micros := uint32(t.Nanosecond() / 1000)
+	var length byte = 4
+	if micros != 0 {
+		length = 11
+	} else if hour != 0 || min != 0 || sec != 0 {
+		length = 7
+	}
+	WriteBytes(buffer, length)
+	WriteInt2(buffer, uint16(year))
+	WriteBytes(buffer, byte(month), byte(day))
+	if length >= 7 {
+		WriteBytes(buffer, byte(hour), byte(min), byte(sec))
+	}
+	if length == 11 {
+		return WriteInt4(buffer, micros)
+	}
+	return nil
+}
+
+//readBinaryTime reads a DATE, DATETIME or TIMESTAMP in UTC, the zero time for 0000-00-00
+func readBinaryTime(buffer *bytes.Buffer) (t time.Time, err error) {
+	length, err := buffer.ReadByte()
+	if err != nil {
+		return t, err
+	}
+	switch length {
+	case 0:
+		return t, nil
+	case 4, 7, 11:
+	default:
+		return t, fmt.Errorf("Wrong date length %d", length)
+	}
+	data, err := readBinaryFixed(buffer, int(length))
+	if err != nil {
+		return t, err
+	}
+	year := int(binary.LittleEndian.Uint16(data))
+	var hour, min, sec, nsec int
+	if length >= 7 {
+		hour, min, sec = int(data[4]), int(data[5]), int(data[6])
+	}
+	if length == 11 {
+		nsec = int(binary.LittleEndian.Uint32(data[7:])) * 1000
+	}
+	return time.Date(year, time.Month(data[2]), int(data[3]), hour, min, sec, nsec, time.UTC), nil
+}
+
+//writeBinaryDuration writes a TIME with the shortest length
+func writeBinaryDuration(buffer *bytes.Buffer, d time.Duration) (err error) {
+	if d == 0 {
+		return buffer.WriteByte(0)
+	}
+	var negative byte
+	if d < 0 {
+		negative = 1
+		d = -d
+	}
+	days := d / (24 * time.Hour)
+	d -= days * 24 * time.Hour
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	seconds := d / time.Second
+	micros := (d - seconds*time.Second) / time.Microsecond
+	var length byte = 8
+	if micros != 0 {
+		length = 12
+	}
+	WriteBytes(buffer, length, negative)
+	WriteInt4(buffer, uint32(days))
+	WriteBytes(buffer, byte(hours), byte(minutes), byte(seconds))
+	if length == 12 {
+		return WriteInt4(buffer, uint32(micros))
+	}
+	return nil
+}
+
+//readBinaryDuration reads a TIME
+func readBinaryDuration(buffer *bytes.Buffer) (d time.Duration, err error) {
+	length, err := buffer.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 0:
+		return 0, nil
+	case 8, 12:
+	default:
+		return 0, fmt.Errorf("Wrong time length %d", length)
+	}
+	data, err := readBinaryFixed(buffer, int(length))
+	if err != nil {
+		return 0, err
+	}
+	d = time.Duration(binary.LittleEndian.Uint32(data[1:]))*24*time.Hour +
+		time.Duration(data[5])*time.Hour +
+		time.Duration(data[6])*time.Minute +
+		time.Duration(data[7])*time.Second
+	if length == 12 {
+		d += time.Duration(binary.LittleEndian.Uint32(data[8:])) * time.Microsecond
+	}
+	if data[0] == 1 {
+		d = -d
+	}
+	return d, nil
+}
+
+func readBinaryFixed(buffer *bytes.Buffer, n int) ([]byte, error) {
+	if buffer.Len() < n {
+		return nil, fmt.Errorf("Short binary value, %d bytes while %d expected", buffer.Len(), n)
+	}
+	return buffer.Next(n), nil
+}
+
+//binaryInt returns the bits of an integer value
+func binaryInt(value interface{}) (uint64, error) {
+	switch v := value.(type) {
+	case int:
+		return uint64(v), nil
+	case int8:
+		return uint64(v), nil
+	case int16:
+		return uint64(v), nil
+	case int32:
+		return uint64(v), nil
+	case int64:
+		return uint64(v), nil
+	case uint:
+		return uint64(v), nil
+	case uint8:
+		return uint64(v), nil
+	case uint16:
+		return uint64(v), nil
+	case uint32:
+		return uint64(v), nil
+	case uint64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return parseBinaryInt(v)
+	case []byte:
+		return parseBinaryInt(string(v))
+	}
+	return 0, fmt.Errorf("Value %T is not an integer", value)
+}
+
+func parseBinaryInt(s string) (uint64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return uint64(n), nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+//binaryFloat returns the float of a numeric value
+func binaryFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float32:
+		return float64(v), nil
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	case []byte:
+		return strconv.ParseFloat(string(v), 64)
+	}
+	n, err := binaryInt(value)
+	if err != nil {
+		return 0, fmt.Errorf("Value %T is not a number", value)
+	}
+	if _, ok := value.(uint64); ok {
+		return float64(n), nil
+	}
+	return float64(int64(n)), nil
+}
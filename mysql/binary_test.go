@@ -0,0 +1,109 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestBinaryRow(t *testing.T) {
+	unsigned := func(field *Field) *Field {
+		field.Flags |= UnsignedFlag
+		return field
+	}
+	fields := []*Field{
+		NewField("tiny", MYSQLTypeTiny),
+		unsigned(NewField("utiny", MYSQLTypeTiny)),
+		NewField("short", MYSQLTypeShort),
+		NewField("year", MYSQLTypeYear),
+		NewField("long", MYSQLTypeLong),
+		NewField("int24", MYSQLTypeInt24),
+		NewField("longlong", MYSQLTypeLongLong),
+		unsigned(NewField("ulonglong", MYSQLTypeLongLong)),
+		NewField("float", MYSQLTypeFloat),
+		NewField("double", MYSQLTypeDouble),
+		NewField("null", MYSQLTypeVarString),
+		NewField("date", MYSQLTypeDate),
+		NewField("datetime", MYSQLTypeDateTime),
+		NewField("timestamp", MYSQLTypeTimestamp),
+		NewField("zero", MYSQLTypeDateTime),
+		NewField("time", MYSQLTypeTime),
+		NewField("ntime", MYSQLTypeTime),
+		NewField("decimal", MYSQLTypeNewDecimal),
+		NewField("blob", MYSQLTypeBlob),
+		NewField("empty", MYSQLTypeString),
+	}
+	values := []interface{}{
+		int64(-128),
+		uint64(255),
+		int64(-32768),
+		int64(2020),
+		int64(-2147483648),
+		int64(8388607),
+		int64(-9223372036854775808),
+		uint64(18446744073709551615),
+		float32(1.5),
+		3.14159,
+		nil,
+		time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+		time.Date(2020, 2, 29, 23, 59, 58, 0, time.UTC),
+		time.Date(1999, 12, 31, 1, 2, 3, 456789000, time.UTC),
+		time.Time{},
+		50*time.Hour + 3*time.Minute + 4*time.Second,
+		-(time.Minute + time.Microsecond),
+		[]byte("123.45"),
+		[]byte{0, 1, 2, 0xff},
+		[]byte{},
+	}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, WriteBinaryRow(buffer, fields, values))
+	//header and NULL bitmap of 20 fields with offset 2, the field 10 at bit 12
+	assert.DeepEqual(t, buffer.Bytes()[:4], []byte{0x00, 0x00, 0x10, 0x00})
+	decoded, err := ReadBinaryRow(buffer, fields)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, values)
+	assert.Equal(t, buffer.Len(), 0)
+}
+
+func TestWriteBinaryValue(t *testing.T) {
+	for _, tc := range []struct {
+		fieldType byte
+		value     interface{}
+		expected  []byte
+	}{
+		{MYSQLTypeTiny, true, []byte{1}},
+		{MYSQLTypeShort, -2, []byte{0xfe, 0xff}},
+		{MYSQLTypeLong, "258", []byte{2, 1, 0, 0}},
+		{MYSQLTypeLongLong, uint8(1), []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+		{MYSQLTypeDouble, 2, []byte{0, 0, 0, 0, 0, 0, 0, 0x40}},
+		{MYSQLTypeDate, time.Date(2010, 10, 17, 0, 0, 0, 0, time.UTC), []byte{4, 0xda, 0x07, 10, 17}},
+		{MYSQLTypeDateTime, time.Date(2010, 10, 17, 19, 27, 30, 0, time.UTC), []byte{7, 0xda, 0x07, 10, 17, 19, 27, 30}},
+		{MYSQLTypeTimestamp, time.Date(2010, 10, 17, 19, 27, 30, 1000, time.UTC), []byte{11, 0xda, 0x07, 10, 17, 19, 27, 30, 1, 0, 0, 0}},
+		{MYSQLTypeTime, 0 * time.Second, []byte{0}},
+		{MYSQLTypeTime, -(120*time.Hour + 8*time.Hour + 1*time.Second), []byte{8, 1, 5, 0, 0, 0, 8, 0, 1}},
+		{MYSQLTypeTime, 19*time.Hour + 27*time.Minute + 30*time.Second + 1*time.Microsecond, []byte{12, 0, 0, 0, 0, 0, 19, 27, 30, 1, 0, 0, 0}},
+		{MYSQLTypeNewDecimal, "-1.50", []byte{5, '-', '1', '.', '5', '0'}},
+		{MYSQLTypeVarString, 12, []byte{2, '1', '2'}},
+	} {
+		buffer := new(bytes.Buffer)
+		assert.NilError(t, WriteBinaryValue(buffer, tc.fieldType, tc.value))
+		assert.DeepEqual(t, buffer.Bytes(), tc.expected)
+	}
+	assert.ErrorContains(t, WriteBinaryValue(new(bytes.Buffer), MYSQLTypeLong, 1.5), "not an integer")
+	assert.ErrorContains(t, WriteBinaryValue(new(bytes.Buffer), MYSQLTypeDate, "2010-10-17"), "not a time.Time")
+	assert.ErrorContains(t, WriteBinaryValue(new(bytes.Buffer), MYSQLTypeTime, 1), "not a time.Duration")
+}
+
+func TestReadBinaryRowErrors(t *testing.T) {
+	fields := []*Field{NewField("a", MYSQLTypeLong), NewField("b", MYSQLTypeDate)}
+	_, err := ReadBinaryRow(bytes.NewBuffer([]byte{0x01, 0}), fields)
+	assert.ErrorContains(t, err, "Wrong binary row header")
+	_, err = ReadBinaryRow(bytes.NewBuffer([]byte{0x00, 0, 1, 0}), fields)
+	assert.ErrorContains(t, err, "Short binary value")
+	_, err = ReadBinaryRow(bytes.NewBuffer([]byte{0x00, 0, 1, 0, 0, 0, 5}), fields)
+	assert.ErrorContains(t, err, "Wrong date length 5")
+	err = WriteBinaryRow(new(bytes.Buffer), fields, []interface{}{1})
+	assert.ErrorContains(t, err, "Row of 1 values for 2 fields")
+}
@@ -0,0 +1,630 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+)
+
+//requiredCapability always requested by the client connections
+const requiredCapability uint32 = ClientLongPassword | ClientLongFlag | ClientProtocol41 | ClientTransactions |
+	ClientSecureConnection | ClientPluginAuth | ClientPluginAuthLENENCClientData
+
+//clientCapability requested by default
+const clientCapability uint32 = requiredCapability | ClientMultiStatements | ClientMultiResults | ClientPSMultiResults
+
+//Conn client connection to a MySQL server
+type Conn struct {
+	conn       net.Conn
+	reader     io.Reader
+	writer     io.Writer
+	seq        byte
+	bufferPool *util.BufferPool
+	dsn        *DSN
+	handshake  *Handshake
+	capability uint32 // negotiated capabilities
+	status     uint16 // last server status
+	//capabilities requested in the handshake response
+	clientCapability uint32
+	collation        byte // of the handshake response and COM_CHANGE_USER
+}
+
+//Rows of a resultset streamed from the connection, or the OK of a command without resultset
+type Rows struct {
+	conn   *Conn
+	Fields []*Field
+	OK     *OKPacket // nil for a resultset
+	Status uint16    // status of the OK or the final EOF
+	binary bool
+	done   bool
+}
+
+//Stmt prepared statement of a connection
+type Stmt struct {
+	conn    *Conn
+	ID      uint32
+	Params  []*Field
+	Columns []*Field
+}
+
+//Dial connects to the server of the DSN and authenticates
+func Dial(dsn *DSN, options ...func(*Conn)) (*Conn, error) {
+	dialer := net.Dialer{Timeout: dsn.Timeout}
+	netConn, err := dialer.Dial(dsn.Net, dsn.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Connect(netConn, dsn, options...)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//Connect performs the client side of the connection phase over netConn
+func Connect(netConn net.Conn, dsn *DSN, options ...func(*Conn)) (conn *Conn, err error) {
+	conn = &Conn{
+		conn:             netConn,
+		reader:           bufio.NewReader(netConn),
+		writer:           netConn,
+		bufferPool:       util.NewBufferPool(),
+		dsn:              dsn,
+		clientCapability: clientCapability,
+		collation:        DefaultCollationID,
+	}
+	for _, option := range options {
+		option(conn)
+	}
+	if dsn.Timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(dsn.Timeout))
+		defer netConn.SetDeadline(time.Time{})
+	}
+	err = conn.connect()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+//WithCapability requests the optional capabilities, e.g. ClientMultiStatements or ClientLocalFiles,
+//instead of the multi statements and results requested by default
+func WithCapability(capability uint32) func(*Conn) {
+	return func(conn *Conn) {
+		conn.clientCapability = requiredCapability | capability
+	}
+}
+
+//WithCollation sets the collation of the connection instead of DefaultCollationID, 0 keeps the default
+func WithCollation(collation byte) func(*Conn) {
+	return func(conn *Conn) {
+		if collation != 0 {
+			conn.collation = collation
+		}
+	}
+}
+
+//connect reads the server handshake, switches to TLS and authenticates
+func (conn *Conn) connect() (err error) {
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		return err
+	}
+	handshake, err := ReadHandshake(packet.Body)
+	conn.ReleasePacket(packet)
+	if err != nil {
+		return err
+	} else if handshake.Capability&ClientProtocol41 == 0 {
+		return fmt.Errorf("Server %s does not support protocol 41", handshake.ServerVersion)
+	}
+	conn.handshake = handshake
+	conn.capability = conn.clientCapability & handshake.Capability
+	if conn.dsn.DBName != "" {
+		conn.capability |= ClientConnectWithDB
+	}
+	if conn.dsn.TLS != nil {
+		if handshake.Capability&ClientSSL != 0 {
+			err = conn.startTLS()
+			if err != nil {
+				return err
+			}
+		} else if !conn.dsn.TLSPreferred {
+			return fmt.Errorf("TLS not supported by server")
+		}
+	}
+	plugin := handshake.AuthPlugin
+	if plugin == "" {
+		plugin = AuthNativePassword
+	}
+	salt := handshake.Salt
+	auth, err := conn.authResponse(plugin, salt)
+	if err != nil {
+		return err
+	}
+	resp := &HandshakeResponse{
+		Capability:    conn.capability,
+		MaxPacketSize: 1 << 24,
+		Collation:     conn.collation,
+		User:          conn.dsn.User,
+		AuthResponse:  auth,
+		Database:      conn.dsn.DBName,
+		AuthPlugin:    plugin,
+	}
+	buffer := new(bytes.Buffer)
+	resp.Write(buffer)
+	err = conn.WritePacket(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return conn.readAuthResult(plugin, salt)
+}
+
+//startTLS sends an SSLRequest and switches the connection to TLS
+func (conn *Conn) startTLS() (err error) {
+	conn.capability |= ClientSSL
+	resp := &HandshakeResponse{
+		Capability:    conn.capability,
+		MaxPacketSize: 1 << 24,
+		Collation:     conn.collation,
+	}
+	buffer := new(bytes.Buffer)
+	resp.Write(buffer)
+	err = conn.WritePacket(buffer.Bytes()[:SSLRequestLen])
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Client(conn.conn, conn.dsn.TLS)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	conn.conn = tlsConn
+	conn.reader = bufio.NewReader(tlsConn)
+	conn.writer = tlsConn
+	return nil
+}
+
+//authResponse returns the first auth response of the plugin
+func (conn *Conn) authResponse(plugin string, salt []byte) ([]byte, error) {
+	password := conn.dsn.Password
+	switch plugin {
+	case AuthNativePassword:
+		return ScrambleNativePassword(salt, password), nil
+	case AuthCachingSHA2Password:
+		return ScrambleSHA256Password(salt, password), nil
+	case AuthSHA2Password:
+		if password == "" {
+			return []byte{0}, nil
+		} else if conn.isSecure() {
+			return append([]byte(password), 0), nil
+		}
+		return []byte{SHA256RequestPublicKey}, nil
+	}
+	return nil, fmt.Errorf("Auth method %s not supported", plugin)
+}
+
+//readAuthResult follows the auth exchange until OK or ERR
+func (conn *Conn) readAuthResult(plugin string, salt []byte) (err error) {
+	for {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return err
+		}
+		body := append([]byte{}, packet.Body.Bytes()...)
+		conn.ReleasePacket(packet)
+		if len(body) == 0 {
+			return fmt.Errorf("Empty auth packet")
+		}
+		var auth []byte
+		switch body[0] {
+		case OKHeader:
+			ok, err := ReadOKPacket(bytes.NewBuffer(body), conn.capability)
+			if err != nil {
+				return err
+			}
+			conn.status = ok.Status
+			return nil
+		case ERRHeader:
+			return conn.readError(bytes.NewBuffer(body))
+		case AuthSwitchHeader:
+			buffer := bytes.NewBuffer(body[1:])
+			plugin, err = ReadNullTerminatedString(buffer)
+			if err != nil {
+				return err
+			}
+			salt = bytes.TrimSuffix(buffer.Bytes(), []byte{0})
+			auth, err = conn.authResponse(plugin, salt)
+		case MoreDataHeader:
+			auth, err = conn.authMoreData(plugin, salt, body[1:])
+			if auth == nil && err == nil {
+				//fast auth, OK follows
+				continue
+			}
+		default:
+			return fmt.Errorf("Unexpected auth packet header %x", body[0])
+		}
+		if err != nil {
+			return err
+		}
+		err = conn.WritePacket(auth)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//authMoreData answers an AuthMoreData, nil if there is nothing to send
+func (conn *Conn) authMoreData(plugin string, salt []byte, data []byte) ([]byte, error) {
+	password := conn.dsn.Password
+	if plugin == AuthCachingSHA2Password && len(data) == 1 {
+		switch data[0] {
+		case CacheSHA2FastAuth:
+			return nil, nil
+		case CacheSHA2FullAuth:
+			if conn.isSecure() {
+				return append([]byte(password), 0), nil
+			}
+			return []byte{CacheSHA2RequestPublicKey}, nil
+		}
+	}
+	if plugin != AuthCachingSHA2Password && plugin != AuthSHA2Password {
+		return nil, fmt.Errorf("Unexpected auth data for %s", plugin)
+	}
+	//public key requested
+	pubKey, err := ParsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptPassword(salt, password, pubKey)
+}
+
+//isSecure checks if the password can be sent in clear text
+func (conn *Conn) isSecure() bool {
+	if _, ok := conn.conn.(*tls.Conn); ok {
+		return true
+	}
+	return conn.dsn.Net == "unix"
+}
+
+//ConnectionID returns the connection id in the server
+func (conn *Conn) ConnectionID() uint32 {
+	return conn.handshake.ConnectionID
+}
+
+//ServerVersion returns the version of the server
+func (conn *Conn) ServerVersion() string {
+	return conn.handshake.ServerVersion
+}
+
+//Capability returns the negotiated capabilities
+func (conn *Conn) Capability() uint32 {
+	return conn.capability
+}
+
+//Collation returns the collation requested in the handshake response
+func (conn *Conn) Collation() byte {
+	return conn.collation
+}
+
+//Status returns the server status of the last result
+func (conn *Conn) Status() uint16 {
+	return conn.status
+}
+
+//WriteCommand starts a command sending its packet, the body starts with the command byte
+func (conn *Conn) WriteCommand(body []byte) error {
+	conn.seq = 0
+	return conn.WritePacket(body)
+}
+
+//WritePacket sends a packet in the current sequence
+func (conn *Conn) WritePacket(body []byte) error {
+	if conn.dsn.WriteTimeout > 0 {
+		conn.conn.SetWriteDeadline(time.Now().Add(conn.dsn.WriteTimeout))
+	}
+	return WritePacket(conn.writer, &conn.seq, NewPacket(func(p *Packet) {
+		p.Body = bytes.NewBuffer(body)
+	}))
+}
+
+//ReadPacket reads the next packet of the response, release it with ReleasePacket
+func (conn *Conn) ReadPacket() (*Packet, error) {
+	if conn.dsn.ReadTimeout > 0 {
+		conn.conn.SetReadDeadline(time.Now().Add(conn.dsn.ReadTimeout))
+	}
+	return ReadPacket(conn.reader, &conn.seq, 0, conn.bufferPool)
+}
+
+//ReleasePacket returns the packet body to the pool
+func (conn *Conn) ReleasePacket(packet *Packet) {
+	conn.bufferPool.Return(packet.Body)
+}
+
+//readError decodes an ERR packet as *Error
+func (conn *Conn) readError(buffer *bytes.Buffer) error {
+	e, err := ReadERRPacket(buffer, conn.capability)
+	if err != nil {
+		return err
+	}
+	return e.ToError()
+}
+
+//Close sends COM_QUIT and closes the connection
+func (conn *Conn) Close() error {
+	conn.WriteCommand([]byte{ComQuit})
+	return conn.conn.Close()
+}
+
+//Ping sends COM_PING
+func (conn *Conn) Ping() error {
+	_, err := conn.exec([]byte{ComPing})
+	return err
+}
+
+//InitDB changes the current schema
+func (conn *Conn) InitDB(db string) error {
+	_, err := conn.exec(append([]byte{ComInitDB}, db...))
+	return err
+}
+
+//ResetConnection resets the session state keeping the user and the schema
+func (conn *Conn) ResetConnection() error {
+	_, err := conn.exec([]byte{ComResetConnection})
+	return err
+}
+
+//ChangeUser authenticates again as the DSN user with the schema, resetting the session state
+func (conn *Conn) ChangeUser(db string) error {
+	plugin := conn.handshake.AuthPlugin
+	if plugin == "" {
+		plugin = AuthNativePassword
+	}
+	salt := conn.handshake.Salt
+	auth, err := conn.authResponse(plugin, salt)
+	if err != nil {
+		return err
+	}
+	buffer := new(bytes.Buffer)
+	WriteBytes(buffer, ComChangeUser)
+	WriteNullTerminatedString(buffer, conn.dsn.User)
+	WriteBytes(buffer, byte(len(auth)))
+	Write(buffer, auth)
+	WriteNullTerminatedString(buffer, db)
+	WriteInt2(buffer, uint16(conn.collation))
+	WriteNullTerminatedString(buffer, plugin)
+	err = conn.WriteCommand(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	return conn.readAuthResult(plugin, salt)
+}
+
+//Exec runs a query without resultset
+func (conn *Conn) Exec(query string) (*OKPacket, error) {
+	return conn.exec(append([]byte{ComQuery}, query...))
+}
+
+//exec sends a command answered by OK or ERR
+func (conn *Conn) exec(body []byte) (*OKPacket, error) {
+	err := conn.WriteCommand(body)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.readResult(false)
+	if err != nil {
+		return nil, err
+	} else if rows.OK == nil {
+		rows.Close()
+		return nil, fmt.Errorf("Unexpected resultset")
+	}
+	return rows.OK, nil
+}
+
+//Query runs a query returning its first result
+func (conn *Conn) Query(query string) (*Rows, error) {
+	err := conn.WriteCommand(append([]byte{ComQuery}, query...))
+	if err != nil {
+		return nil, err
+	}
+	return conn.readResult(false)
+}
+
+//readResult reads an OK, ERR or the column definitions of a resultset
+func (conn *Conn) readResult(binary bool) (*Rows, error) {
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ReleasePacket(packet)
+	body := packet.Body.Bytes()
+	if len(body) == 0 {
+		return nil, fmt.Errorf("Empty result packet")
+	}
+	switch body[0] {
+	case OKHeader:
+		ok, err := ReadOKPacket(packet.Body, conn.capability)
+		if err != nil {
+			return nil, err
+		}
+		conn.status = ok.Status
+		return &Rows{conn: conn, OK: ok, Status: ok.Status, binary: binary, done: true}, nil
+	case ERRHeader:
+		return nil, conn.readError(packet.Body)
+	case LocalInfileHeader:
+		//no file sent, the server answers with OK or ERR
+		err = conn.WritePacket(nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.readResult(binary)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("LOCAL INFILE not supported")
+	}
+	count, _, err := ReadRLEInt(packet.Body)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := conn.readFields(int(count))
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{conn: conn, Fields: fields, binary: binary}, nil
+}
+
+//readFields reads count column definitions and the EOF
+func (conn *Conn) readFields(count int) (fields []*Field, err error) {
+	if count == 0 {
+		return nil, nil
+	}
+	fields = make([]*Field, count)
+	for i := range fields {
+		packet, err := conn.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		fields[i], err = ReadField(packet.Body)
+		conn.ReleasePacket(packet)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conn.capability&ClientDeprecateEOF != 0 {
+		return fields, nil
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ReleasePacket(packet)
+	_, err = ReadEOFPacket(packet.Body, conn.capability)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+//Next returns the values of the next row, io.EOF after the last one.
+//Text values are []byte, binary values as decoded by ReadBinaryValue, NULL is nil
+func (rows *Rows) Next() (values []interface{}, err error) {
+	if rows.done {
+		return nil, io.EOF
+	}
+	conn := rows.conn
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		rows.done = true
+		return nil, err
+	}
+	defer conn.ReleasePacket(packet)
+	body := packet.Body.Bytes()
+	switch {
+	case IsEOFPacket(body, conn.capability):
+		rows.done = true
+		eof, err := ReadEOFPacket(packet.Body, conn.capability)
+		if err != nil {
+			return nil, err
+		}
+		rows.Status = eof.Status
+		conn.status = eof.Status
+		return nil, io.EOF
+	case IsERRPacket(body):
+		rows.done = true
+		return nil, conn.readError(packet.Body)
+	case rows.binary:
+		return ReadBinaryRow(packet.Body, rows.Fields)
+	}
+	values = make([]interface{}, len(rows.Fields))
+	for i := range values {
+		value, err := ReadRLEBytes(packet.Body)
+		if err != nil {
+			return nil, err
+		} else if value != nil {
+			values[i] = value
+		}
+	}
+	return values, nil
+}
+
+//Close discards the pending rows
+func (rows *Rows) Close() error {
+	for {
+		_, err := rows.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+//NextResult discards the pending rows and returns the next result of a multi result command, io.EOF if there is none
+func (rows *Rows) NextResult() (*Rows, error) {
+	err := rows.Close()
+	if err != nil {
+		return nil, err
+	} else if rows.Status&ServerStatusMoreResultsExists == 0 {
+		return nil, io.EOF
+	}
+	return rows.conn.readResult(rows.binary)
+}
+
+//Prepare prepares a statement
+func (conn *Conn) Prepare(query string) (stmt *Stmt, err error) {
+	err = conn.WriteCommand(append([]byte{ComSTMTPrepare}, query...))
+	if err != nil {
+		return nil, err
+	}
+	packet, err := conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ReleasePacket(packet)
+	if IsERRPacket(packet.Body.Bytes()) {
+		return nil, conn.readError(packet.Body)
+	}
+	ok, err := ReadStmtPrepareOK(packet.Body)
+	if err != nil {
+		return nil, err
+	}
+	stmt = &Stmt{conn: conn, ID: ok.StatementID}
+	stmt.Params, err = conn.readFields(int(ok.ParamCount))
+	if err != nil {
+		return nil, err
+	}
+	stmt.Columns, err = conn.readFields(int(ok.ColumnCount))
+	if err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+//Execute runs the statement with the params, rows are decoded from the binary protocol
+func (stmt *Stmt) Execute(params ...interface{}) (*Rows, error) {
+	if len(params) != len(stmt.Params) {
+		return nil, fmt.Errorf("%d params for %d placeholders", len(params), len(stmt.Params))
+	}
+	execute := &StmtExecute{StatementID: stmt.ID, NewParamsBound: true, Params: params}
+	buffer := new(bytes.Buffer)
+	err := execute.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	err = stmt.conn.WriteCommand(buffer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return stmt.conn.readResult(true)
+}
+
+//Close deallocates the statement, the server does not answer
+func (stmt *Stmt) Close() error {
+	return stmt.conn.WriteCommand([]byte{ComSTMTClose, byte(stmt.ID), byte(stmt.ID >> 8), byte(stmt.ID >> 16), byte(stmt.ID >> 24)})
+}
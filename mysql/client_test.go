@@ -0,0 +1,147 @@
+package mysql_test
+
+import (
+	"io"
+	"testing"
+
+	mysqltest "github.com/rafalopez79/godriver/internal/mysqltest"
+	mysql "github.com/rafalopez79/godriver/mysql"
+	"gotest.tools/assert"
+)
+
+func dial(t *testing.T, server *mysqltest.Server, userPassword string, params string) (*mysql.Conn, error) {
+	dsn, err := mysql.ParseDSN(userPassword + "@tcp(" + server.Addr + ")/test" + params)
+	assert.NilError(t, err)
+	return mysql.Dial(dsn)
+}
+
+func TestClientAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []func(*mysqltest.Server)
+		params  string
+	}{
+		{"native", nil, ""},
+		{"caching_sha2 fast auth", []func(*mysqltest.Server){mysqltest.WithAuthMethod(mysql.AuthCachingSHA2Password), mysqltest.WithFastAuth()}, ""},
+		{"caching_sha2 full auth", []func(*mysqltest.Server){mysqltest.WithAuthMethod(mysql.AuthCachingSHA2Password)}, ""},
+		{"caching_sha2 full auth with TLS", []func(*mysqltest.Server){mysqltest.WithAuthMethod(mysql.AuthCachingSHA2Password), mysqltest.WithTLS()}, "?tls=skip-verify"},
+		{"sha256", []func(*mysqltest.Server){mysqltest.WithAuthMethod(mysql.AuthSHA2Password)}, ""},
+		{"sha256 with TLS", []func(*mysqltest.Server){mysqltest.WithAuthMethod(mysql.AuthSHA2Password), mysqltest.WithTLS()}, "?tls=preferred"},
+		{"auth switch", []func(*mysqltest.Server){mysqltest.WithAuthSwitch(mysql.AuthSHA2Password)}, ""},
+		{"TLS preferred without TLS", nil, "?tls=preferred"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, err := mysqltest.NewServer("user", "secret", test.options...)
+			assert.NilError(t, err)
+			defer server.Close()
+			conn, err := dial(t, server, "user:secret", test.params)
+			assert.NilError(t, err)
+			assert.Equal(t, conn.ServerVersion(), mysqltest.Version)
+			assert.NilError(t, conn.Ping())
+			assert.NilError(t, conn.Close())
+
+			_, err = dial(t, server, "user:wrong", test.params)
+			e, ok := err.(*mysql.Error)
+			assert.Assert(t, ok, "%v", err)
+			assert.Equal(t, e.Number, mysql.ErrAccessDeniedError)
+		})
+	}
+}
+
+func TestClientTLSRequired(t *testing.T) {
+	server, err := mysqltest.NewServer("user", "secret")
+	assert.NilError(t, err)
+	defer server.Close()
+	_, err = dial(t, server, "user:secret", "?tls=skip-verify")
+	assert.ErrorContains(t, err, "TLS")
+}
+
+func TestClientCommands(t *testing.T) {
+	server, err := mysqltest.NewServer("user", "")
+	assert.NilError(t, err)
+	defer server.Close()
+	server.SetResult("SELECT 1", &mysqltest.Result{
+		Fields: []*mysql.Field{mysql.NewField("a", mysql.MYSQLTypeLongLong), mysql.NewField("b", mysql.MYSQLTypeVarString)},
+		Rows:   [][]interface{}{{1, "x"}, {2, nil}},
+	})
+	server.SetResult("UPDATE", &mysqltest.Result{AffectedRows: 2, LastInsertID: 5})
+	server.SetResult("BAD", &mysqltest.Result{Err: mysql.NewError(mysql.ErrParseError, "near 'BAD'")})
+	conn, err := dial(t, server, "user", "")
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT 1")
+	assert.NilError(t, err)
+	assert.Equal(t, rows.Fields[1].Name, "b")
+	var values [][]interface{}
+	for {
+		row, err := rows.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		values = append(values, row)
+	}
+	assert.DeepEqual(t, values, [][]interface{}{{[]byte("1"), []byte("x")}, {[]byte("2"), nil}})
+
+	ok, err := conn.Exec("UPDATE")
+	assert.NilError(t, err)
+	assert.Equal(t, ok.AffectedRows, uint64(2))
+	assert.Equal(t, ok.LastInsertID, uint64(5))
+
+	_, err = conn.Exec("BAD")
+	assert.ErrorContains(t, err, "Error 1064 (42000)")
+	_, err = conn.Exec("SELECT 1")
+	assert.ErrorContains(t, err, "Unexpected resultset")
+
+	//multi statements
+	rows, err = conn.Query("SELECT 1; UPDATE")
+	assert.NilError(t, err)
+	assert.Equal(t, len(rows.Fields), 2)
+	rows, err = rows.NextResult()
+	assert.NilError(t, err)
+	assert.Equal(t, rows.OK.AffectedRows, uint64(2))
+	_, err = rows.NextResult()
+	assert.Equal(t, err, io.EOF)
+
+	_, err = conn.Exec("BEGIN")
+	assert.NilError(t, err)
+	assert.Equal(t, conn.Status()&mysql.ServerStatusInTrans, mysql.ServerStatusInTrans)
+
+	_, err = conn.Query("LOAD DATA LOCAL INFILE 'data.csv' INTO TABLE t")
+	assert.ErrorContains(t, err, "LOCAL INFILE not supported")
+	assert.NilError(t, conn.InitDB("other"))
+
+	stmt, err := conn.Prepare("SELECT ?")
+	assert.NilError(t, err)
+	assert.Equal(t, len(stmt.Params), 1)
+	assert.Equal(t, len(stmt.Columns), 1)
+	_, err = stmt.Execute()
+	assert.ErrorContains(t, err, "0 params for 1 placeholders")
+	rows, err = stmt.Execute("abc")
+	assert.NilError(t, err)
+	row, err := rows.Next()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, row, []interface{}{[]byte("abc")})
+	assert.NilError(t, rows.Close())
+	assert.NilError(t, stmt.Close())
+	assert.NilError(t, conn.Ping())
+	assert.DeepEqual(t, server.Queries(), []string{"SELECT 1", "UPDATE", "BAD", "SELECT 1", "SELECT 1", "UPDATE", "BEGIN", "LOAD DATA LOCAL INFILE 'data.csv' INTO TABLE t"})
+}
+
+func TestClientCollation(t *testing.T) {
+	server, err := mysqltest.NewServer("user", "", mysqltest.WithoutResetConnection())
+	assert.NilError(t, err)
+	defer server.Close()
+	conn, err := mysql.Dial(&mysql.DSN{User: "user", Net: "tcp", Addr: server.Addr})
+	assert.NilError(t, err)
+	defer conn.Close()
+	assert.Equal(t, conn.Collation(), mysql.DefaultCollationID)
+
+	utf8mb4, err := mysql.Dial(&mysql.DSN{User: "user", Net: "tcp", Addr: server.Addr}, mysql.WithCollation(255))
+	assert.NilError(t, err)
+	defer utf8mb4.Close()
+	assert.NilError(t, utf8mb4.ChangeUser(""))
+	assert.DeepEqual(t, server.Collations(), []byte{mysql.DefaultCollationID, 255, 255})
+}
@@ -0,0 +1,221 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+//MinCompressLength payloads shorter are sent uncompressed
+const MinCompressLength = 50
+
+//Compression algorithm of the compressed protocol
+type Compression interface {
+	//Compress appends the compressed data to dst
+	Compress(dst *bytes.Buffer, data []byte) error
+	//Decompress returns a reader of the uncompressed src
+	Decompress(src io.Reader) (io.Reader, error)
+}
+
+//zlibCompression CLIENT_COMPRESS
+type zlibCompression struct {
+	writer *zlib.Writer
+	reader io.ReadCloser
+}
+
+//NewZlibCompression creates a zlib compression with the level
+func NewZlibCompression(level int) (Compression, error) {
+	writer, err := zlib.NewWriterLevel(nil, level)
+	if err != nil {
+		return nil, err
+	}
+	return &zlibCompression{writer: writer}, nil
+}
+
+//Compress appends the zlib compressed data to dst
+func (compression *zlibCompression) Compress(dst *bytes.Buffer, data []byte) (err error) {
+	compression.writer.Reset(dst)
+	_, err = compression.writer.Write(data)
+	if err != nil {
+		return err
+	}
+	return compression.writer.Close()
+}
+
+//Decompress returns a zlib reader of src
+func (compression *zlibCompression) Decompress(src io.Reader) (reader io.Reader, err error) {
+	if compression.reader == nil {
+		compression.reader, err = zlib.NewReader(src)
+	} else {
+		err = compression.reader.(zlib.Resetter).Reset(src, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return compression.reader, nil
+}
+
+//zstdCompression CLIENT_ZSTD_COMPRESSION_ALGORITHM
+type zstdCompression struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+//NewZstdCompression creates a zstd compression with the level, 1 to 22
+func NewZstdCompression(level int) (Compression, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	//the window of a frame is at most a payload
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(MaxPayloadLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompression{encoder: encoder, decoder: decoder}, nil
+}
+
+//Compress appends the zstd frame to dst
+func (compression *zstdCompression) Compress(dst *bytes.Buffer, data []byte) (err error) {
+	_, err = dst.Write(compression.encoder.EncodeAll(data, nil))
+	return err
+}
+
+//Decompress returns a streaming reader of the zstd frame of src, nothing is decoded beyond what is read
+func (compression *zstdCompression) Decompress(src io.Reader) (reader io.Reader, err error) {
+	err = compression.decoder.Reset(src)
+	if err != nil {
+		return nil, err
+	}
+	return compression.decoder, nil
+}
+
+//CompressedReader reads the compressed protocol returning the uncompressed packet stream
+type CompressedReader struct {
+	reader      io.Reader
+	seq         *byte // compressed sequence
+	data        bytes.Buffer
+	compression Compression
+}
+
+//NewCompressedReader creates a reader of compressed packets
+func NewCompressedReader(reader io.Reader, seq *byte, compression Compression) *CompressedReader {
+	return &CompressedReader{
+		reader:      reader,
+		seq:         seq,
+		compression: compression,
+	}
+}
+
+//Read reads the uncompressed stream
+func (cr *CompressedReader) Read(p []byte) (n int, err error) {
+	for cr.data.Len() == 0 {
+		err = cr.readCompressedPacket()
+		if err != nil {
+			return 0, err
+		}
+	}
+	return cr.data.Read(p)
+}
+
+func (cr *CompressedReader) readCompressedPacket() (err error) {
+	var header [7]byte
+	_, err = io.ReadFull(cr.reader, header[:])
+	if err != nil {
+		return err
+	}
+	compressedLen := int64(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	if header[3] != *cr.seq {
+		return fmt.Errorf("invalid compressed sequence %d != %d", header[3], *cr.seq)
+	}
+	*cr.seq++
+	uncompressedLen := int64(uint32(header[4]) | uint32(header[5])<<8 | uint32(header[6])<<16)
+	payload := io.LimitReader(cr.reader, compressedLen)
+	var data io.Reader = payload
+	if uncompressedLen == 0 {
+		//not compressed
+		uncompressedLen = compressedLen
+	} else {
+		data, err = cr.compression.Decompress(payload)
+		if err != nil {
+			return err
+		}
+	}
+	cr.data.Grow(int(uncompressedLen))
+	n, err := cr.data.ReadFrom(io.LimitReader(data, uncompressedLen))
+	if err == nil && n != uncompressedLen {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return fmt.Errorf("Read failed. only %d bytes uncompressed while %d expected: %v", n, uncompressedLen, err)
+	}
+	//compression trailer
+	_, err = io.Copy(ioutil.Discard, payload)
+	return err
+}
+
+//CompressedWriter buffers the packet stream and writes it compressed on Flush
+type CompressedWriter struct {
+	writer      io.Writer
+	seq         *byte // compressed sequence
+	data        bytes.Buffer
+	compressed  bytes.Buffer
+	compression Compression
+}
+
+//NewCompressedWriter creates a writer of compressed packets
+func NewCompressedWriter(writer io.Writer, seq *byte, compression Compression) *CompressedWriter {
+	return &CompressedWriter{
+		writer:      writer,
+		seq:         seq,
+		compression: compression,
+	}
+}
+
+//Write buffers the uncompressed stream
+func (cw *CompressedWriter) Write(p []byte) (n int, err error) {
+	return cw.data.Write(p)
+}
+
+//Flush writes the buffered stream in compressed packets
+func (cw *CompressedWriter) Flush() (err error) {
+	defer cw.data.Reset()
+	for cw.data.Len() > 0 {
+		err = cw.writeCompressedPacket(cw.data.Next(Min(cw.data.Len(), MaxPayloadLen)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cw *CompressedWriter) writeCompressedPacket(data []byte) (err error) {
+	payload := data
+	uncompressedLen := 0
+	if len(data) >= MinCompressLength {
+		cw.compressed.Reset()
+		err = cw.compression.Compress(&cw.compressed, data)
+		if err != nil {
+			return err
+		}
+		if cw.compressed.Len() < len(data) {
+			payload = cw.compressed.Bytes()
+			uncompressedLen = len(data)
+		}
+	}
+	header := [7]byte{
+		byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16),
+		*cw.seq,
+		byte(uncompressedLen), byte(uncompressedLen >> 8), byte(uncompressedLen >> 16),
+	}
+	*cw.seq++
+	err = write(cw.writer, header[:])
+	if err != nil {
+		return err
+	}
+	return write(cw.writer, payload)
+}
@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"testing"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+	"gotest.tools/assert"
+)
+
+func testCompressedRoundTrip(t *testing.T, compression Compression) []byte {
+	pool := util.NewBufferPool()
+	stream := new(bytes.Buffer)
+	var writeCompressSeq, writeSeq byte
+	writer := NewCompressedWriter(stream, &writeCompressSeq, compression)
+	sizes := []int{1, MinCompressLength - 4, 1000, MaxPayloadLen + 10}
+	for _, size := range sizes {
+		body := bytes.Repeat([]byte("abc"), size)[:size]
+		assert.NilError(t, WritePacket(writer, &writeSeq, NewPacket(func(p *Packet) {
+			p.Body = bytes.NewBuffer(body)
+		})))
+	}
+	data := append([]byte{}, stream.Bytes()...)
+
+	var readCompressSeq, readSeq byte
+	reader := NewCompressedReader(stream, &readCompressSeq, compression)
+	for _, size := range sizes {
+		packet, err := ReadPacket(reader, &readSeq, 0, pool)
+		assert.NilError(t, err)
+		assert.Assert(t, bytes.Equal(packet.Body.Bytes(), bytes.Repeat([]byte("abc"), size)[:size]))
+		pool.Return(packet.Body)
+	}
+	assert.Equal(t, readSeq, writeSeq)
+	assert.Equal(t, readCompressSeq, writeCompressSeq)
+	assert.Equal(t, stream.Len(), 0)
+	return data
+}
+
+func TestZlibCompressedRoundTrip(t *testing.T) {
+	compression, err := NewZlibCompression(zlib.DefaultCompression)
+	assert.NilError(t, err)
+	data := testCompressedRoundTrip(t, compression)
+	//small packet sent uncompressed
+	assert.DeepEqual(t, data[:7], []byte{5, 0, 0, 0, 0, 0, 0})
+	//not compressed if zlib does not reduce it
+	assert.DeepEqual(t, data[12:12+7], []byte{50, 0, 0, 1, 0, 0, 0})
+	//compressed
+	assert.DeepEqual(t, data[69+3:69+7], []byte{2, 0xec, 0x03, 0})
+	assert.DeepEqual(t, data[69+7:69+9], []byte{0x78, 0x9c})
+}
+
+func TestZstdCompressedRoundTrip(t *testing.T) {
+	compression, err := NewZstdCompression(DefaultZstdCompressionLevel)
+	assert.NilError(t, err)
+	data := testCompressedRoundTrip(t, compression)
+	assert.DeepEqual(t, data[:7], []byte{5, 0, 0, 0, 0, 0, 0})
+	//compressed, zstd frame magic number
+	assert.DeepEqual(t, data[12+3:12+11], []byte{1, 50, 0, 0, 0x28, 0xb5, 0x2f, 0xfd})
+}
+
+func TestZstdDecompressLimit(t *testing.T) {
+	compression, err := NewZstdCompression(DefaultZstdCompressionLevel)
+	assert.NilError(t, err)
+	//a frame of 64MB announcing 10 bytes uncompressed
+	frame := new(bytes.Buffer)
+	assert.NilError(t, compression.Compress(frame, make([]byte, 4*MaxPayloadLen)))
+	stream := bytes.NewBuffer([]byte{byte(frame.Len()), byte(frame.Len() >> 8), byte(frame.Len() >> 16), 0, 10, 0, 0})
+	stream.Write(frame.Bytes())
+
+	var seq byte
+	reader := NewCompressedReader(stream, &seq, compression)
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	data, err := ioutil.ReadAll(reader)
+	runtime.ReadMemStats(&after)
+	assert.Assert(t, err == io.EOF || err == nil, "%v", err)
+	assert.DeepEqual(t, data, make([]byte, 10))
+	assert.Assert(t, after.TotalAlloc-before.TotalAlloc < uint64(MaxPayloadLen), "%d bytes allocated", after.TotalAlloc-before.TotalAlloc)
+}
+
+func TestCompressedWrongSequence(t *testing.T) {
+	var seq byte = 1
+	reader := NewCompressedReader(bytes.NewBuffer([]byte{1, 0, 0, 0, 0, 0, 0, 'x'}), &seq, nil)
+	_, err := reader.Read(make([]byte, 1))
+	assert.ErrorContains(t, err, "invalid compressed sequence 0 != 1")
+}
@@ -0,0 +1,130 @@
+package mysql
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//DefaultPort of MySQL servers
+const DefaultPort = "3306"
+
+//DSN settings of a backend connection, [user[:password]@][net[(addr)]]/dbname[?param=value&...]
+//params: tls (true, false, skip-verify or preferred), timeout, readTimeout and writeTimeout
+type DSN struct {
+	User         string
+	Password     string
+	Net          string // tcp or unix
+	Addr         string
+	DBName       string
+	TLS          *tls.Config // nil without TLS
+	TLSPreferred bool        // TLS only if the server supports it
+	Timeout      time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+//ParseDSN parses a data source name
+func ParseDSN(dsn string) (cfg *DSN, err error) {
+	cfg = &DSN{Net: "tcp"}
+	slash := strings.LastIndex(dsn, "/")
+	if slash < 0 {
+		return nil, fmt.Errorf("Invalid DSN %s: missing the slash before the database name", dsn)
+	}
+	address := dsn[:slash]
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		user := address[:at]
+		address = address[at+1:]
+		if colon := strings.Index(user, ":"); colon >= 0 {
+			cfg.User, cfg.Password = user[:colon], user[colon+1:]
+		} else {
+			cfg.User = user
+		}
+	}
+	if open := strings.Index(address, "("); open >= 0 {
+		if !strings.HasSuffix(address, ")") {
+			return nil, fmt.Errorf("Invalid DSN %s: unclosed address", dsn)
+		}
+		cfg.Net = address[:open]
+		cfg.Addr = address[open+1 : len(address)-1]
+	} else if address != "" {
+		cfg.Net = address
+	}
+	dbName := dsn[slash+1:]
+	query := ""
+	if question := strings.Index(dbName, "?"); question >= 0 {
+		dbName, query = dbName[:question], dbName[question+1:]
+	}
+	cfg.DBName, err = url.PathUnescape(dbName)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DSN %s: %v", dsn, err)
+	}
+	switch cfg.Net {
+	case "tcp":
+		if cfg.Addr == "" {
+			cfg.Addr = "127.0.0.1:" + DefaultPort
+		} else if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+			cfg.Addr = net.JoinHostPort(cfg.Addr, DefaultPort)
+		}
+	case "unix":
+		if cfg.Addr == "" {
+			cfg.Addr = "/tmp/mysql.sock"
+		}
+	default:
+		return nil, fmt.Errorf("Invalid DSN %s: unknown network %s", dsn, cfg.Net)
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid DSN %s: %v", dsn, err)
+	}
+	for key, values := range params {
+		err = cfg.setParam(key, values[len(values)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid DSN %s: %v", dsn, err)
+		}
+	}
+	return cfg, nil
+}
+
+func (cfg *DSN) setParam(key string, value string) (err error) {
+	switch key {
+	case "tls":
+		host, _, _ := net.SplitHostPort(cfg.Addr)
+		switch value {
+		case "false", "":
+			cfg.TLS = nil
+		case "true":
+			cfg.TLS = &tls.Config{ServerName: host}
+		case "skip-verify":
+			cfg.TLS = &tls.Config{InsecureSkipVerify: true}
+		case "preferred":
+			cfg.TLS = &tls.Config{InsecureSkipVerify: true}
+			cfg.TLSPreferred = true
+		default:
+			return fmt.Errorf("Invalid tls value %s", value)
+		}
+	case "timeout":
+		cfg.Timeout, err = time.ParseDuration(value)
+	case "readTimeout":
+		cfg.ReadTimeout, err = time.ParseDuration(value)
+	case "writeTimeout":
+		cfg.WriteTimeout, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("Unknown param %s", key)
+	}
+	return err
+}
+
+//String formats the DSN without the password
+func (cfg *DSN) String() string {
+	var sb strings.Builder
+	if cfg.User != "" {
+		sb.WriteString(cfg.User)
+		sb.WriteString("@")
+	}
+	fmt.Fprintf(&sb, "%s(%s)/%s", cfg.Net, cfg.Addr, url.PathEscape(cfg.DBName))
+	return sb.String()
+}
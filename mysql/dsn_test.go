@@ -0,0 +1,37 @@
+package mysql
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestParseDSN(t *testing.T) {
+	cfg, err := ParseDSN("user:pass:word@tcp(db.local)/my%20db?timeout=2s&readTimeout=1s&tls=true")
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.User, "user")
+	assert.Equal(t, cfg.Password, "pass:word")
+	assert.Equal(t, cfg.Net, "tcp")
+	assert.Equal(t, cfg.Addr, "db.local:3306")
+	assert.Equal(t, cfg.DBName, "my db")
+	assert.Equal(t, cfg.Timeout, 2*time.Second)
+	assert.Equal(t, cfg.ReadTimeout, time.Second)
+	assert.Equal(t, cfg.TLS.ServerName, "db.local")
+	assert.Equal(t, cfg.String(), "user@tcp(db.local:3306)/my%20db")
+
+	cfg, err = ParseDSN("/")
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.Addr, "127.0.0.1:3306")
+	assert.Assert(t, cfg.TLS == nil)
+
+	cfg, err = ParseDSN("root@unix/test?tls=preferred")
+	assert.NilError(t, err)
+	assert.Equal(t, cfg.Addr, "/tmp/mysql.sock")
+	assert.Assert(t, cfg.TLSPreferred)
+
+	for _, dsn := range []string{"user@tcp", "udp(host)/db", "tcp(host/db", "/db?tls=maybe", "/db?timeout=x", "/db?foo=bar"} {
+		_, err = ParseDSN(dsn)
+		assert.ErrorContains(t, err, "Invalid DSN")
+	}
+}
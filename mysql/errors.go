@@ -0,0 +1,91 @@
+package mysql
+
+import (
+	"fmt"
+)
+
+//Error a MySQL error, sent to the client as an ERR packet
+type Error struct {
+	Number   uint16
+	SQLState string
+	Message  string
+}
+
+//errorDefinition SQLSTATE and message format of an error number
+type errorDefinition struct {
+	sqlState string
+	format   string
+}
+
+//errors catalog
+var errorCatalog = map[uint16]errorDefinition{
+	ErrConCountError:          {"08004", "Too many connections"},
+	ErrDBAccessDeniedError:    {"42000", "Access denied for user '%s'@'%s' to database '%s'"},
+	ErrAccessDeniedError:      {"28000", "Access denied for user '%s'@'%s' (using password: %s)"},
+	ErrNoDBError:              {"3D000", "No database selected"},
+	ErrUnknownComError:        {"08S01", "Unknown command"},
+	ErrBadDBError:             {"42000", "Unknown database '%s'"},
+	ErrServerShutdown:         {"08S01", "Server shutdown in progress"},
+	ErrParseError:             {"42000", "You have an error in your SQL syntax; %s"},
+	ErrUnknownError:           {"HY000", "Unknown error"},
+	ErrHostIsBlocked:          {"HY000", "Host '%s' is blocked because of many connection errors; unblock with 'mysqladmin flush-hosts'"},
+	ErrHostNotPrivileged:      {"HY000", "Host '%s' is not allowed to connect to this MySQL server"},
+	ErrAbortingConnection:     {"08S01", "Aborted connection %d to db: '%s' user: '%s' (%s)"},
+	ErrNetPacketTooLarge:      {"08S01", "Got a packet bigger than 'max_allowed_packet' bytes"},
+	ErrNetReadError:           {"08S01", "Got an error reading communication packets"},
+	ErrNetReadInterrupted:     {"08S01", "Got timeout reading communication packets"},
+	ErrNetErrorOnWrite:        {"08S01", "Got an error writing communication packets"},
+	ErrTooManyUserConnections: {"42000", "User %s already has more than 'max_user_connections' active connections"},
+	ErrLockWaitTimeout:        {"HY000", "Lock wait timeout exceeded; try restarting transaction"},
+	ErrLockDeadlock:           {"40001", "Deadlock found when trying to get lock; try restarting transaction"},
+	ErrWrongArguments:         {"HY000", "Incorrect arguments to %s"},
+	ErrUnknownStmtHandler:     {"HY000", "Unknown prepared statement handler (%d) given to %s"},
+	ErrUnsupportedPS:          {"HY000", "This command is not supported in the prepared statement protocol yet"},
+	ErrQueryInterrupted:       {"70100", "Query execution was interrupted"},
+	ErrStmtHasNoOpenCursor:    {"HY000", "The statement (%d) has no open cursor."},
+	ErrReadOnlyTransaction:    {"25006", "Cannot execute statement in a READ ONLY transaction."},
+	ErrMalformedPacket:        {"HY000", "Malformed communication packet."},
+	CRConnectionError:         {"HY000", "Can't connect to MySQL server (%s)"},
+	CRServerGoneError:         {"HY000", "MySQL server has gone away"},
+	CRServerLost:              {"HY000", "Lost connection to MySQL server during query"},
+	CRServerLostExtended:      {"HY000", "Lost connection to MySQL server at '%s', system error: %s"},
+}
+
+//NewError creates an error of the catalog, formatting its message with the args
+func NewError(number uint16, args ...interface{}) *Error {
+	definition, ok := errorCatalog[number]
+	if !ok {
+		return &Error{number, DefaultSQLState, fmt.Sprint(args...)}
+	}
+	message := definition.format
+	if len(args) > 0 {
+		message = fmt.Sprintf(definition.format, args...)
+	}
+	return &Error{number, definition.sqlState, message}
+}
+
+//NewErrorf creates an error with a custom message and the SQLSTATE of the catalog
+func NewErrorf(number uint16, format string, args ...interface{}) *Error {
+	err := NewError(number)
+	err.Message = fmt.Sprintf(format, args...)
+	return err
+}
+
+//Error implements error
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Number, e.SQLState, e.Message)
+}
+
+//ERRPacket returns the ERR packet of the error
+func (e *Error) ERRPacket() *ERRPacket {
+	return &ERRPacket{e.Number, e.SQLState, e.Message}
+}
+
+//ToError returns the error of the ERR packet, with the default SQLSTATE if missing
+func (e *ERRPacket) ToError() *Error {
+	sqlState := e.SQLState
+	if sqlState == "" {
+		sqlState = DefaultSQLState
+	}
+	return &Error{e.Code, sqlState, e.Message}
+}
@@ -0,0 +1,33 @@
+package mysql
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestNewError(t *testing.T) {
+	err := NewError(ErrAccessDeniedError, "user1", "localhost", "YES")
+	assert.DeepEqual(t, err, &Error{1045, "28000", "Access denied for user 'user1'@'localhost' (using password: YES)"})
+	assert.Equal(t, err.Error(), "Error 1045 (28000): Access denied for user 'user1'@'localhost' (using password: YES)")
+
+	assert.DeepEqual(t, NewError(ErrConCountError), &Error{1040, "08004", "Too many connections"})
+	assert.DeepEqual(t, NewError(ErrBadDBError, "db1"), &Error{1049, "42000", "Unknown database 'db1'"})
+	assert.DeepEqual(t, NewError(CRServerLost), &Error{2013, "HY000", "Lost connection to MySQL server during query"})
+	assert.DeepEqual(t, NewError(9999, "custom"), &Error{9999, DefaultSQLState, "custom"})
+	assert.DeepEqual(t, NewErrorf(ErrParseError, "near '%s'", "SELEC"), &Error{1064, "42000", "near 'SELEC'"})
+}
+
+func TestErrorPacket(t *testing.T) {
+	err := NewError(ErrUnknownComError)
+	packet := err.ERRPacket()
+	assert.DeepEqual(t, packet, &ERRPacket{1047, "08S01", "Unknown command"})
+	assert.DeepEqual(t, packet.ToError(), err)
+	assert.Equal(t, (&ERRPacket{Code: 1105, Message: "x"}).ToError().SQLState, DefaultSQLState)
+
+	var sqlErr *Error
+	assert.Assert(t, errors.As(fmt.Errorf("wrapped: %w", err), &sqlErr))
+	assert.Equal(t, sqlErr.Number, ErrUnknownComError)
+}
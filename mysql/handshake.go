@@ -0,0 +1,357 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+//Handshake initial HandshakeV10 sent by the server in the connection phase
+type Handshake struct {
+	ProtocolVersion byte
+	ServerVersion   string
+	ConnectionID    uint32
+	Salt            []byte // 8 + 12
+	Capability      uint32
+	Collation       byte
+	Status          uint16
+	AuthPlugin      string
+}
+
+//HandshakeResponse sent by the client in the connection phase
+type HandshakeResponse struct {
+	Capability    uint32
+	MaxPacketSize uint32
+	Collation     byte
+	User          string
+	AuthResponse  []byte
+	Database      string
+	AuthPlugin    string
+	Attributes    map[string]string
+	//CLIENT_ZSTD_COMPRESSION_ALGORITHM
+	ZstdCompressionLevel byte
+}
+
+//Write encodes the HandshakeV10
+func (handshake *Handshake) Write(buffer *bytes.Buffer) (err error) {
+	//proto version
+	WriteBytes(buffer, handshake.ProtocolVersion)
+	//server version
+	WriteNullTerminatedString(buffer, handshake.ServerVersion)
+	//conn id
+	WriteInt4(buffer, handshake.ConnectionID)
+	//salt
+	Write(buffer, handshake.Salt[:8])
+	WriteBytes(buffer, 0)
+	//server caps
+	WriteInt2(buffer, uint16(handshake.Capability))
+	//server default collation
+	WriteBytes(buffer, handshake.Collation)
+	//status flags
+	WriteInt2(buffer, handshake.Status)
+	//server caps 2
+	WriteInt2(buffer, uint16(handshake.Capability>>16))
+	//auth plugin data len
+	if handshake.Capability&ClientPluginAuth != 0 {
+		WriteBytes(buffer, byte(len(handshake.Salt)+1))
+	} else {
+		WriteBytes(buffer, 0)
+	}
+	//reserved
+	WriteBytes(buffer, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	//salt part 2
+	if handshake.Capability&ClientSecureConnection != 0 {
+		Write(buffer, handshake.Salt[8:])
+		WriteBytes(buffer, 0)
+	}
+	//auth plugin name
+	if handshake.Capability&ClientPluginAuth != 0 {
+		return WriteNullTerminatedString(buffer, handshake.AuthPlugin)
+	}
+	return nil
+}
+
+//ReadHandshake decodes a HandshakeV10, an ERR packet is returned as *Error
+func ReadHandshake(buffer *bytes.Buffer) (handshake *Handshake, err error) {
+	handshake = &Handshake{}
+	handshake.ProtocolVersion, err = buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if handshake.ProtocolVersion == ERRHeader {
+		buffer.UnreadByte()
+		e, err := ReadERRPacket(buffer, ClientProtocol41)
+		if err != nil {
+			return nil, err
+		}
+		return nil, e.ToError()
+	} else if handshake.ProtocolVersion < MinProtocolVersion {
+		return nil, fmt.Errorf("Protocol version %d not supported", handshake.ProtocolVersion)
+	}
+	handshake.ServerVersion, err = ReadNullTerminatedString(buffer)
+	if err != nil {
+		return nil, err
+	}
+	handshake.ConnectionID, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if buffer.Len() < 8+1+2 {
+		return nil, fmt.Errorf("Wrong handshake packet length")
+	}
+	handshake.Salt = append([]byte{}, buffer.Next(8)...)
+	buffer.Next(1)
+	capability, _ := ReadInt2(buffer)
+	handshake.Capability = uint32(capability)
+	if buffer.Len() == 0 {
+		return handshake, nil
+	}
+	if buffer.Len() < 1+2+2+1+10 {
+		return nil, fmt.Errorf("Wrong handshake packet length")
+	}
+	handshake.Collation, _ = buffer.ReadByte()
+	handshake.Status, _ = ReadInt2(buffer)
+	capability, _ = ReadInt2(buffer)
+	handshake.Capability |= uint32(capability) << 16
+	saltLen, _ := buffer.ReadByte()
+	buffer.Next(10)
+	if handshake.Capability&ClientSecureConnection != 0 {
+		n := Max(13, int(saltLen)-8)
+		if buffer.Len() < n {
+			return nil, fmt.Errorf("Wrong handshake salt length %d", saltLen)
+		}
+		salt := buffer.Next(n)
+		//trailing NUL
+		handshake.Salt = append(handshake.Salt, salt[:n-1]...)
+	}
+	if handshake.Capability&ClientPluginAuth != 0 {
+		handshake.AuthPlugin, err = ReadNullTerminatedString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return handshake, nil
+}
+
+//SSLRequest packet lengths, protocol 41 and 320
+const (
+	SSLRequestLen    = 32
+	SSLRequest320Len = 5
+)
+
+//IsSSLRequest checks if a packet of the given length is an SSLRequest
+func IsSSLRequest(length int) bool {
+	return length == SSLRequestLen || length == SSLRequest320Len
+}
+
+//ReadHandshakeResponse decodes a HandshakeResponse41 or HandshakeResponse320,
+//an SSLRequest is decoded up to the collation
+func ReadHandshakeResponse(buffer *bytes.Buffer) (resp *HandshakeResponse, err error) {
+	if buffer.Len() < 2 {
+		return nil, fmt.Errorf("Wrong client handshake packet length %d", buffer.Len())
+	}
+	data := buffer.Bytes()
+	if (uint32(data[0])|uint32(data[1])<<8)&ClientProtocol41 == 0 {
+		return readHandshakeResponse320(buffer)
+	}
+	return readHandshakeResponse41(buffer)
+}
+
+func readHandshakeResponse41(buffer *bytes.Buffer) (resp *HandshakeResponse, err error) {
+	if buffer.Len() < SSLRequestLen {
+		return nil, fmt.Errorf("Wrong client handshake packet length %d", buffer.Len())
+	}
+	resp = &HandshakeResponse{}
+	resp.Capability, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	resp.MaxPacketSize, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	resp.Collation, err = buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	buffer.Next(23) //reserved
+	if buffer.Len() == 0 {
+		//ssl request
+		return resp, nil
+	}
+	resp.User, err = ReadNullTerminatedString(buffer)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.Capability&ClientPluginAuthLENENCClientData != 0:
+		resp.AuthResponse, err = ReadRLEBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+	case resp.Capability&ClientSecureConnection != 0:
+		l, err := buffer.ReadByte()
+		if err != nil {
+			return nil, err
+		} else if int(l) > buffer.Len() {
+			return nil, fmt.Errorf("Wrong auth response length %d", l)
+		}
+		resp.AuthResponse = make([]byte, l)
+		copy(resp.AuthResponse, buffer.Next(int(l)))
+	default:
+		auth, err := ReadNullTerminatedString(buffer)
+		if err != nil {
+			return nil, err
+		}
+		resp.AuthResponse = []byte(auth)
+	}
+	if resp.Capability&ClientConnectWithDB != 0 && buffer.Len() > 0 {
+		resp.Database, err = ReadNullTerminatedString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Capability&ClientPluginAuth != 0 && buffer.Len() > 0 {
+		resp.AuthPlugin, err = ReadNullTerminatedString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Capability&ClientConnectATTRS != 0 && buffer.Len() > 0 {
+		resp.Attributes, err = readAttributes(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if resp.Capability&ClientZstdCompressionAlgorithm != 0 && buffer.Len() > 0 {
+		resp.ZstdCompressionLevel, err = buffer.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func readHandshakeResponse320(buffer *bytes.Buffer) (resp *HandshakeResponse, err error) {
+	if buffer.Len() < SSLRequest320Len {
+		return nil, fmt.Errorf("Wrong client handshake packet length %d", buffer.Len())
+	}
+	resp = &HandshakeResponse{}
+	capability, err := ReadInt2(buffer)
+	if err != nil {
+		return nil, err
+	}
+	resp.Capability = uint32(capability)
+	resp.MaxPacketSize, err = ReadInt3(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if buffer.Len() == 0 {
+		//ssl request
+		return resp, nil
+	}
+	resp.User, err = ReadNullTerminatedString(buffer)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := ReadNullTerminatedString(buffer)
+	if err != nil {
+		return nil, err
+	}
+	resp.AuthResponse = []byte(auth)
+	if resp.Capability&ClientConnectWithDB != 0 && buffer.Len() > 0 {
+		resp.Database, err = ReadNullTerminatedString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func readAttributes(buffer *bytes.Buffer) (attrs map[string]string, err error) {
+	data, err := ReadRLEBytes(buffer)
+	if err != nil {
+		return nil, err
+	}
+	attrsBuffer := bytes.NewBuffer(data)
+	attrs = make(map[string]string)
+	for attrsBuffer.Len() > 0 {
+		key, err := ReadRLEString(attrsBuffer)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ReadRLEString(attrsBuffer)
+		if err != nil {
+			return nil, err
+		}
+		attrs[key] = value
+	}
+	return attrs, nil
+}
+
+//Write encodes the HandshakeResponse41 into the buffer
+func (resp *HandshakeResponse) Write(buffer *bytes.Buffer) (err error) {
+	if err = WriteInt4(buffer, resp.Capability); err != nil {
+		return err
+	}
+	if err = WriteInt4(buffer, resp.MaxPacketSize); err != nil {
+		return err
+	}
+	if err = WriteBytes(buffer, resp.Collation); err != nil {
+		return err
+	}
+	var reserved [23]byte
+	if err = Write(buffer, reserved[:]); err != nil {
+		return err
+	}
+	if err = WriteNullTerminatedString(buffer, resp.User); err != nil {
+		return err
+	}
+	switch {
+	case resp.Capability&ClientPluginAuthLENENCClientData != 0:
+		err = WriteRLEString(buffer, String(resp.AuthResponse))
+	case resp.Capability&ClientSecureConnection != 0:
+		if len(resp.AuthResponse) > 0xff {
+			return fmt.Errorf("Auth response too long %d", len(resp.AuthResponse))
+		}
+		err = WriteBytes(buffer, byte(len(resp.AuthResponse)))
+		if err == nil {
+			_, err = buffer.Write(resp.AuthResponse)
+		}
+	default:
+		err = WriteNullTerminatedString(buffer, String(resp.AuthResponse))
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Capability&ClientConnectWithDB != 0 {
+		if err = WriteNullTerminatedString(buffer, resp.Database); err != nil {
+			return err
+		}
+	}
+	if resp.Capability&ClientPluginAuth != 0 {
+		if err = WriteNullTerminatedString(buffer, resp.AuthPlugin); err != nil {
+			return err
+		}
+	}
+	if resp.Capability&ClientConnectATTRS != 0 {
+		keys := make([]string, 0, len(resp.Attributes))
+		for key := range resp.Attributes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		attrs := new(bytes.Buffer)
+		for _, key := range keys {
+			WriteRLEString(attrs, key)
+			WriteRLEString(attrs, resp.Attributes[key])
+		}
+		if err = WriteRLEString(buffer, String(attrs.Bytes())); err != nil {
+			return err
+		}
+	}
+	if resp.Capability&ClientZstdCompressionAlgorithm != 0 {
+		if err = WriteBytes(buffer, resp.ZstdCompressionLevel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
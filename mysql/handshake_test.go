@@ -0,0 +1,74 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestHandshakeResponseRoundTrip(t *testing.T) {
+	base := ClientProtocol41 | ClientConnectWithDB | ClientPluginAuth | ClientConnectATTRS | ClientZstdCompressionAlgorithm
+	auth := []byte{1, 2, 3, 0, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	for _, caps := range []uint32{base | ClientPluginAuthLENENCClientData, base | ClientSecureConnection} {
+		resp := &HandshakeResponse{
+			Capability:    caps,
+			MaxPacketSize: 1 << 24,
+			Collation:     DefaultCollationID,
+			User:          "user1",
+			AuthResponse:  auth,
+			Database:      "db1",
+			AuthPlugin:    AuthNativePassword,
+			Attributes:    map[string]string{"_client_name": "libmysql", "_os": "Linux"},
+
+			ZstdCompressionLevel: 7,
+		}
+		buffer := new(bytes.Buffer)
+		assert.NilError(t, resp.Write(buffer))
+		decoded, err := ReadHandshakeResponse(buffer)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, decoded, resp)
+	}
+}
+
+func TestHandshakeResponseNullTerminatedAuth(t *testing.T) {
+	resp := &HandshakeResponse{
+		Capability:   ClientProtocol41,
+		Collation:    DefaultCollationID,
+		User:         "user1",
+		AuthResponse: []byte("secret"),
+	}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, resp.Write(buffer))
+	decoded, err := ReadHandshakeResponse(buffer)
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.User, "user1")
+	assert.Equal(t, string(decoded.AuthResponse), "secret")
+	assert.Equal(t, decoded.Database, "")
+}
+
+func TestSSLRequest(t *testing.T) {
+	resp := &HandshakeResponse{
+		Capability:    ClientProtocol41 | ClientSSL,
+		MaxPacketSize: 1 << 24,
+		Collation:     DefaultCollationID,
+	}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, resp.Write(buffer))
+	buffer.Truncate(SSLRequestLen)
+	assert.Assert(t, IsSSLRequest(buffer.Len()))
+	decoded, err := ReadHandshakeResponse(buffer)
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.Capability, resp.Capability)
+	assert.Equal(t, decoded.User, "")
+}
+
+func TestHandshakeResponse320(t *testing.T) {
+	data := []byte{byte(ClientConnectWithDB), 0, 0, 0, 1, 'u', 0, 'p', 'w', 0, 'd', 'b', 0}
+	decoded, err := ReadHandshakeResponse(bytes.NewBuffer(data))
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.MaxPacketSize, uint32(1<<16))
+	assert.Equal(t, decoded.User, "u")
+	assert.Equal(t, string(decoded.AuthResponse), "pw")
+	assert.Equal(t, decoded.Database, "db")
+}
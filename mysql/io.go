@@ -0,0 +1,123 @@
+package mysql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+)
+
+//Flusher writers buffering packets, flushed after each packet
+type Flusher interface {
+	Flush() error
+}
+
+//ErrPacketTooLarge read packet bigger than the max packet size
+var ErrPacketTooLarge = errors.New("Packet bigger than max packet size")
+
+//ReadPacket reads a packet joining the continuation frames of payloads of MaxPayloadLen or more,
+//checking and advancing the sequence. The body comes from the pool, maxPacketSize 0 is unlimited
+func ReadPacket(reader io.Reader, seq *byte, maxPacketSize int, bufferPool *util.BufferPool) (packet *Packet, err error) {
+	buffer := bufferPool.Get()
+	for {
+		len, err := readFrame(reader, seq, maxPacketSize, buffer)
+		if err != nil {
+			bufferPool.Return(buffer)
+			return nil, err
+		}
+		if len < MaxPayloadLen {
+			break
+		}
+	}
+	packet = NewPacket(func(p *Packet) {
+		p.Body = buffer
+	})
+	return packet, nil
+}
+
+//readFrame reads a single frame appending its payload to the buffer
+func readFrame(reader io.Reader, seq *byte, maxPacketSize int, buffer *bytes.Buffer) (len int, err error) {
+	var header [4]byte
+	_, err = io.ReadFull(reader, header[:])
+	if err != nil {
+		return 0, err
+	}
+	len = int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	if header[3] != *seq {
+		return 0, fmt.Errorf("invalid sequence %d != %d", header[3], *seq)
+	}
+	*seq++
+	if maxPacketSize > 0 && buffer.Len()+len > maxPacketSize {
+		return 0, ErrPacketTooLarge
+	}
+	buffer.Grow(len)
+	n, err := buffer.ReadFrom(io.LimitReader(reader, int64(len)))
+	if err == nil && n != int64(len) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Read failed. only %d bytes read while %d expected: %v", n, len, err)
+	}
+	return len, nil
+}
+
+//WritePacket writes a packet splitting payloads of MaxPayloadLen or more, advancing the sequence
+func WritePacket(writer io.Writer, seq *byte, p *Packet) (err error) {
+	const max = MaxPayloadLen
+	var header [4]byte
+
+	var body []byte
+	if p.Body != nil {
+		body = p.Body.Bytes()
+	}
+	len := len(body)
+	for len >= max {
+		header[0] = byte(0xff)
+		header[1] = byte(0xff)
+		header[2] = byte(0xff)
+		header[3] = *seq
+		err = write(writer, header[:])
+		if err != nil {
+			return err
+		}
+		err = write(writer, body[:max])
+		if err != nil {
+			return err
+		}
+		*seq++
+		len -= max
+		body = body[max:]
+	}
+	header[0] = byte(len)
+	header[1] = byte(len >> 8)
+	header[2] = byte(len >> 16)
+	header[3] = *seq
+	err = write(writer, header[:])
+	if err != nil {
+		return err
+	}
+	err = write(writer, body)
+	if err != nil {
+		return err
+	}
+	*seq++
+	if flusher, ok := writer.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func write(writer io.Writer, buff []byte) (err error) {
+	if len(buff) == 0 {
+		return nil
+	}
+	n, err := writer.Write(buff)
+	if err != nil {
+		return err
+	} else if n != len(buff) {
+		return fmt.Errorf("Write failed. only %v bytes written while %v expected", n, len(buff))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+	"gotest.tools/assert"
+)
+
+func TestReadWritePacketShortReads(t *testing.T) {
+	pool := util.NewBufferPool()
+	stream := new(bytes.Buffer)
+	var writeSeq byte
+	for _, size := range []int{0, 3, 1000, MaxPayloadLen, MaxPayloadLen + 7} {
+		body := bytes.Repeat([]byte{byte(size)}, size)
+		assert.NilError(t, WritePacket(stream, &writeSeq, NewPacket(func(p *Packet) {
+			p.Body = bytes.NewBuffer(body)
+		})))
+	}
+	reader := iotest.HalfReader(iotest.OneByteReader(stream))
+	var readSeq byte
+	for _, size := range []int{0, 3, 1000, MaxPayloadLen, MaxPayloadLen + 7} {
+		packet, err := ReadPacket(reader, &readSeq, 0, pool)
+		assert.NilError(t, err)
+		assert.Equal(t, packet.Len(), size)
+		assert.Assert(t, bytes.Equal(packet.Body.Bytes(), bytes.Repeat([]byte{byte(size)}, size)))
+		pool.Return(packet.Body)
+	}
+	assert.Equal(t, readSeq, writeSeq)
+}
+
+func TestReadPacketErrors(t *testing.T) {
+	pool := util.NewBufferPool()
+	var seq byte
+	_, err := ReadPacket(bytes.NewBuffer([]byte{1, 0, 0, 3, 'x'}), &seq, 0, pool)
+	assert.ErrorContains(t, err, "invalid sequence 3 != 0")
+	seq = 0
+	_, err = ReadPacket(bytes.NewBuffer([]byte{5, 0, 0, 0, 'x'}), &seq, 0, pool)
+	assert.ErrorContains(t, err, "only 1 bytes read while 5 expected")
+	seq = 0
+	_, err = ReadPacket(bytes.NewBuffer([]byte{5, 0, 0, 0, 1, 2, 3, 4, 5}), &seq, 4, pool)
+	assert.Equal(t, err, ErrPacketTooLarge)
+}
@@ -3,6 +3,7 @@ package mysql
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"reflect"
 	"unsafe"
 )
@@ -32,13 +33,45 @@ func NewPingPacket() *Packet {
 	})
 }
 
+//NewSimpleOKPacket creates a new OK Packet with no affected rows
+func NewSimpleOKPacket(status uint16) *Packet {
+	return NewOKPacket(&OKPacket{Status: status}, ClientProtocol41)
+}
+
+//NewOKPacket creates a new OK Packet for the capabilities
+func NewOKPacket(ok *OKPacket, capability uint32) *Packet {
+	return NewPacket(func(p *Packet) {
+		buffer := new(bytes.Buffer)
+		ok.Write(buffer, capability)
+		p.Body = buffer
+	})
+}
+
+//NewEOFPacket creates a new EOF Packet for the capabilities
+func NewEOFPacket(eof *EOFPacket, capability uint32) *Packet {
+	return NewPacket(func(p *Packet) {
+		buffer := new(bytes.Buffer)
+		eof.Write(buffer, capability)
+		p.Body = buffer
+	})
+}
+
 //NewSimpleErrPacket creates a new simple Error Packet
 func NewSimpleErrPacket(errorCode uint16, msg string) *Packet {
+	return NewErrPacket(errorCode, DefaultSQLState, msg)
+}
+
+//NewErrPacket creates a new Error Packet with SQLSTATE
+func NewErrPacket(errorCode uint16, sqlState string, msg string) *Packet {
+	return NewERRPacket(&ERRPacket{errorCode, sqlState, msg}, ClientProtocol41)
+}
+
+//NewERRPacket creates a new Error Packet for the capabilities
+func NewERRPacket(e *ERRPacket, capability uint32) *Packet {
 	return NewPacket(func(p *Packet) {
-		data := make([]byte, 3+len(msg))
-		data[0] = ERRHeader
-		//TODO: fields
-		p.Body = bytes.NewBuffer(data)
+		buffer := new(bytes.Buffer)
+		e.Write(buffer, capability)
+		p.Body = buffer
 	})
 }
 
@@ -254,11 +287,50 @@ func ReadRLEInt(buffer *bytes.Buffer) (num int64, null bool, err error) {
 		if err != nil {
 			return 0, false, err
 		}
-		return int64(b1) + int64(b2)<<8 + int64(b3)<<16 + int64(b4)<<24 + int64(b4)<<32 + int64(b5)<<40 + int64(b6)<<48 + int64(b7)<<56, false, nil
+		b8, err := buffer.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return int64(b1) + int64(b2)<<8 + int64(b3)<<16 + int64(b4)<<24 + int64(b5)<<32 + int64(b6)<<40 + int64(b7)<<48 + int64(b8)<<56, false, nil
 	}
 	return 0, false, fmt.Errorf("Wrong RLE Integer")
 }
 
+//ReadNullTerminatedString reads a nts from buffer, the terminator is optional at the end of the buffer
+func ReadNullTerminatedString(buffer *bytes.Buffer) (s string, err error) {
+	s, err = buffer.ReadString(0)
+	if err == io.EOF {
+		return s, nil
+	} else if err != nil {
+		return "", err
+	}
+	return s[:len(s)-1], nil
+}
+
+//ReadRLEBytes reads a length encoded byte slice from buffer
+func ReadRLEBytes(buffer *bytes.Buffer) (b []byte, err error) {
+	num, null, err := ReadRLEInt(buffer)
+	if err != nil {
+		return nil, err
+	} else if null {
+		return nil, nil
+	} else if num < 0 || int(num) > buffer.Len() {
+		return nil, fmt.Errorf("Wrong RLE length %d, only %d bytes left", num, buffer.Len())
+	}
+	b = make([]byte, num)
+	copy(b, buffer.Next(int(num)))
+	return b, nil
+}
+
+//ReadRLEString reads a length encoded string from buffer
+func ReadRLEString(buffer *bytes.Buffer) (s string, err error) {
+	b, err := ReadRLEBytes(buffer)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 //ReadFixedLengthString reads string from byte[]
 func ReadFixedLengthString(buff []byte, l int) string {
 	return String(buff[:Min(len(buff), l)])
@@ -291,10 +363,10 @@ func String(b []byte) (s string) {
 
 //packed integer
 const (
-	oneByte   byte = 0XFB
-	twoByte   byte = 0XFC
-	threeByte byte = 0XFD
-	eightByte byte = 0XFE
+	oneByte   byte = 0xFB
+	twoByte   byte = 0xFC
+	threeByte byte = 0xFD
+	eightByte byte = 0xFE
 )
 
 //MaxPayloadLen of packet
@@ -353,6 +425,8 @@ const (
 	ServerStatusMetadataChanged   uint16 = 0x0400
 	ServerStatusQueryWasLow       uint16 = 0x0800
 	ServerStatusPSOutParams       uint16 = 0x1000
+	ServerStatusInTransReadonly   uint16 = 0x2000
+	ServerSessionStateChanged     uint16 = 0x4000
 )
 
 //STMT Indicator
@@ -378,6 +452,45 @@ const (
 	DefaultCollationName       = "utf8_general_ci"
 )
 
+//SQLSTATE
+const (
+	DefaultSQLState = "HY000"
+)
+
+//ERRORS
+const (
+	ErrConCountError          uint16 = 1040
+	ErrDBAccessDeniedError    uint16 = 1044
+	ErrAccessDeniedError      uint16 = 1045
+	ErrNoDBError              uint16 = 1046
+	ErrUnknownComError        uint16 = 1047
+	ErrBadDBError             uint16 = 1049
+	ErrServerShutdown         uint16 = 1053
+	ErrParseError             uint16 = 1064
+	ErrUnknownError           uint16 = 1105
+	ErrHostIsBlocked          uint16 = 1129
+	ErrHostNotPrivileged      uint16 = 1130
+	ErrAbortingConnection     uint16 = 1152
+	ErrNetPacketTooLarge      uint16 = 1153
+	ErrNetReadError           uint16 = 1158
+	ErrNetReadInterrupted     uint16 = 1159
+	ErrNetErrorOnWrite        uint16 = 1160
+	ErrTooManyUserConnections uint16 = 1203
+	ErrLockWaitTimeout        uint16 = 1205
+	ErrWrongArguments         uint16 = 1210
+	ErrLockDeadlock           uint16 = 1213
+	ErrUnknownStmtHandler     uint16 = 1243
+	ErrUnsupportedPS          uint16 = 1295
+	ErrQueryInterrupted       uint16 = 1317
+	ErrStmtHasNoOpenCursor    uint16 = 1421
+	ErrReadOnlyTransaction    uint16 = 1792
+	ErrMalformedPacket        uint16 = 1835
+	CRConnectionError         uint16 = 2002
+	CRServerGoneError         uint16 = 2006
+	CRServerLost              uint16 = 2013
+	CRServerLostExtended      uint16 = 2055
+)
+
 //HEADER
 const (
 	OKHeader          byte = 0x00
@@ -385,9 +498,12 @@ const (
 	ERRHeader         byte = 0xff
 	EOFHeader         byte = 0xfe
 	LocalInfileHeader byte = 0xfb
+	AuthSwitchHeader  byte = 0xfe
 
-	CacheSHA2FastAuth byte = 0x03
-	CacheSHA2FullAuth byte = 0x04
+	SHA256RequestPublicKey    byte = 0x01
+	CacheSHA2RequestPublicKey byte = 0x02
+	CacheSHA2FastAuth         byte = 0x03
+	CacheSHA2FullAuth         byte = 0x04
 )
 
 //Client
@@ -414,6 +530,20 @@ const (
 	ClientPluginAuth
 	ClientConnectATTRS
 	ClientPluginAuthLENENCClientData
+	ClientCanHandleExpiredPasswords
+	ClientSessionTrack
+	ClientDeprecateEOF
+	ClientOptionalResultsetMetadata
+	ClientZstdCompressionAlgorithm
+)
+
+//COMPRESSION
+const (
+	CompressionZlib         = "zlib"
+	CompressionZstd         = "zstd"
+	CompressionUncompressed = "uncompressed"
+
+	DefaultZstdCompressionLevel = 3
 )
 
 //MYSQLTYPE
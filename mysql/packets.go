@@ -0,0 +1,203 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//OKPacket signals a successful command, also ends resultsets with CLIENT_DEPRECATE_EOF
+type OKPacket struct {
+	Header           byte // OKHeader, EOFHeader when ending a resultset
+	AffectedRows     uint64
+	LastInsertID     uint64
+	Status           uint16
+	Warnings         uint16
+	Info             string
+	SessionStateInfo []byte // with ServerSessionStateChanged
+}
+
+//ERRPacket signals an error
+type ERRPacket struct {
+	Code     uint16
+	SQLState string
+	Message  string
+}
+
+//EOFPacket ends column definitions and resultsets before CLIENT_DEPRECATE_EOF
+type EOFPacket struct {
+	Warnings uint16
+	Status   uint16
+}
+
+//Write encodes the OK packet for the capabilities
+func (ok *OKPacket) Write(buffer *bytes.Buffer, capability uint32) (err error) {
+	header := ok.Header
+	if header != EOFHeader {
+		header = OKHeader
+	}
+	WriteBytes(buffer, header)
+	WriteRLEInt(buffer, ok.AffectedRows)
+	WriteRLEInt(buffer, ok.LastInsertID)
+	if capability&ClientProtocol41 != 0 {
+		WriteInt2(buffer, ok.Status)
+		WriteInt2(buffer, ok.Warnings)
+	} else if capability&ClientTransactions != 0 {
+		WriteInt2(buffer, ok.Status)
+	}
+	if capability&ClientSessionTrack != 0 {
+		if ok.Info != "" || ok.Status&ServerSessionStateChanged != 0 {
+			WriteRLEString(buffer, ok.Info)
+		}
+		if ok.Status&ServerSessionStateChanged != 0 {
+			return WriteRLEString(buffer, String(ok.SessionStateInfo))
+		}
+		return nil
+	}
+	return WriteFixedLengthString(buffer, ok.Info)
+}
+
+//ReadOKPacket decodes an OK packet for the capabilities
+func ReadOKPacket(buffer *bytes.Buffer, capability uint32) (ok *OKPacket, err error) {
+	ok = &OKPacket{}
+	ok.Header, err = buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if ok.Header != OKHeader && ok.Header != EOFHeader {
+		return nil, fmt.Errorf("Wrong OK packet header %x", ok.Header)
+	}
+	affectedRows, _, err := ReadRLEInt(buffer)
+	if err != nil {
+		return nil, err
+	}
+	ok.AffectedRows = uint64(affectedRows)
+	lastInsertID, _, err := ReadRLEInt(buffer)
+	if err != nil {
+		return nil, err
+	}
+	ok.LastInsertID = uint64(lastInsertID)
+	if capability&(ClientProtocol41|ClientTransactions) != 0 {
+		ok.Status, err = ReadInt2(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if capability&ClientProtocol41 != 0 {
+		ok.Warnings, err = ReadInt2(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if capability&ClientSessionTrack == 0 {
+		ok.Info = buffer.String()
+		return ok, nil
+	}
+	if buffer.Len() > 0 {
+		ok.Info, err = ReadRLEString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ok.Status&ServerSessionStateChanged != 0 && buffer.Len() > 0 {
+		ok.SessionStateInfo, err = ReadRLEBytes(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ok, nil
+}
+
+//Write encodes the ERR packet for the capabilities
+func (e *ERRPacket) Write(buffer *bytes.Buffer, capability uint32) (err error) {
+	WriteBytes(buffer, ERRHeader)
+	WriteInt2(buffer, e.Code)
+	if capability&ClientProtocol41 != 0 {
+		WriteBytes(buffer, '#')
+		WriteFixedLengthString(buffer, (e.SQLState + DefaultSQLState)[:5])
+	}
+	return WriteFixedLengthString(buffer, e.Message)
+}
+
+//ReadERRPacket decodes an ERR packet for the capabilities
+func ReadERRPacket(buffer *bytes.Buffer, capability uint32) (e *ERRPacket, err error) {
+	header, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if header != ERRHeader {
+		return nil, fmt.Errorf("Wrong ERR packet header %x", header)
+	}
+	e = &ERRPacket{}
+	e.Code, err = ReadInt2(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if capability&ClientProtocol41 != 0 && buffer.Len() >= 6 && buffer.Bytes()[0] == '#' {
+		buffer.Next(1)
+		e.SQLState = string(buffer.Next(5))
+	}
+	e.Message = buffer.String()
+	return e, nil
+}
+
+//Write encodes the EOF packet for the capabilities, an OK packet with EOF header with CLIENT_DEPRECATE_EOF
+func (eof *EOFPacket) Write(buffer *bytes.Buffer, capability uint32) (err error) {
+	if capability&ClientDeprecateEOF != 0 {
+		ok := &OKPacket{Header: EOFHeader, Status: eof.Status, Warnings: eof.Warnings}
+		return ok.Write(buffer, capability)
+	}
+	WriteBytes(buffer, EOFHeader)
+	if capability&ClientProtocol41 != 0 {
+		WriteInt2(buffer, eof.Warnings)
+		return WriteInt2(buffer, eof.Status)
+	}
+	return nil
+}
+
+//ReadEOFPacket decodes an EOF packet for the capabilities
+func ReadEOFPacket(buffer *bytes.Buffer, capability uint32) (eof *EOFPacket, err error) {
+	if capability&ClientDeprecateEOF != 0 {
+		ok, err := ReadOKPacket(buffer, capability)
+		if err != nil {
+			return nil, err
+		}
+		return &EOFPacket{Warnings: ok.Warnings, Status: ok.Status}, nil
+	}
+	header, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if header != EOFHeader {
+		return nil, fmt.Errorf("Wrong EOF packet header %x", header)
+	}
+	eof = &EOFPacket{}
+	if capability&ClientProtocol41 != 0 {
+		eof.Warnings, err = ReadInt2(buffer)
+		if err != nil {
+			return nil, err
+		}
+		eof.Status, err = ReadInt2(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return eof, nil
+}
+
+//IsEOFPacket checks if the body is an EOF packet, or an OK packet ending a resultset with CLIENT_DEPRECATE_EOF
+func IsEOFPacket(body []byte, capability uint32) bool {
+	if len(body) == 0 || body[0] != EOFHeader {
+		return false
+	}
+	if capability&ClientDeprecateEOF != 0 {
+		return len(body) < MaxPayloadLen
+	}
+	return len(body) < 9
+}
+
+//IsERRPacket checks if the body is an ERR packet
+func IsERRPacket(body []byte) bool {
+	return len(body) > 0 && body[0] == ERRHeader
+}
+
+//IsOKPacket checks if the body is an OK packet
+func IsOKPacket(body []byte) bool {
+	return len(body) >= 7 && body[0] == OKHeader
+}
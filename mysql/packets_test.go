@@ -0,0 +1,110 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOKPacket(t *testing.T) {
+	capabilities := []uint32{
+		0,
+		ClientTransactions,
+		ClientProtocol41,
+		ClientProtocol41 | ClientSessionTrack,
+	}
+	for _, capability := range capabilities {
+		for _, ok := range []*OKPacket{
+			{Header: OKHeader},
+			{Header: OKHeader, AffectedRows: 300, LastInsertID: 1 << 20, Status: ServerStatusAutocommit, Warnings: 2, Info: "Rows matched: 1"},
+			{Header: EOFHeader, Status: ServerStatusInTrans},
+			{Header: OKHeader, Status: ServerSessionStateChanged, SessionStateInfo: []byte{0, 4, 3, 'd', 'b', '1'}},
+		} {
+			buffer := new(bytes.Buffer)
+			assert.NilError(t, ok.Write(buffer, capability))
+			decoded, err := ReadOKPacket(buffer, capability)
+			assert.NilError(t, err)
+			assert.Equal(t, decoded.Header, ok.Header)
+			assert.Equal(t, decoded.AffectedRows, ok.AffectedRows)
+			assert.Equal(t, decoded.LastInsertID, ok.LastInsertID)
+			if capability&(ClientProtocol41|ClientTransactions) != 0 {
+				assert.Equal(t, decoded.Status, ok.Status)
+			}
+			if capability&ClientProtocol41 != 0 {
+				assert.Equal(t, decoded.Warnings, ok.Warnings)
+			}
+			assert.Equal(t, decoded.Info, ok.Info)
+			if capability&ClientSessionTrack != 0 {
+				assert.Assert(t, bytes.Equal(decoded.SessionStateInfo, ok.SessionStateInfo))
+			}
+		}
+	}
+}
+
+func TestOKPacketBytes(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	ok := &OKPacket{AffectedRows: 1, Status: ServerStatusAutocommit}
+	assert.NilError(t, ok.Write(buffer, ClientProtocol41))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0x00, 1, 0, 2, 0, 0, 0})
+	assert.Assert(t, IsOKPacket(buffer.Bytes()))
+	buffer.Reset()
+	assert.NilError(t, ok.Write(buffer, 0))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0x00, 1, 0})
+	_, err := ReadOKPacket(bytes.NewBuffer([]byte{0x01, 0, 0}), 0)
+	assert.ErrorContains(t, err, "Wrong OK packet header")
+}
+
+func TestERRPacket(t *testing.T) {
+	e := &ERRPacket{Code: ErrAccessDeniedError, SQLState: "28000", Message: "Access denied"}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, e.Write(buffer, ClientProtocol41))
+	assert.DeepEqual(t, buffer.Bytes(), append([]byte{0xff, 0x15, 0x04, '#', '2', '8', '0', '0', '0'}, "Access denied"...))
+	assert.Assert(t, IsERRPacket(buffer.Bytes()))
+	decoded, err := ReadERRPacket(buffer, ClientProtocol41)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, e)
+
+	buffer.Reset()
+	assert.NilError(t, e.Write(buffer, 0))
+	assert.DeepEqual(t, buffer.Bytes(), append([]byte{0xff, 0x15, 0x04}, "Access denied"...))
+	decoded, err = ReadERRPacket(buffer, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, &ERRPacket{Code: ErrAccessDeniedError, Message: "Access denied"})
+	assert.Equal(t, decoded.ToError().Error(), "Error 1045 (HY000): Access denied")
+
+	//default state
+	buffer.Reset()
+	assert.NilError(t, (&ERRPacket{Code: 1105, Message: "x"}).Write(buffer, ClientProtocol41))
+	decoded, err = ReadERRPacket(buffer, ClientProtocol41)
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.SQLState, DefaultSQLState)
+}
+
+func TestEOFPacket(t *testing.T) {
+	eof := &EOFPacket{Warnings: 1, Status: ServerStatusAutocommit}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, eof.Write(buffer, ClientProtocol41))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0xfe, 1, 0, 2, 0})
+	assert.Assert(t, IsEOFPacket(buffer.Bytes(), ClientProtocol41))
+	decoded, err := ReadEOFPacket(buffer, ClientProtocol41)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, eof)
+
+	buffer.Reset()
+	assert.NilError(t, eof.Write(buffer, 0))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0xfe})
+	decoded, err = ReadEOFPacket(buffer, 0)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, &EOFPacket{})
+
+	//OK packet with EOF header
+	capability := ClientProtocol41 | ClientDeprecateEOF
+	buffer.Reset()
+	assert.NilError(t, eof.Write(buffer, capability))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0xfe, 0, 0, 2, 0, 1, 0})
+	assert.Assert(t, IsEOFPacket(buffer.Bytes(), capability))
+	decoded, err = ReadEOFPacket(buffer, capability)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, eof)
+}
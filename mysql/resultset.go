@@ -0,0 +1,264 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+//DefaultCatalog catalog of the column definitions
+const DefaultCatalog = "def"
+
+//TimeFormat text protocol format of DATETIME and TIMESTAMP values
+const TimeFormat = "2006-01-02 15:04:05.999999"
+
+//Field column definition of a resultset, ColumnDefinition41
+type Field struct {
+	Catalog  string
+	Schema   string
+	Table    string
+	OrgTable string
+	Name     string
+	OrgName  string
+	Charset  uint16 // collation id
+	Length   uint32 // max column length
+	Type     byte   // MYSQLType*
+	Flags    uint16 // *Flag
+	Decimals byte
+}
+
+//NewField creates a field of the type named name, with the default collation
+func NewField(name string, fieldType byte) *Field {
+	return &Field{
+		Catalog: DefaultCatalog,
+		Name:    name,
+		OrgName: name,
+		Charset: uint16(DefaultCollationID),
+		Type:    fieldType,
+	}
+}
+
+//Write encodes the ColumnDefinition41
+func (field *Field) Write(buffer *bytes.Buffer) (err error) {
+	catalog := field.Catalog
+	if catalog == "" {
+		catalog = DefaultCatalog
+	}
+	WriteRLEString(buffer, catalog)
+	WriteRLEString(buffer, field.Schema)
+	WriteRLEString(buffer, field.Table)
+	WriteRLEString(buffer, field.OrgTable)
+	WriteRLEString(buffer, field.Name)
+	WriteRLEString(buffer, field.OrgName)
+	//length of fixed length fields
+	WriteRLEInt(buffer, 0x0c)
+	WriteInt2(buffer, field.Charset)
+	WriteInt4(buffer, field.Length)
+	WriteBytes(buffer, field.Type)
+	WriteInt2(buffer, field.Flags)
+	WriteBytes(buffer, field.Decimals)
+	//filler
+	return WriteBytes(buffer, 0, 0)
+}
+
+//ReadField decodes a ColumnDefinition41
+func ReadField(buffer *bytes.Buffer) (field *Field, err error) {
+	field = &Field{}
+	for _, s := range []*string{&field.Catalog, &field.Schema, &field.Table, &field.OrgTable, &field.Name, &field.OrgName} {
+		*s, err = ReadRLEString(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fixedLen, _, err := ReadRLEInt(buffer)
+	if err != nil {
+		return nil, err
+	} else if fixedLen < 0x0a || int(fixedLen) > buffer.Len() {
+		return nil, fmt.Errorf("Wrong column definition length %d", fixedLen)
+	}
+	fixed := buffer.Next(int(fixedLen))
+	field.Charset = uint16(fixed[0]) | uint16(fixed[1])<<8
+	field.Length = uint32(fixed[2]) | uint32(fixed[3])<<8 | uint32(fixed[4])<<16 | uint32(fixed[5])<<24
+	field.Type = fixed[6]
+	field.Flags = uint16(fixed[7]) | uint16(fixed[8])<<8
+	field.Decimals = fixed[9]
+	return field, nil
+}
+
+//Resultset writes a text protocol resultset: column count, column definitions, rows and the final EOF,
+//column definitions are not followed by EOF with CLIENT_DEPRECATE_EOF
+type Resultset struct {
+	writer     io.Writer
+	seq        *byte
+	capability uint32
+	fields     []*Field
+	buffer     bytes.Buffer
+}
+
+//NewResultset creates a resultset writer for the client capabilities
+func NewResultset(writer io.Writer, seq *byte, capability uint32, fields []*Field) *Resultset {
+	return &Resultset{
+		writer:     writer,
+		seq:        seq,
+		capability: capability,
+		fields:     fields,
+	}
+}
+
+//WriteFields writes the column count and the column definitions, followed by EOF with the status
+func (rs *Resultset) WriteFields(status uint16) (err error) {
+	rs.buffer.Reset()
+	WriteRLEInt(&rs.buffer, uint64(len(rs.fields)))
+	err = rs.writePacket()
+	if err != nil {
+		return err
+	}
+	for _, field := range rs.fields {
+		rs.buffer.Reset()
+		field.Write(&rs.buffer)
+		err = rs.writePacket()
+		if err != nil {
+			return err
+		}
+	}
+	if rs.capability&ClientDeprecateEOF != 0 {
+		return nil
+	}
+	rs.buffer.Reset()
+	(&EOFPacket{Status: status}).Write(&rs.buffer, rs.capability)
+	return rs.writePacket()
+}
+
+//WriteRow writes a text row, a value per field
+func (rs *Resultset) WriteRow(values ...interface{}) (err error) {
+	if len(values) != len(rs.fields) {
+		return fmt.Errorf("Row of %d values for %d fields", len(values), len(rs.fields))
+	}
+	rs.buffer.Reset()
+	for _, value := range values {
+		err = WriteTextValue(&rs.buffer, value)
+		if err != nil {
+			return err
+		}
+	}
+	return rs.writePacket()
+}
+
+//WriteBinaryRow writes a binary protocol row, a value per field
+func (rs *Resultset) WriteBinaryRow(values ...interface{}) (err error) {
+	rs.buffer.Reset()
+	err = WriteBinaryRow(&rs.buffer, rs.fields, values)
+	if err != nil {
+		return err
+	}
+	return rs.writePacket()
+}
+
+//WriteEnd ends the resultset with the status, ServerStatusMoreResultsExists if another resultset follows
+func (rs *Resultset) WriteEnd(status uint16, warnings uint16) (err error) {
+	rs.buffer.Reset()
+	(&EOFPacket{Warnings: warnings, Status: status}).Write(&rs.buffer, rs.capability)
+	return rs.writePacket()
+}
+
+func (rs *Resultset) writePacket() error {
+	return WritePacket(rs.writer, rs.seq, NewPacket(func(p *Packet) {
+		p.Body = &rs.buffer
+	}))
+}
+
+//WriteResultset writes a whole text resultset
+func WriteResultset(writer io.Writer, seq *byte, capability uint32, status uint16, fields []*Field, rows [][]interface{}) (err error) {
+	rs := NewResultset(writer, seq, capability, fields)
+	err = rs.WriteFields(status)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		err = rs.WriteRow(row...)
+		if err != nil {
+			return err
+		}
+	}
+	return rs.WriteEnd(status, 0)
+}
+
+//WriteTextValue writes a value of a text row, nil is NULL
+func WriteTextValue(buffer *bytes.Buffer, value interface{}) (err error) {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return WriteRLEIntNUL(buffer)
+	case []byte:
+		if v == nil {
+			return WriteRLEIntNUL(buffer)
+		}
+		data = v
+	case string:
+		return WriteRLEString(buffer, v)
+	case int:
+		data = strconv.AppendInt(nil, int64(v), 10)
+	case int8:
+		data = strconv.AppendInt(nil, int64(v), 10)
+	case int16:
+		data = strconv.AppendInt(nil, int64(v), 10)
+	case int32:
+		data = strconv.AppendInt(nil, int64(v), 10)
+	case int64:
+		data = strconv.AppendInt(nil, v, 10)
+	case uint:
+		data = strconv.AppendUint(nil, uint64(v), 10)
+	case uint8:
+		data = strconv.AppendUint(nil, uint64(v), 10)
+	case uint16:
+		data = strconv.AppendUint(nil, uint64(v), 10)
+	case uint32:
+		data = strconv.AppendUint(nil, uint64(v), 10)
+	case uint64:
+		data = strconv.AppendUint(nil, v, 10)
+	case float32:
+		data = strconv.AppendFloat(nil, float64(v), 'g', -1, 32)
+	case float64:
+		data = strconv.AppendFloat(nil, v, 'g', -1, 64)
+	case bool:
+		data = []byte{'0'}
+		if v {
+			data[0] = '1'
+		}
+	case time.Time:
+		data = []byte(v.Format(TimeFormat))
+	case time.Duration:
+		data = []byte(FormatDuration(v))
+	case fmt.Stringer:
+		return WriteRLEString(buffer, v.String())
+	default:
+		return fmt.Errorf("Unsupported value type %T", value)
+	}
+	err = WriteRLEInt(buffer, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = buffer.Write(data)
+	return err
+}
+
+//FormatDuration formats a TIME value, [-]hh:mm:ss[.ffffff]
+func FormatDuration(d time.Duration) string {
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	hours := d / time.Hour
+	d -= hours * time.Hour
+	minutes := d / time.Minute
+	d -= minutes * time.Minute
+	seconds := d / time.Second
+	micros := (d - seconds*time.Second) / time.Microsecond
+	if micros == 0 {
+		return fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minutes, seconds)
+	}
+	return fmt.Sprintf("%s%02d:%02d:%02d.%06d", sign, hours, minutes, seconds, micros)
+}
@@ -0,0 +1,118 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	util "github.com/rafalopez79/godriver/internal/util"
+	"gotest.tools/assert"
+)
+
+func TestField(t *testing.T) {
+	field := &Field{
+		Catalog:  DefaultCatalog,
+		Schema:   "db1",
+		Table:    "t",
+		OrgTable: "table1",
+		Name:     "c",
+		OrgName:  "column1",
+		Charset:  uint16(DefaultCollationID),
+		Length:   255,
+		Type:     MYSQLTypeVarString,
+		Flags:    NotNullFlag | PriKeyFlag,
+		Decimals: 0,
+	}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, field.Write(buffer))
+	expected := []byte{3, 'd', 'e', 'f', 3, 'd', 'b', '1', 1, 't', 6, 't', 'a', 'b', 'l', 'e', '1', 1, 'c', 7, 'c', 'o', 'l', 'u', 'm', 'n', '1',
+		0x0c, 33, 0, 255, 0, 0, 0, MYSQLTypeVarString, 3, 0, 0, 0, 0}
+	assert.DeepEqual(t, buffer.Bytes(), expected)
+	decoded, err := ReadField(buffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, field)
+
+	_, err = ReadField(bytes.NewBuffer([]byte{0, 0, 0, 0, 0, 0, 0x0c, 1}))
+	assert.ErrorContains(t, err, "Wrong column definition length")
+}
+
+func TestWriteTextValue(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xfb}},
+		{[]byte(nil), []byte{0xfb}},
+		{[]byte{}, []byte{0}},
+		{"abc", []byte{3, 'a', 'b', 'c'}},
+		{-12, []byte{3, '-', '1', '2'}},
+		{uint64(18446744073709551615), append([]byte{20}, "18446744073709551615"...)},
+		{1.5, []byte{3, '1', '.', '5'}},
+		{float32(0.1), []byte{3, '0', '.', '1'}},
+		{true, []byte{1, '1'}},
+		{time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC), append([]byte{26}, "2020-01-02 03:04:05.000006"...)},
+		{time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), append([]byte{19}, "2020-01-02 03:04:05"...)},
+		{-(26*time.Hour + 3*time.Minute + 4*time.Second + 5*time.Microsecond), append([]byte{16}, "-26:03:04.000005"...)},
+	} {
+		buffer := new(bytes.Buffer)
+		assert.NilError(t, WriteTextValue(buffer, tc.value))
+		assert.DeepEqual(t, buffer.Bytes(), tc.expected)
+	}
+	assert.ErrorContains(t, WriteTextValue(new(bytes.Buffer), struct{}{}), "Unsupported value type")
+}
+
+func readResultsetPackets(t *testing.T, stream *bytes.Buffer) [][]byte {
+	pool := util.NewBufferPool()
+	var seq byte
+	var packets [][]byte
+	for stream.Len() > 0 {
+		packet, err := ReadPacket(stream, &seq, 0, pool)
+		assert.NilError(t, err)
+		packets = append(packets, packet.Body.Bytes())
+	}
+	return packets
+}
+
+func TestResultset(t *testing.T) {
+	fields := []*Field{NewField("@@version", MYSQLTypeVarString), NewField("id", MYSQLTypeLongLong)}
+	rows := [][]interface{}{{"5.7.0", 1}, {nil, int64(2)}}
+
+	stream := new(bytes.Buffer)
+	var seq byte = 1
+	assert.NilError(t, WriteResultset(stream, &seq, ClientProtocol41, ServerStatusAutocommit, fields, rows))
+	assert.Equal(t, seq, byte(8))
+	packets := readResultsetPackets(t, bytes.NewBuffer(append([]byte{0, 0, 0, 0}, stream.Bytes()...)))
+	packets = packets[1:]
+	assert.Equal(t, len(packets), 7)
+	assert.DeepEqual(t, packets[0], []byte{2})
+	field, err := ReadField(bytes.NewBuffer(packets[1]))
+	assert.NilError(t, err)
+	assert.DeepEqual(t, field, fields[0])
+	assert.Assert(t, IsEOFPacket(packets[3], ClientProtocol41))
+	assert.DeepEqual(t, packets[4], []byte{5, '5', '.', '7', '.', '0', 1, '1'})
+	assert.DeepEqual(t, packets[5], []byte{0xfb, 1, '2'})
+	assert.DeepEqual(t, packets[6], []byte{0xfe, 0, 0, 2, 0})
+
+	//no EOF after the column definitions, OK with EOF header at the end
+	capability := ClientProtocol41 | ClientDeprecateEOF
+	stream.Reset()
+	seq = 1
+	assert.NilError(t, WriteResultset(stream, &seq, capability, ServerStatusAutocommit, fields, rows))
+	packets = readResultsetPackets(t, bytes.NewBuffer(append([]byte{0, 0, 0, 0}, stream.Bytes()...)))
+	packets = packets[1:]
+	assert.Equal(t, len(packets), 6)
+	assert.DeepEqual(t, packets[3], []byte{5, '5', '.', '7', '.', '0', 1, '1'})
+	assert.DeepEqual(t, packets[5], []byte{0xfe, 0, 0, 2, 0, 0, 0})
+	eof, err := ReadEOFPacket(bytes.NewBuffer(packets[5]), capability)
+	assert.NilError(t, err)
+	assert.Equal(t, eof.Status, ServerStatusAutocommit)
+
+	rs := NewResultset(stream, &seq, capability, fields)
+	assert.ErrorContains(t, rs.WriteRow(1), "Row of 1 values for 2 fields")
+
+	stream.Reset()
+	seq = 0
+	assert.NilError(t, rs.WriteBinaryRow("5.7.0", 1))
+	packets = readResultsetPackets(t, stream)
+	assert.DeepEqual(t, packets[0], []byte{0x00, 0x00, 5, '5', '.', '7', '.', '0', 1, 0, 0, 0, 0, 0, 0, 0})
+}
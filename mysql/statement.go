@@ -0,0 +1,271 @@
+package mysql
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+//ParamUnsignedFlag of the parameter types of COM_STMT_EXECUTE
+const ParamUnsignedFlag uint16 = 0x8000
+
+//CURSOR TYPE flags of COM_STMT_EXECUTE
+const (
+	CursorTypeNoCursor   byte = 0x00
+	CursorTypeReadOnly   byte = 0x01
+	CursorTypeForUpdate  byte = 0x02
+	CursorTypeScrollable byte = 0x04
+)
+
+//StmtPrepareOK response of COM_STMT_PREPARE, followed by the param and column definitions
+type StmtPrepareOK struct {
+	StatementID uint32
+	ColumnCount uint16
+	ParamCount  uint16
+	Warnings    uint16
+}
+
+//StmtExecute request of COM_STMT_EXECUTE
+type StmtExecute struct {
+	StatementID    uint32
+	Flags          byte // CursorType*
+	IterationCount uint32
+	NewParamsBound bool
+	ParamTypes     []uint16 // MYSQLType* | ParamUnsignedFlag
+	Params         []interface{}
+}
+
+//StmtFetch request of COM_STMT_FETCH
+type StmtFetch struct {
+	StatementID uint32
+	NumRows     uint32
+}
+
+//StmtSendLongData request of COM_STMT_SEND_LONG_DATA
+type StmtSendLongData struct {
+	StatementID uint32
+	ParamID     uint16
+	Data        []byte
+}
+
+//Write encodes the COM_STMT_PREPARE response
+func (ok *StmtPrepareOK) Write(buffer *bytes.Buffer) (err error) {
+	WriteBytes(buffer, OKHeader)
+	WriteInt4(buffer, ok.StatementID)
+	WriteInt2(buffer, ok.ColumnCount)
+	WriteInt2(buffer, ok.ParamCount)
+	//reserved
+	WriteBytes(buffer, 0)
+	return WriteInt2(buffer, ok.Warnings)
+}
+
+//ReadStmtPrepareOK decodes the COM_STMT_PREPARE response
+func ReadStmtPrepareOK(buffer *bytes.Buffer) (ok *StmtPrepareOK, err error) {
+	header, err := buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	} else if header != OKHeader {
+		return nil, fmt.Errorf("Wrong prepare OK header %x", header)
+	}
+	ok = &StmtPrepareOK{}
+	ok.StatementID, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	ok.ColumnCount, err = ReadInt2(buffer)
+	if err != nil {
+		return nil, err
+	}
+	ok.ParamCount, err = ReadInt2(buffer)
+	if err != nil {
+		return nil, err
+	}
+	//reserved, warnings missing in old servers
+	if buffer.Len() >= 3 {
+		buffer.Next(1)
+		ok.Warnings, err = ReadInt2(buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ok, nil
+}
+
+//Write encodes the COM_STMT_EXECUTE command, with the types of the params if ParamTypes is nil
+func (execute *StmtExecute) Write(buffer *bytes.Buffer) (err error) {
+	WriteBytes(buffer, ComSTMTExecute)
+	WriteInt4(buffer, execute.StatementID)
+	WriteBytes(buffer, execute.Flags)
+	iterationCount := execute.IterationCount
+	if iterationCount == 0 {
+		iterationCount = 1
+	}
+	WriteInt4(buffer, iterationCount)
+	if len(execute.Params) == 0 {
+		return nil
+	}
+	bitmap := make([]byte, NullBitmapLen(len(execute.Params), 0))
+	for i, param := range execute.Params {
+		if IsNull(param) {
+			bitmap[i/8] |= 1 << uint(i%8)
+		}
+	}
+	buffer.Write(bitmap)
+	paramTypes := execute.ParamTypes
+	if paramTypes == nil {
+		paramTypes = make([]uint16, len(execute.Params))
+		for i, param := range execute.Params {
+			paramTypes[i] = BinaryParamType(param)
+		}
+	} else if len(paramTypes) != len(execute.Params) {
+		return fmt.Errorf("%d param types for %d params", len(paramTypes), len(execute.Params))
+	}
+	if execute.NewParamsBound {
+		WriteBytes(buffer, 1)
+		for _, paramType := range paramTypes {
+			WriteInt2(buffer, paramType)
+		}
+	} else {
+		WriteBytes(buffer, 0)
+	}
+	for i, param := range execute.Params {
+		if IsNull(param) {
+			continue
+		}
+		err = WriteBinaryValue(buffer, byte(paramTypes[i]), param)
+		if err != nil {
+			return fmt.Errorf("Param %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+//ReadStmtExecute decodes the COM_STMT_EXECUTE payload after the command byte, for a statement of paramCount
+//params with the types bound by its previous execution and the params sent as long data
+func ReadStmtExecute(buffer *bytes.Buffer, paramCount int, paramTypes []uint16, longData map[uint16][]byte) (execute *StmtExecute, err error) {
+	execute = &StmtExecute{}
+	execute.StatementID, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	execute.Flags, err = buffer.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	execute.IterationCount, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	if paramCount == 0 {
+		return execute, nil
+	}
+	bitmapLen := NullBitmapLen(paramCount, 0)
+	if buffer.Len() < bitmapLen+1 {
+		return nil, fmt.Errorf("Short NULL bitmap")
+	}
+	bitmap := buffer.Next(bitmapLen)
+	newParamsBound, _ := buffer.ReadByte()
+	execute.NewParamsBound = newParamsBound == 1
+	if execute.NewParamsBound {
+		paramTypes = make([]uint16, paramCount)
+		for i := range paramTypes {
+			paramTypes[i], err = ReadInt2(buffer)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else if len(paramTypes) != paramCount {
+		return nil, fmt.Errorf("Missing param types")
+	}
+	execute.ParamTypes = paramTypes
+	execute.Params = make([]interface{}, paramCount)
+	for i, paramType := range paramTypes {
+		if data, ok := longData[uint16(i)]; ok {
+			execute.Params[i] = data
+			continue
+		}
+		if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			continue
+		}
+		execute.Params[i], err = ReadBinaryValue(buffer, byte(paramType), paramType&ParamUnsignedFlag != 0)
+		if err != nil {
+			return nil, fmt.Errorf("Param %d: %v", i, err)
+		}
+	}
+	return execute, nil
+}
+
+//Write encodes the COM_STMT_FETCH command
+func (fetch *StmtFetch) Write(buffer *bytes.Buffer) (err error) {
+	WriteBytes(buffer, ComSTMTFetch)
+	WriteInt4(buffer, fetch.StatementID)
+	return WriteInt4(buffer, fetch.NumRows)
+}
+
+//ReadStmtFetch decodes the COM_STMT_FETCH payload after the command byte
+func ReadStmtFetch(buffer *bytes.Buffer) (fetch *StmtFetch, err error) {
+	fetch = &StmtFetch{}
+	fetch.StatementID, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	fetch.NumRows, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return fetch, nil
+}
+
+//Write encodes the COM_STMT_SEND_LONG_DATA command
+func (longData *StmtSendLongData) Write(buffer *bytes.Buffer) (err error) {
+	WriteBytes(buffer, ComSTMTSendLongData)
+	WriteInt4(buffer, longData.StatementID)
+	WriteInt2(buffer, longData.ParamID)
+	_, err = buffer.Write(longData.Data)
+	return err
+}
+
+//ReadStmtSendLongData decodes the COM_STMT_SEND_LONG_DATA payload after the command byte
+func ReadStmtSendLongData(buffer *bytes.Buffer) (longData *StmtSendLongData, err error) {
+	longData = &StmtSendLongData{}
+	longData.StatementID, err = ReadInt4(buffer)
+	if err != nil {
+		return nil, err
+	}
+	longData.ParamID, err = ReadInt2(buffer)
+	if err != nil {
+		return nil, err
+	}
+	longData.Data = append([]byte(nil), buffer.Bytes()...)
+	buffer.Reset()
+	return longData, nil
+}
+
+//BinaryParamType returns the param type sending the value in COM_STMT_EXECUTE
+func BinaryParamType(value interface{}) uint16 {
+	switch value.(type) {
+	case nil:
+		return uint16(MYSQLTypeNull)
+	case int, int8, int16, int32, int64:
+		return uint16(MYSQLTypeLongLong)
+	case uint, uint8, uint16, uint32, uint64:
+		return uint16(MYSQLTypeLongLong) | ParamUnsignedFlag
+	case bool:
+		return uint16(MYSQLTypeTiny)
+	case float32:
+		return uint16(MYSQLTypeFloat)
+	case float64:
+		return uint16(MYSQLTypeDouble)
+	case time.Time:
+		return uint16(MYSQLTypeDateTime)
+	case time.Duration:
+		return uint16(MYSQLTypeTime)
+	case []byte:
+		if IsNull(value) {
+			return uint16(MYSQLTypeNull)
+		}
+		return uint16(MYSQLTypeBlob)
+	default:
+		return uint16(MYSQLTypeVarString)
+	}
+}
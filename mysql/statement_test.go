@@ -0,0 +1,73 @@
+package mysql
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestStmtPrepareOK(t *testing.T) {
+	ok := &StmtPrepareOK{StatementID: 7, ColumnCount: 2, ParamCount: 3, Warnings: 1}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, ok.Write(buffer))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{0, 7, 0, 0, 0, 2, 0, 3, 0, 0, 1, 0})
+	decoded, err := ReadStmtPrepareOK(buffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, decoded, ok)
+}
+
+func TestStmtExecute(t *testing.T) {
+	params := []interface{}{int64(-1), uint64(1), nil, 1.5, []byte("abc"), time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), time.Second}
+	execute := &StmtExecute{StatementID: 1, Flags: CursorTypeReadOnly, NewParamsBound: true, Params: params}
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, execute.Write(buffer))
+	command, _ := buffer.ReadByte()
+	assert.Equal(t, command, byte(ComSTMTExecute))
+	decoded, err := ReadStmtExecute(buffer, len(params), nil, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, decoded.StatementID, uint32(1))
+	assert.Equal(t, decoded.Flags, CursorTypeReadOnly)
+	assert.Equal(t, decoded.IterationCount, uint32(1))
+	assert.Assert(t, decoded.NewParamsBound)
+	assert.DeepEqual(t, decoded.ParamTypes, []uint16{
+		uint16(MYSQLTypeLongLong), uint16(MYSQLTypeLongLong) | ParamUnsignedFlag, uint16(MYSQLTypeNull),
+		uint16(MYSQLTypeDouble), uint16(MYSQLTypeBlob), uint16(MYSQLTypeDateTime), uint16(MYSQLTypeTime),
+	})
+	assert.DeepEqual(t, decoded.Params, params)
+
+	//previous types and long data
+	execute = &StmtExecute{StatementID: 1, ParamTypes: decoded.ParamTypes[:2], Params: []interface{}{int64(5), nil}}
+	buffer.Reset()
+	assert.NilError(t, execute.Write(buffer))
+	buffer.ReadByte()
+	decoded, err = ReadStmtExecute(buffer, 2, execute.ParamTypes, map[uint16][]byte{1: []byte("long")})
+	assert.NilError(t, err)
+	assert.Assert(t, !decoded.NewParamsBound)
+	assert.DeepEqual(t, decoded.Params, []interface{}{int64(5), []byte("long")})
+
+	buffer.Reset()
+	assert.NilError(t, execute.Write(buffer))
+	buffer.ReadByte()
+	_, err = ReadStmtExecute(buffer, 2, nil, nil)
+	assert.ErrorContains(t, err, "Missing param types")
+}
+
+func TestStmtFetchAndLongData(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	assert.NilError(t, (&StmtFetch{StatementID: 3, NumRows: 100}).Write(buffer))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{ComSTMTFetch, 3, 0, 0, 0, 100, 0, 0, 0})
+	buffer.ReadByte()
+	fetch, err := ReadStmtFetch(buffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, fetch, &StmtFetch{3, 100})
+
+	buffer.Reset()
+	assert.NilError(t, (&StmtSendLongData{StatementID: 3, ParamID: 1, Data: []byte("data")}).Write(buffer))
+	assert.DeepEqual(t, buffer.Bytes(), []byte{ComSTMTSendLongData, 3, 0, 0, 0, 1, 0, 'd', 'a', 't', 'a'})
+	buffer.ReadByte()
+	longData, err := ReadStmtSendLongData(buffer)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, longData, &StmtSendLongData{3, 1, []byte("data")})
+}